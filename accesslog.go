@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// access log outputs and formats
+const (
+	accessLogStdout = "stdout"
+	accessLogStderr = "stderr"
+	accessLogSyslog = "syslog"
+
+	accessLogJSON   = "json"
+	accessLogLogfmt = "logfmt"
+)
+
+// accessLog writes one line per client session
+type accessLog struct {
+	logger *slog.Logger
+	out    io.Writer
+}
+
+// newAccessLog opens access log output, it returns nil if the access log is disabled
+func newAccessLog(cfg accessLogConfig) (*accessLog, error) {
+	if cfg.Output == "" {
+		return nil, nil
+	}
+
+	out, err := openAccessLog(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("open access log: %w", err)
+	}
+
+	return newAccessLogWriter(out, cfg.Format), nil
+}
+
+func newAccessLogWriter(out io.Writer, format string) *accessLog {
+	opts := &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.LevelKey {
+				return slog.Attr{} // every line is info
+			}
+			return a
+		},
+	}
+
+	var handler slog.Handler = slog.NewJSONHandler(out, opts)
+	if format == accessLogLogfmt {
+		handler = slog.NewTextHandler(out, opts)
+	}
+
+	return &accessLog{
+		logger: slog.New(handler),
+		out:    out,
+	}
+}
+
+// openAccessLog returns the writer of configured output: stdout, stderr, syslog or file with rotation
+func openAccessLog(cfg accessLogConfig) (io.Writer, error) {
+	switch out := cfg.Output; {
+	case out == accessLogStdout:
+		return os.Stdout, nil
+	case out == accessLogStderr:
+		return os.Stderr, nil
+	case out == accessLogSyslog:
+		return dialSyslog("", "")
+	case strings.HasPrefix(out, "syslog://"):
+		return dialSyslog("udp", strings.TrimPrefix(out, "syslog://"))
+	case strings.HasPrefix(out, "syslog+tcp://"):
+		return dialSyslog("tcp", strings.TrimPrefix(out, "syslog+tcp://"))
+	}
+
+	return &lumberjack.Logger{
+		Filename:   cfg.Output,
+		MaxSize:    cfg.MaxSize,
+		MaxBackups: cfg.MaxBackups,
+		MaxAge:     cfg.MaxAge,
+		Compress:   cfg.Compress,
+		LocalTime:  true,
+	}, nil
+}
+
+// log writes the session summary
+func (l *accessLog) log(sess *session) {
+	if l == nil {
+		return
+	}
+
+	sess.mu.Lock()
+	protocol, user, req, resolved, upstream := sess.protocol, sess.user, sess.request, sess.resolved, sess.upstream
+	reply, reason := sess.reply, sess.closeReason
+	sess.mu.Unlock()
+
+	var client, destination, ip string
+	if sess.client != nil {
+		client = sess.client.String()
+	}
+	if req.cmd != 0 {
+		destination = req.String()
+	}
+	if resolved != nil {
+		ip = resolved.String()
+	}
+
+	l.logger.LogAttrs(context.Background(), slog.LevelInfo, "session",
+		slog.String("client", client),
+		slog.String("listener", sess.listener),
+		slog.String("protocol", protocol),
+		slog.String("user", user),
+		slog.String("command", commandName(req.cmd)),
+		slog.String("destination", destination),
+		slog.String("resolved_ip", ip),
+		slog.String("upstream", upstream),
+		slog.Int("reply", reply),
+		slog.Int64("bytes_in", sess.bytesIn.Load()),
+		slog.Int64("bytes_out", sess.bytesOut.Load()),
+		slog.Int64("duration_ms", time.Since(sess.start).Milliseconds()),
+		slog.String("close_reason", reason),
+	)
+}
+
+// Close closes the output if it's not stdout or stderr
+func (l *accessLog) Close() error {
+	if l == nil || l.out == os.Stdout || l.out == os.Stderr {
+		return nil
+	}
+
+	if c, ok := l.out.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+func commandName(cmd byte) string {
+	switch cmd {
+	case cmdConnect:
+		return "CONNECT"
+	case cmdBind:
+		return "BIND"
+	case cmdUDPAssociate:
+		return "UDP ASSOCIATE"
+	case 0:
+		return ""
+	}
+
+	return fmt.Sprintf("0x%02x", cmd)
+}
@@ -0,0 +1,13 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// dialSyslog connects to syslog server, empty network means local syslog
+func dialSyslog(network, addr string) (io.Writer, error) {
+	return syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, "proxyme")
+}
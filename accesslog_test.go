@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testSession() *session {
+	sess := newSession(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000})
+	sess.listener = "public"
+	sess.setUser("alice")
+	sess.setRequest(socks5Request{cmd: cmdConnect, atyp: atypDomain, addr: []byte("example.com"), port: 443})
+	sess.setTarget(socks5Request{}, net.IPv4(93, 184, 216, 34))
+	sess.setUpstream("corp")
+	sess.setReply(repSucceeded)
+	sess.bytesIn.Add(100)
+	sess.bytesOut.Add(2000)
+	sess.setCloseReason("remote closed")
+	sess.setCloseReason("closed")
+
+	return sess
+}
+
+func Test_accessLog_json(t *testing.T) {
+	var buf bytes.Buffer
+	newAccessLogWriter(&buf, accessLogJSON).log(testSession())
+
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("invalid json %q: %v", buf.String(), err)
+	}
+
+	want := map[string]any{
+		"msg":          "session",
+		"client":       "192.0.2.1:40000",
+		"listener":     "public",
+		"user":         "alice",
+		"command":      "CONNECT",
+		"destination":  "example.com:443",
+		"resolved_ip":  "93.184.216.34",
+		"upstream":     "corp",
+		"reply":        float64(repSucceeded),
+		"bytes_in":     float64(100),
+		"bytes_out":    float64(2000),
+		"close_reason": "remote closed",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+
+	for _, k := range []string{"time", "duration_ms"} {
+		if _, ok := got[k]; !ok {
+			t.Errorf("%s is missing", k)
+		}
+	}
+	if _, ok := got["level"]; ok {
+		t.Error("level must be omitted")
+	}
+}
+
+func Test_accessLog_logfmt(t *testing.T) {
+	var buf bytes.Buffer
+	newAccessLogWriter(&buf, accessLogLogfmt).log(testSession())
+
+	line := buf.String()
+	for _, field := range []string{"user=alice", "command=CONNECT", "destination=example.com:443", `close_reason="remote closed"`} {
+		if !strings.Contains(line, field) {
+			t.Errorf("%q doesn't contain %s", line, field)
+		}
+	}
+}
+
+func Test_accessLog_file(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	l, err := newAccessLog(accessLogConfig{Output: path, Format: accessLogJSON, MaxSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.log(testSession())
+	l.log(newSession(nil))
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(data, []byte("\n")); n != 2 {
+		t.Errorf("got %d lines, want 2", n)
+	}
+}
+
+func Test_accessLog_disabled(t *testing.T) {
+	l, err := newAccessLog(accessLogConfig{})
+	if err != nil || l != nil {
+		t.Fatalf("newAccessLog() = %v, %v; want nil, nil", l, err)
+	}
+
+	// nil access log is noop
+	l.log(newSession(nil))
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func Test_closeReason(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{nil, "eof"},
+		{io.EOF, "eof"},
+		{fmt.Errorf("read: %w", net.ErrClosed), ""},
+		{&net.OpError{Op: "read", Err: timeoutError{}}, "idle timeout"},
+		{errors.New("connection reset by peer"), "connection reset by peer"},
+	}
+
+	for _, tt := range tests {
+		if got := closeReason(tt.err, "eof"); got != tt.want {
+			t.Errorf("closeReason(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// acl actions
+const (
+	aclAllow = "allow"
+	aclDeny  = "deny"
+)
+
+// acl is an ordered list of destination access rules, the first matched rule makes the decision.
+// If nothing matched, the default policy is applied.
+type acl struct {
+	rules        []aclRule
+	defaultAllow bool
+}
+
+type aclRule struct {
+	name    string
+	allow   bool
+	users   map[string]struct{} // nil means any user
+	any     bool                // matches any destination
+	nets    []netip.Prefix
+	domains []string // exact domains, ".example.com" means domain and its subdomains, "*.example.com" subdomains only
+	ports   []portRange
+}
+
+type portRange struct {
+	from, to int
+}
+
+// newACL compiles acl rules from config, errors are prefixed by config key
+func newACL(cfg aclConfig) (*acl, error) {
+	var errs []error
+
+	a := &acl{
+		defaultAllow: cfg.Default != aclDeny,
+	}
+
+	if cfg.Default != "" && cfg.Default != aclAllow && cfg.Default != aclDeny {
+		errs = append(errs, fmt.Errorf("acl.default: must be allow or deny, got %q", cfg.Default))
+	}
+
+	for i, rc := range cfg.Rules {
+		key := fmt.Sprintf("acl.rules[%d]", i)
+
+		rule, err := newACLRule(rc)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s.%w", key, err))
+			continue
+		}
+
+		if rule.name == "" {
+			rule.name = key
+		}
+
+		a.rules = append(a.rules, rule)
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func newACLRule(cfg aclRuleConfig) (aclRule, error) {
+	rule := aclRule{
+		name:  cfg.Name,
+		allow: cfg.Action == aclAllow,
+	}
+
+	if cfg.Action != aclAllow && cfg.Action != aclDeny {
+		return rule, fmt.Errorf("action: must be allow or deny, got %q", cfg.Action)
+	}
+
+	if len(cfg.Users) > 0 {
+		rule.users = make(map[string]struct{}, len(cfg.Users))
+		for _, u := range cfg.Users {
+			rule.users[u] = struct{}{}
+		}
+	}
+
+	rule.any = len(cfg.Destinations) == 0
+	for i, dst := range cfg.Destinations {
+		switch prefix, addr, err := parseDestination(dst); {
+		case err != nil:
+			return rule, fmt.Errorf("destinations[%d]: %w", i, err)
+		case prefix.IsValid():
+			rule.nets = append(rule.nets, prefix)
+		case addr.IsValid():
+			rule.nets = append(rule.nets, netip.PrefixFrom(addr, addr.BitLen()))
+		case dst == "*":
+			rule.any = true
+		default:
+			rule.domains = append(rule.domains, normalizeDomain(dst))
+		}
+	}
+
+	for i, p := range cfg.Ports {
+		pr, err := parsePortRange(p)
+		if err != nil {
+			return rule, fmt.Errorf("ports[%d]: %w", i, err)
+		}
+		rule.ports = append(rule.ports, pr)
+	}
+
+	return rule, nil
+}
+
+// parseDestination parses cidr, ip or domain pattern
+func parseDestination(s string) (netip.Prefix, netip.Addr, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return prefix, netip.Addr{}, err
+		}
+		return prefix.Masked(), netip.Addr{}, nil
+	}
+
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return netip.Prefix{}, addr.Unmap(), nil
+	}
+
+	if s == "*" {
+		return netip.Prefix{}, netip.Addr{}, nil
+	}
+
+	// "*" stands for the subdomains only, "*example.com" matches nothing
+	domain := strings.TrimPrefix(s, "*.")
+	if domain == s {
+		domain = strings.TrimPrefix(s, ".")
+	}
+	if domain == "" || strings.ContainsAny(domain, "*/: ") {
+		return netip.Prefix{}, netip.Addr{}, fmt.Errorf("invalid destination %q", s)
+	}
+
+	return netip.Prefix{}, netip.Addr{}, nil
+}
+
+func parsePortRange(s string) (portRange, error) {
+	from, to, found := strings.Cut(s, "-")
+	if !found {
+		to = from
+	}
+
+	var (
+		pr  portRange
+		err error
+	)
+
+	if pr.from, err = strconv.Atoi(strings.TrimSpace(from)); err != nil {
+		return pr, fmt.Errorf("invalid port %q", s)
+	}
+	if pr.to, err = strconv.Atoi(strings.TrimSpace(to)); err != nil {
+		return pr, fmt.Errorf("invalid port %q", s)
+	}
+
+	if pr.from < 1 || pr.to > 65535 || pr.from > pr.to {
+		return pr, fmt.Errorf("invalid port range %q", s)
+	}
+
+	return pr, nil
+}
+
+func normalizeDomain(s string) string {
+	return strings.TrimSuffix(strings.ToLower(s), ".")
+}
+
+// check returns the decision for user connecting to destination and the name of matched rule.
+// domain is empty if the client requested ip address, ip is the resolved address of the destination.
+func (a *acl) check(user, domain string, ip net.IP, port int) (bool, string) {
+	addr, _ := netip.AddrFromSlice(ip)
+	addr = addr.Unmap()
+	domain = normalizeDomain(domain)
+
+	for _, rule := range a.rules {
+		if rule.match(user, domain, addr, port) {
+			return rule.allow, rule.name
+		}
+	}
+
+	return a.defaultAllow, "default"
+}
+
+// checkDomain returns the decision for user connecting to the domain before it's resolved. It's not decided
+// if a rule matching ip addresses precedes the rule matched by the domain.
+func (a *acl) checkDomain(user, domain string, port int) (allow bool, rule string, decided bool) {
+	domain = normalizeDomain(domain)
+
+	for _, rule := range a.rules {
+		match, decided := rule.matchDomainOnly(user, domain, port)
+		if !decided {
+			return false, "", false
+		}
+		if match {
+			return rule.allow, rule.name, true
+		}
+	}
+
+	return a.defaultAllow, "default", true
+}
+
+func (r aclRule) match(user, domain string, addr netip.Addr, port int) bool {
+	if r.users != nil {
+		if _, ok := r.users[user]; !ok {
+			return false
+		}
+	}
+
+	if len(r.ports) > 0 && !r.matchPort(port) {
+		return false
+	}
+
+	return r.any || r.matchAddr(addr) || r.matchDomain(domain)
+}
+
+// matchDomainOnly matches the rule without the address of the domain, it's not decided if the rule
+// matches ip addresses
+func (r aclRule) matchDomainOnly(user, domain string, port int) (match, decided bool) {
+	if r.users != nil {
+		if _, ok := r.users[user]; !ok {
+			return false, true
+		}
+	}
+
+	if len(r.ports) > 0 && !r.matchPort(port) {
+		return false, true
+	}
+
+	if r.any || r.matchDomain(domain) {
+		return true, true
+	}
+
+	return false, len(r.nets) == 0
+}
+
+func (r aclRule) matchPort(port int) bool {
+	for _, pr := range r.ports {
+		if port >= pr.from && port <= pr.to {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r aclRule) matchAddr(addr netip.Addr) bool {
+	if !addr.IsValid() {
+		return false
+	}
+
+	for _, prefix := range r.nets {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r aclRule) matchDomain(domain string) bool {
+	if domain == "" {
+		return false
+	}
+
+	for _, pattern := range r.domains {
+		switch {
+		case strings.HasPrefix(pattern, "*."):
+			if strings.HasSuffix(domain, pattern[1:]) {
+				return true
+			}
+		case strings.HasPrefix(pattern, "."):
+			if domain == pattern[1:] || strings.HasSuffix(domain, pattern) {
+				return true
+			}
+		case domain == pattern:
+			return true
+		}
+	}
+
+	return false
+}
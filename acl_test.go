@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func Test_acl_check(t *testing.T) {
+	rules, err := newACL(aclConfig{
+		Default: aclDeny,
+		Rules: []aclRuleConfig{
+			{Name: "no-smtp", Action: aclDeny, Ports: []string{"25", "465", "587"}},
+			{Name: "admin", Action: aclAllow, Users: []string{"admin"}},
+			{Name: "internal", Action: aclDeny, Destinations: []string{"10.0.0.0/8", "192.168.1.1", ".corp.example"}},
+			{Name: "web", Action: aclAllow, Ports: []string{"80", "443", "8000-8999"}},
+			{Name: "ssh", Action: aclAllow, Users: []string{"alice"}, Destinations: []string{"*.git.example", "2001:db8::/32"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("newACL() error = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		user      string
+		domain    string
+		ip        string
+		port      int
+		wantAllow bool
+		wantRule  string
+	}{
+		{"port rule has priority", "admin", "", "1.1.1.1", 25, false, "no-smtp"},
+		{"user rule", "admin", "", "10.0.0.1", 22, true, "admin"},
+		{"cidr rule", "alice", "", "10.1.2.3", 443, false, "internal"},
+		{"single ip rule", "alice", "", "192.168.1.1", 443, false, "internal"},
+		{"resolved domain is checked by cidr", "alice", "intranet.example", "10.1.2.3", 443, false, "internal"},
+		{"domain suffix rule matches apex", "", "corp.example", "1.1.1.1", 443, false, "internal"},
+		{"domain suffix rule matches subdomain", "", "WWW.Corp.Example.", "1.1.1.1", 443, false, "internal"},
+		{"domain suffix is not substring", "", "notcorp.example", "1.1.1.1", 443, true, "web"},
+		{"port range", "", "", "1.1.1.1", 8080, true, "web"},
+		{"wildcard matches subdomain", "alice", "repo.git.example", "1.1.1.1", 22, true, "ssh"},
+		{"wildcard does not match apex", "alice", "git.example", "1.1.1.1", 22, false, "default"},
+		{"ipv6 cidr", "alice", "", "2001:db8::1", 22, true, "ssh"},
+		{"ipv4 mapped ipv6", "alice", "", "::ffff:10.0.0.1", 443, false, "internal"},
+		{"user mismatch", "bob", "repo.git.example", "1.1.1.1", 22, false, "default"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allow, rule := rules.check(tt.user, tt.domain, net.ParseIP(tt.ip), tt.port)
+			if allow != tt.wantAllow || rule != tt.wantRule {
+				t.Errorf("check() = %v, %q; want %v, %q", allow, rule, tt.wantAllow, tt.wantRule)
+			}
+		})
+	}
+}
+
+func Test_acl_checkDomain(t *testing.T) {
+	rules, err := newACL(aclConfig{
+		Rules: []aclRuleConfig{
+			{Name: "blocked", Action: aclDeny, Destinations: []string{".blocked.example"}},
+			{Name: "alice", Action: aclAllow, Users: []string{"alice"}},
+			{Name: "internal", Action: aclDeny, Destinations: []string{"10.0.0.0/8", ".corp.example"}},
+			{Name: "web", Action: aclAllow, Destinations: []string{"www.example"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("newACL() error = %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		user        string
+		domain      string
+		wantAllow   bool
+		wantRule    string
+		wantDecided bool
+	}{
+		{"domain rule", "alice", "www.blocked.example", false, "blocked", true},
+		{"user rule", "alice", "www.example", true, "alice", true},
+		{"domain of rule with cidr", "bob", "wiki.corp.example", false, "internal", true},
+		{"cidr rule precedes", "bob", "www.example", false, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allow, rule, decided := rules.checkDomain(tt.user, tt.domain, 443)
+			if allow != tt.wantAllow || rule != tt.wantRule || decided != tt.wantDecided {
+				t.Errorf("checkDomain() = %v, %q, %v; want %v, %q, %v", allow, rule, decided, tt.wantAllow, tt.wantRule, tt.wantDecided)
+			}
+		})
+	}
+}
+
+func Test_acl_default(t *testing.T) {
+	rules, err := newACL(aclConfig{
+		Rules: []aclRuleConfig{{Action: aclDeny, Destinations: []string{"example.com"}}},
+	})
+	if err != nil {
+		t.Fatalf("newACL() error = %v", err)
+	}
+
+	if allow, rule := rules.check("", "example.com", net.ParseIP("1.1.1.1"), 80); allow || rule != "acl.rules[0]" {
+		t.Errorf("check() = %v, %q; want false, %q", allow, rule, "acl.rules[0]")
+	}
+	if allow, rule := rules.check("", "example.org", net.ParseIP("1.1.1.1"), 80); !allow || rule != "default" {
+		t.Errorf("check() = %v, %q; want true, %q", allow, rule, "default")
+	}
+}
+
+func Test_newACL_errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     aclConfig
+		wantErr string
+	}{
+		{
+			name:    "invalid default",
+			cfg:     aclConfig{Default: "reject"},
+			wantErr: "acl.default: must be allow or deny",
+		},
+		{
+			name:    "invalid action",
+			cfg:     aclConfig{Rules: []aclRuleConfig{{Action: "permit"}}},
+			wantErr: "acl.rules[0].action: must be allow or deny",
+		},
+		{
+			name:    "invalid cidr",
+			cfg:     aclConfig{Rules: []aclRuleConfig{{Action: aclDeny, Destinations: []string{"10.0.0.0/33"}}}},
+			wantErr: "acl.rules[0].destinations[0]",
+		},
+		{
+			name:    "invalid domain",
+			cfg:     aclConfig{Rules: []aclRuleConfig{{Action: aclDeny, Destinations: []string{"example.com", "a*b.com"}}}},
+			wantErr: "acl.rules[0].destinations[1]: invalid destination",
+		},
+		{
+			name:    "wildcard without dot",
+			cfg:     aclConfig{Rules: []aclRuleConfig{{Action: aclDeny, Destinations: []string{"*example.com"}}}},
+			wantErr: "acl.rules[0].destinations[0]: invalid destination",
+		},
+		{
+			name: "invalid port range",
+			cfg: aclConfig{Rules: []aclRuleConfig{
+				{Action: aclAllow},
+				{Action: aclDeny, Ports: []string{"9000-8000"}},
+			}},
+			wantErr: "acl.rules[1].ports[0]: invalid port range",
+		},
+		{
+			name:    "invalid port",
+			cfg:     aclConfig{Rules: []aclRuleConfig{{Action: aclDeny, Ports: []string{"http"}}}},
+			wantErr: "acl.rules[0].ports[0]: invalid port",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newACL(tt.cfg)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("newACL() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+)
+
+// defaults for auth backends, see auth_backends section of config
+const (
+	authTimeout   = 5 * time.Second
+	authCacheSize = 1000
+)
+
+// auth backend types
+const (
+	authLDAP    = "ldap"
+	authWebhook = "webhook"
+	authSQL     = "sql"
+)
+
+// errAuthBackend is the failure of all the auth backends checked the credentials, none of them rejected the credentials
+var errAuthBackend = errors.New("auth backends are unavailable")
+
+// authenticator checks username/password credentials.
+// It returns errDenied for invalid credentials and other errors if the check itself is failed.
+type authenticator interface {
+	authenticate(username, password []byte) error
+}
+
+// authChain tries the authenticators in order, the first one accepted credentials wins
+type authChain []authenticator
+
+func (c authChain) authenticate(username, password []byte) error {
+	var (
+		errs   []error
+		denied bool
+	)
+
+	for _, a := range c {
+		err := a.authenticate(username, password)
+		if err == nil {
+			return nil
+		}
+
+		if errors.Is(err, errDenied) {
+			denied = true
+		} else {
+			errs = append(errs, err)
+		}
+	}
+
+	switch {
+	case len(errs) == 0:
+		return errDenied
+	case denied:
+		return fmt.Errorf("%w: %w", errDenied, errors.Join(errs...))
+	}
+
+	return fmt.Errorf("%w: %w: %w", errDenied, errAuthBackend, errors.Join(errs...))
+}
+
+// isDenied reports the credentials are rejected by any of the authenticators, even if the others are failed.
+// The failed checks of unavailable backends alone and the attempts of banned clients are not the rejection.
+func isDenied(err error) bool {
+	return errors.Is(err, errDenied) && !errors.Is(err, errAuthBackend) && !errors.Is(err, errBanned)
+}
+
+// newAuthBackend creates authenticator by config
+func newAuthBackend(cfg authBackendConfig) (authenticator, error) {
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = authTimeout
+	}
+
+	var (
+		backend authenticator
+		err     error
+	)
+
+	switch cfg.Type {
+	case authLDAP:
+		backend = newLDAPAuth(cfg.LDAP, timeout)
+	case authWebhook:
+		backend = newWebhookAuth(cfg.Webhook, timeout)
+	case authSQL:
+		backend, err = newSQLAuth(cfg.SQL, timeout)
+	default:
+		err = fmt.Errorf("unknown auth backend %q", cfg.Type)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newCachedAuth(backend, cfg.Cache), nil
+}
+
+// cachedAuth caches the results of slow authenticator. Only the definite results (accepted and denied)
+// are cached, failed checks are not. Passwords are never kept, the cache key is a salted hash of credentials.
+type cachedAuth struct {
+	next    authenticator
+	salt    []byte
+	allowed *expirable.LRU[[sha256.Size]byte, struct{}]
+	denied  *expirable.LRU[[sha256.Size]byte, struct{}]
+}
+
+// newCachedAuth returns authenticator with cache, or the given one if caching is disabled
+func newCachedAuth(next authenticator, cfg authCacheConfig) authenticator {
+	if cfg.PositiveTTL <= 0 && cfg.NegativeTTL <= 0 {
+		return next
+	}
+
+	size := cfg.Size
+	if size == 0 {
+		size = authCacheSize
+	}
+
+	salt := make([]byte, 32)
+	_, _ = rand.Read(salt)
+
+	c := &cachedAuth{
+		next: next,
+		salt: salt,
+	}
+
+	if cfg.PositiveTTL > 0 {
+		c.allowed = expirable.NewLRU[[sha256.Size]byte, struct{}](size, nil, cfg.PositiveTTL)
+	}
+	if cfg.NegativeTTL > 0 {
+		c.denied = expirable.NewLRU[[sha256.Size]byte, struct{}](size, nil, cfg.NegativeTTL)
+	}
+
+	return c
+}
+
+func (c *cachedAuth) authenticate(username, password []byte) error {
+	key := c.key(username, password)
+
+	if c.allowed != nil && c.allowed.Contains(key) {
+		return nil
+	}
+	if c.denied != nil && c.denied.Contains(key) {
+		return errDenied
+	}
+
+	err := c.next.authenticate(username, password)
+	switch {
+	case err == nil && c.allowed != nil:
+		c.allowed.Add(key, struct{}{})
+	case errors.Is(err, errDenied) && c.denied != nil:
+		c.denied.Add(key, struct{}{})
+	}
+
+	return err
+}
+
+func (c *cachedAuth) key(username, password []byte) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write(c.salt)
+	_ = binary.Write(h, binary.BigEndian, uint32(len(username))) // nolint
+	h.Write(username)
+	h.Write(password)
+
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+
+	return key
+}
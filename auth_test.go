@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+// countingAuth is fake authenticator that counts the calls
+type countingAuth struct {
+	err   error
+	calls int
+}
+
+func (c *countingAuth) authenticate(_, _ []byte) error {
+	c.calls++
+	return c.err
+}
+
+func Test_authChain(t *testing.T) {
+	alice, _ := newUAM("alice:1234")
+	bob, _ := newUAM("bob:secret")
+
+	tests := []struct {
+		name        string
+		chain       authChain
+		username    string
+		password    string
+		expectedErr error
+		wantErr     bool
+	}{
+		{
+			name:     "first authenticator",
+			chain:    authChain{alice, bob},
+			username: "alice",
+			password: "1234",
+		},
+		{
+			name:     "second authenticator",
+			chain:    authChain{alice, bob},
+			username: "bob",
+			password: "secret",
+		},
+		{
+			name:        "denied by all",
+			chain:       authChain{alice, bob},
+			username:    "bob",
+			password:    "1234",
+			expectedErr: errDenied,
+			wantErr:     true,
+		},
+		{
+			name:     "failed backend is skipped",
+			chain:    authChain{&countingAuth{err: io.EOF}, bob},
+			username: "bob",
+			password: "secret",
+		},
+		{
+			name:        "failed backend is reported",
+			chain:       authChain{&countingAuth{err: io.EOF}, bob},
+			username:    "bob",
+			password:    "1234",
+			expectedErr: io.EOF,
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.chain.authenticate([]byte(tt.username), []byte(tt.password))
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("did not expect an error, got: %v", err)
+				}
+				return
+			}
+
+			if !errors.Is(err, tt.expectedErr) || !errors.Is(err, errDenied) {
+				t.Errorf("expected error %v, got %v", tt.expectedErr, err)
+			}
+		})
+	}
+}
+
+func Test_isDenied(t *testing.T) {
+	bob, _ := newUAM("bob:secret")
+	failed := &countingAuth{err: io.EOF}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "denied by all", err: authChain{bob}.authenticate([]byte("bob"), []byte("1234")), want: true},
+		{name: "denied while other backend failed", err: authChain{failed, bob}.authenticate([]byte("bob"), []byte("1234")), want: true},
+		{name: "all backends failed", err: authChain{failed}.authenticate([]byte("bob"), []byte("1234")), want: false},
+		{name: "backend error", err: io.EOF, want: false},
+		{name: "banned", err: fmt.Errorf("%w: client is %w", errDenied, errBanned), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isDenied(tt.err); got != tt.want {
+				t.Errorf("isDenied(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_cachedAuth(t *testing.T) {
+	cfg := authCacheConfig{
+		PositiveTTL: time.Minute,
+		NegativeTTL: time.Minute,
+	}
+
+	tests := []struct {
+		name      string
+		err       error
+		wantCalls int
+	}{
+		{"accepted credentials are cached", nil, 1},
+		{"denied credentials are cached", errDenied, 1},
+		{"failures are not cached", io.EOF, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &countingAuth{err: tt.err}
+			a := newCachedAuth(backend, cfg)
+
+			for i := 0; i < 3; i++ {
+				if err := a.authenticate([]byte("alice"), []byte("1234")); !errors.Is(err, tt.err) {
+					t.Fatalf("expected error %v, got %v", tt.err, err)
+				}
+			}
+
+			if backend.calls != tt.wantCalls {
+				t.Errorf("expected %d backend calls, got %d", tt.wantCalls, backend.calls)
+			}
+
+			// another password must not hit the cache
+			_ = a.authenticate([]byte("alice"), []byte("4321"))
+			if backend.calls != tt.wantCalls+1 {
+				t.Errorf("expected %d backend calls, got %d", tt.wantCalls+1, backend.calls)
+			}
+		})
+	}
+}
+
+func Test_newCachedAuth_disabled(t *testing.T) {
+	backend := &countingAuth{}
+	if a := newCachedAuth(backend, authCacheConfig{}); a != backend {
+		t.Errorf("expected the backend itself when caching is disabled, got %T", a)
+	}
+}
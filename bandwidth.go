@@ -0,0 +1,263 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// directions of the relayed traffic
+const (
+	upload   = iota // from the client to the remote host
+	download        // from the remote host to the client
+)
+
+const (
+	minBurst       = 4 << 10  // bucket size of the low limits, the smaller buckets make relay inefficient
+	maxChunk       = 64 << 10 // max bytes relayed at once by the limited sessions
+	unlimitedChunk = 1 << 20  // bytes relayed at once by the unlimited sessions, the limits are checked between chunks
+)
+
+// bandwidthLimit is the rate limit in bytes per second, 0 means unlimited
+type bandwidthLimit struct {
+	Upload   int `yaml:"upload"`
+	Download int `yaml:"download"`
+}
+
+// shaper limits the bandwidth by token buckets: global, per client ip and per user.
+// The buckets are shared by the sessions and survive the config reloads, the limits are changed in place.
+type shaper struct {
+	mu     sync.Mutex
+	cfg    bandwidthConfig
+	global [2]*rate.Limiter
+	ips    map[string]*bucket
+	users  map[string]*bucket
+}
+
+// bucket is a pair of upload and download limiters shared by the sessions of the same client ip or user
+type bucket struct {
+	limiters [2]*rate.Limiter
+	refs     int // the number of sessions using the bucket
+}
+
+func newShaper() *shaper {
+	return &shaper{
+		global: [2]*rate.Limiter{newLimiter(0), newLimiter(0)},
+		ips:    make(map[string]*bucket),
+		users:  make(map[string]*bucket),
+	}
+}
+
+// update applies the limits to all the buckets including the ones used by the active sessions
+func (s *shaper) update(cfg bandwidthConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cfg = cfg
+
+	setLimits(s.global, cfg.Global)
+	for _, b := range s.ips {
+		setLimits(b.limiters, cfg.PerIP)
+	}
+	for user, b := range s.users {
+		setLimits(b.limiters, cfg.userLimit(user))
+	}
+}
+
+// open returns the bandwidth limits of the session, the returned shape must be closed when the session is done
+func (s *shaper) open(sess *session) *sessionShape {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	shape := &sessionShape{
+		shaper: s,
+		sess:   sess,
+		ip:     clientKey(sess.client),
+		done:   make(chan struct{}),
+	}
+	if shape.ip != "" {
+		shape.ipBkt = s.acquire(s.ips, shape.ip, s.cfg.PerIP)
+	}
+
+	return shape
+}
+
+// acquire returns the bucket by key creating it if necessary, must be called with lock held
+func (s *shaper) acquire(buckets map[string]*bucket, key string, limit bandwidthLimit) *bucket {
+	b, ok := buckets[key]
+	if !ok {
+		b = &bucket{limiters: [2]*rate.Limiter{newLimiter(limit.Upload), newLimiter(limit.Download)}}
+		buckets[key] = b
+	}
+
+	b.refs++
+	return b
+}
+
+// release forgets the bucket unused by the sessions, must be called with lock held
+func (s *shaper) release(buckets map[string]*bucket, key string) {
+	b, ok := buckets[key]
+	if !ok {
+		return
+	}
+
+	b.refs--
+	if b.refs <= 0 {
+		delete(buckets, key)
+	}
+}
+
+// userLimit returns the limit of the user: per user override or common per user limit
+func (c bandwidthConfig) userLimit(user string) bandwidthLimit {
+	if limit, ok := c.Users[user]; ok {
+		return limit
+	}
+
+	return c.PerUser
+}
+
+// sessionShape is the set of the buckets limiting the session. The user bucket is taken once the request
+// is received: the user is authenticated by that moment.
+type sessionShape struct {
+	shaper *shaper
+	sess   *session
+	ip     string  // empty if the client is not counted per ip, see clientKey
+	ipBkt  *bucket // nil if the client is not counted per ip
+
+	mu      sync.Mutex
+	closed  bool
+	checked bool    // the user is checked, the request is received
+	user    string  // empty for the anonymous clients
+	userBkt *bucket // nil until the user is checked or for the anonymous clients
+
+	closeOnce sync.Once
+	done      chan struct{} // closed when the session is finished, interrupts throttling
+}
+
+// limiters returns the limiters of the direction applicable to the session at the moment
+func (s *sessionShape) limiters(dir int) []*rate.Limiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.checked && !s.closed && s.sess.command() != 0 {
+		s.checked = true
+		s.user = s.sess.username()
+
+		if s.user != "" {
+			s.shaper.mu.Lock()
+			s.userBkt = s.shaper.acquire(s.shaper.users, s.user, s.shaper.cfg.userLimit(s.user))
+			s.shaper.mu.Unlock()
+		}
+	}
+
+	res := []*rate.Limiter{s.shaper.global[dir]}
+	if s.ipBkt != nil {
+		res = append(res, s.ipBkt.limiters[dir])
+	}
+	if s.userBkt != nil {
+		res = append(res, s.userBkt.limiters[dir])
+	}
+
+	return res
+}
+
+// chunk returns max number of bytes of the direction relayed at once
+func (s *sessionShape) chunk(dir int) int {
+	n := unlimitedChunk
+	for _, lim := range s.limiters(dir) {
+		if lim.Limit() != rate.Inf {
+			n = min(n, maxChunk, lim.Burst())
+		}
+	}
+
+	return n
+}
+
+// unlimited reports whether none of the buckets of the direction limits the session at the moment
+func (s *sessionShape) unlimited(dir int) bool {
+	for _, lim := range s.limiters(dir) {
+		if lim.Limit() != rate.Inf {
+			return false
+		}
+	}
+
+	return true
+}
+
+// wait takes n bytes from the buckets of the direction, it waits until the buckets allow the transfer.
+// The bytes are taken after they are relayed, so the chunk may exceed the limit, but the rate does not.
+func (s *sessionShape) wait(dir int, n int) {
+	if n <= 0 {
+		return
+	}
+
+	now := time.Now()
+
+	var delay time.Duration
+	for _, lim := range s.limiters(dir) {
+		r := lim.ReserveN(now, min(n, lim.Burst()))
+		if r.OK() {
+			delay = max(delay, r.DelayFrom(now))
+		}
+	}
+
+	if delay <= 0 {
+		return
+	}
+
+	countThrottled(dir, delay)
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-s.done:
+	}
+}
+
+// close releases the buckets of the session
+func (s *sessionShape) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.closed = true
+
+		s.shaper.mu.Lock()
+		defer s.shaper.mu.Unlock()
+
+		if s.ipBkt != nil {
+			s.shaper.release(s.shaper.ips, s.ip)
+		}
+		if s.userBkt != nil {
+			s.shaper.release(s.shaper.users, s.user)
+		}
+	})
+}
+
+func newLimiter(bps int) *rate.Limiter {
+	lim := rate.NewLimiter(rate.Inf, minBurst)
+	setLimit(lim, bps)
+
+	return lim
+}
+
+// setLimits sets upload and download limits
+func setLimits(limiters [2]*rate.Limiter, limit bandwidthLimit) {
+	setLimit(limiters[upload], limit.Upload)
+	setLimit(limiters[download], limit.Download)
+}
+
+// setLimit sets the rate in bytes per second, the bucket holds one second of traffic
+func setLimit(lim *rate.Limiter, bps int) {
+	if bps <= 0 {
+		lim.SetLimit(rate.Inf)
+		return
+	}
+
+	lim.SetBurst(max(bps, minBurst))
+	lim.SetLimit(rate.Limit(bps))
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/time/rate"
+)
+
+// tcpPair returns connected tcp connections
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close()
+
+	client, err := net.Dial("tcp", ls.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := ls.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+func Test_shaper_buckets(t *testing.T) {
+	s := newShaper()
+	s.update(bandwidthConfig{
+		PerIP:   bandwidthLimit{Upload: 10000},
+		PerUser: bandwidthLimit{Download: 20000},
+		Users:   map[string]bandwidthLimit{"bob": {Download: 30000}},
+	})
+
+	client := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+
+	alice := newSession(client)
+	bob := newSession(client)
+	anonymous := newSession(client)
+
+	shapes := []*sessionShape{s.open(alice), s.open(bob), s.open(anonymous)}
+	if len(s.ips) != 1 || s.ips["192.0.2.1"].refs != 3 {
+		t.Fatalf("ip buckets = %v", s.ips)
+	}
+
+	// the user bucket is taken once the request is received
+	alice.setUser("alice")
+	bob.setUser("bob")
+	if got := len(shapes[0].limiters(download)); got != 2 {
+		t.Errorf("limiters before request = %d, want 2", got)
+	}
+
+	for _, sess := range []*session{alice, bob, anonymous} {
+		sess.setRequest(socks5Request{cmd: cmdConnect})
+	}
+
+	tests := []struct {
+		shape *sessionShape
+		want  []rate.Limit
+	}{
+		{shape: shapes[0], want: []rate.Limit{rate.Inf, rate.Inf, 20000}},
+		{shape: shapes[1], want: []rate.Limit{rate.Inf, rate.Inf, 30000}},
+		{shape: shapes[2], want: []rate.Limit{rate.Inf, rate.Inf}},
+	}
+	for i, tt := range tests {
+		var got []rate.Limit
+		for _, lim := range tt.shape.limiters(download) {
+			got = append(got, lim.Limit())
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("session %d download limits = %v, want %v", i, got, tt.want)
+		}
+	}
+
+	// limits are changed for the active sessions
+	s.update(bandwidthConfig{PerIP: bandwidthLimit{Upload: 5000}})
+	if got := shapes[0].limiters(upload)[1].Limit(); got != 5000 {
+		t.Errorf("ip upload limit = %v, want 5000", got)
+	}
+	if got := shapes[1].limiters(download)[2].Limit(); got != rate.Inf {
+		t.Errorf("bob download limit = %v, want unlimited", got)
+	}
+
+	for _, shape := range shapes {
+		shape.close()
+	}
+	if len(s.ips) != 0 || len(s.users) != 0 {
+		t.Errorf("buckets are not released: ips %d, users %d", len(s.ips), len(s.users))
+	}
+}
+
+func Test_sessionShape_wait(t *testing.T) {
+	s := newShaper()
+	s.update(bandwidthConfig{Global: bandwidthLimit{Download: 8192}})
+
+	shape := s.open(newSession(nil))
+	defer shape.close()
+
+	if got := shape.chunk(download); got != 8192 {
+		t.Errorf("chunk(download) = %d, want 8192", got)
+	}
+	if got := shape.chunk(upload); got != unlimitedChunk {
+		t.Errorf("chunk(upload) = %d, want %d", got, unlimitedChunk)
+	}
+
+	throttled := bandwidthThrottled.WithLabelValues("download")
+	before := testutil.ToFloat64(throttled)
+
+	// the full bucket is passed at once, the next half of it waits half a second
+	start := time.Now()
+	shape.wait(download, 8192)
+	shape.wait(download, 4096)
+	shape.wait(upload, 1<<20)
+
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("wait() took %s, want about 500ms", elapsed)
+	}
+	if got := testutil.ToFloat64(throttled) - before; got < 0.4 {
+		t.Errorf("throttled time = %v, want about 0.5", got)
+	}
+
+	// closed session is not throttled
+	shape.close()
+
+	start = time.Now()
+	shape.wait(download, 8192)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("wait() after close took %s", elapsed)
+	}
+}
+
+func Test_sessionShape_unlimited(t *testing.T) {
+	tests := []struct {
+		name         string
+		cfg          bandwidthConfig
+		wantUpload   bool
+		wantDownload bool
+	}{
+		{name: "no limits", wantUpload: true, wantDownload: true},
+		{name: "global download", cfg: bandwidthConfig{Global: bandwidthLimit{Download: 8192}}, wantUpload: true},
+		{name: "per ip upload", cfg: bandwidthConfig{PerIP: bandwidthLimit{Upload: 8192}}, wantDownload: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newShaper()
+			s.update(tt.cfg)
+
+			shape := s.open(newSession(nil))
+			defer shape.close()
+
+			if got := shape.unlimited(upload); got != tt.wantUpload {
+				t.Errorf("unlimited(upload) = %v, want %v", got, tt.wantUpload)
+			}
+			if got := shape.unlimited(download); got != tt.wantDownload {
+				t.Errorf("unlimited(download) = %v, want %v", got, tt.wantDownload)
+			}
+		})
+	}
+}
+
+func Test_clientConn_limited(t *testing.T) {
+	s := newShaper()
+	s.update(bandwidthConfig{Global: bandwidthLimit{Upload: 16 << 10, Download: 16 << 10}})
+
+	tests := []struct {
+		name  string
+		relay func(conn *clientConn, remote *net.TCPConn) (int64, error)
+	}{
+		{
+			name: "download",
+			relay: func(conn *clientConn, remote *net.TCPConn) (int64, error) {
+				return conn.ReadFrom(remote)
+			},
+		},
+		{
+			name: "upload",
+			relay: func(conn *clientConn, remote *net.TCPConn) (int64, error) {
+				return conn.WriteTo(remote)
+			},
+		},
+	}
+
+	data := bytes.Repeat([]byte("x"), 24<<10)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := tcpPair(t)
+			remote, target := tcpPair(t)
+
+			sess := newSession(nil)
+			conn := &clientConn{Conn: server, sess: sess, shape: s.open(sess), state: stateRelay}
+			defer conn.shape.close()
+
+			// source sends the data and finishes, sink receives everything
+			src, sink := target, client
+			if tt.name == "upload" {
+				src, sink = client, target
+			}
+
+			go func() {
+				_, _ = src.Write(data)
+				_ = src.CloseWrite()
+			}()
+
+			received := make(chan []byte, 1)
+			go func() {
+				b, _ := io.ReadAll(sink)
+				received <- b
+			}()
+
+			start := time.Now()
+			n, err := tt.relay(conn, remote)
+			if err != nil {
+				t.Fatalf("relay error = %v", err)
+			}
+			elapsed := time.Since(start)
+
+			_ = server.CloseWrite()
+			_ = remote.CloseWrite()
+
+			if n != int64(len(data)) {
+				t.Errorf("relayed %d bytes, want %d", n, len(data))
+			}
+			if got := <-received; !bytes.Equal(got, data) {
+				t.Errorf("received %d bytes, want %d", len(got), len(data))
+			}
+			// the bucket holds 16K, the rest 8K waits half a second
+			if elapsed < 400*time.Millisecond {
+				t.Errorf("relay took %s, want about 500ms", elapsed)
+			}
+		})
+	}
+}
+
+func Test_clientConn_limitedDuringRelay(t *testing.T) {
+	tests := []struct {
+		name  string
+		relay func(conn *clientConn, remote *net.TCPConn) (int64, error)
+		bytes func(sess *session) int64
+	}{
+		{
+			name: "download",
+			relay: func(conn *clientConn, remote *net.TCPConn) (int64, error) {
+				return conn.ReadFrom(remote)
+			},
+			bytes: func(sess *session) int64 { return sess.bytesOut.Load() },
+		},
+		{
+			name: "upload",
+			relay: func(conn *clientConn, remote *net.TCPConn) (int64, error) {
+				return conn.WriteTo(remote)
+			},
+			bytes: func(sess *session) int64 { return sess.bytesIn.Load() },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newShaper()
+			client, server := tcpPair(t)
+			remote, target := tcpPair(t)
+
+			sess := newSession(nil)
+			conn := &clientConn{Conn: server, sess: sess, shape: s.open(sess), state: stateRelay}
+			defer conn.shape.close()
+
+			src, sink := target, client
+			if tt.name == "upload" {
+				src, sink = client, target
+			}
+
+			relayed := make(chan int64, 1)
+			go func() {
+				n, _ := tt.relay(conn, remote)
+				_ = server.CloseWrite()
+				_ = remote.CloseWrite()
+				relayed <- n
+			}()
+
+			// the first chunk is relayed without limits, the limits are turned on in the middle of it
+			first := bytes.Repeat([]byte("x"), unlimitedChunk/2)
+			if _, err := src.Write(first); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadFull(sink, make([]byte, len(first))); err != nil {
+				t.Fatal(err)
+			}
+			s.update(bandwidthConfig{Global: bandwidthLimit{Upload: 16 << 10, Download: 16 << 10}})
+
+			start := time.Now()
+			rest := bytes.Repeat([]byte("y"), unlimitedChunk/2+24<<10)
+			go func() {
+				_, _ = src.Write(rest)
+				_ = src.CloseWrite()
+			}()
+
+			got, _ := io.ReadAll(sink)
+			n := <-relayed
+			elapsed := time.Since(start)
+
+			if want := int64(len(first) + len(rest)); n != want || int64(len(got)) != int64(len(rest)) || tt.bytes(sess) != want {
+				t.Errorf("relayed %d, received %d, counted %d bytes, want %d", n, len(got), tt.bytes(sess), want)
+			}
+			// the rest of 24K after the first chunk is limited by 16K bucket
+			if elapsed < 400*time.Millisecond {
+				t.Errorf("relay took %s after the limits are turned on, want them applied", elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// defaults, see brute_force section of config
+const (
+	bruteForceMaxFailures = 5
+	bruteForceWindow      = 10 * time.Minute
+	bruteForceBanTime     = 15 * time.Minute
+	bruteForceMaxBanTime  = 24 * time.Hour
+	bruteForceBackoff     = 500 * time.Millisecond
+	bruteForceMaxBackoff  = 8 * time.Second
+	bruteForceCacheSize   = 10000
+)
+
+// kinds of tracked attempts
+const (
+	banIP   = "ip"
+	banUser = "user"
+)
+
+var errBanned = errors.New("banned for too many failed attempts")
+
+// bruteForceGuard protects username/password authentication from password guessing. The failed attempts are
+// tracked per client ip and per username: every failure delays the reply exponentially, too many failures
+// within the window ban the ip or username. Every next ban is twice longer. The trusted networks are never
+// delayed or banned. The state is kept in bounded lru caches and survives config reloads.
+type bruteForceGuard struct {
+	mu    sync.Mutex
+	cfg   bruteForceConfig
+	allow []netip.Prefix
+	ips   *lru.Cache[string, *authAttempts]
+	users *lru.Cache[string, *authAttempts]
+}
+
+// authAttempts is the failed attempts of single ip or username
+type authAttempts struct {
+	count       int       // failures within the window
+	first       time.Time // the first failure within the window
+	bans        int       // the number of bans so far
+	bannedUntil time.Time
+}
+
+// newBruteForceGuard returns disabled guard, it's configured by update
+func newBruteForceGuard() *bruteForceGuard {
+	ips, _ := lru.New[string, *authAttempts](bruteForceCacheSize)
+	users, _ := lru.New[string, *authAttempts](bruteForceCacheSize)
+
+	return &bruteForceGuard{
+		ips:   ips,
+		users: users,
+	}
+}
+
+// parseBruteForceAllow parses the trusted networks
+func parseBruteForceAllow(cfg bruteForceConfig) ([]netip.Prefix, error) {
+	var (
+		res  []netip.Prefix
+		errs []error
+	)
+
+	for i, s := range cfg.Allow {
+		prefix, err := parsePrefix(s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("brute_force.allow[%d]: %w", i, err))
+			continue
+		}
+		res = append(res, prefix)
+	}
+
+	return res, errors.Join(errs...)
+}
+
+// update applies the config, the tracked attempts and bans are kept
+func (g *bruteForceGuard) update(cfg bruteForceConfig) error {
+	allow, err := parseBruteForceAllow(cfg)
+	if err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.cfg = cfg
+	g.allow = allow
+	g.ips.Resize(cfg.CacheSize)
+	g.users.Resize(cfg.CacheSize)
+
+	return nil
+}
+
+// enabled reports whether the attempts of the client are tracked, must be called with lock held
+func (g *bruteForceGuard) enabled(client net.Addr) bool {
+	return g.cfg.Enable && !containsAddr(g.allow, addrPortOf(client).Addr())
+}
+
+// check returns error if the client ip or username is banned. The clients are tracked by clientKey,
+// the ones not counted per ip are tracked by username only.
+func (g *bruteForceGuard) check(client net.Addr, user string) error {
+	if g == nil {
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.enabled(client) {
+		return nil
+	}
+
+	now := time.Now()
+	if f, ok := g.ips.Peek(clientKey(client)); ok && now.Before(f.bannedUntil) {
+		return fmt.Errorf("%w: client %s is %w", errDenied, clientKey(client), errBanned)
+	}
+	if f, ok := g.users.Peek(user); ok && now.Before(f.bannedUntil) {
+		return fmt.Errorf("%w: user %q is %w", errDenied, user, errBanned)
+	}
+
+	return nil
+}
+
+// failed records failed attempt and returns the delay of the reply
+func (g *bruteForceGuard) failed(client net.Addr, user string) time.Duration {
+	if g == nil {
+		return 0
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.enabled(client) {
+		return 0
+	}
+
+	countAuthFailure()
+
+	now := time.Now()
+	ipFailures := 0
+	if key := clientKey(client); key != "" {
+		ipFailures = g.fail(g.ips, banIP, key, now)
+	}
+	userFailures := g.fail(g.users, banUser, user, now)
+
+	n := max(ipFailures, userFailures) - 1
+	if n >= 16 || g.cfg.Backoff<<n > g.cfg.MaxBackoff {
+		return g.cfg.MaxBackoff
+	}
+
+	return g.cfg.Backoff << n
+}
+
+// fail counts the failure of ip or username and bans it if needed, returns the number of failures in window.
+// must be called with lock held
+func (g *bruteForceGuard) fail(cache *lru.Cache[string, *authAttempts], kind, key string, now time.Time) int {
+	f, ok := cache.Get(key)
+	if !ok {
+		f = new(authAttempts)
+		cache.Add(key, f)
+	}
+
+	if now.Sub(f.first) > g.cfg.Window {
+		f.count = 0
+		f.first = now
+	}
+	f.count++
+
+	if f.count >= g.cfg.MaxFailures && !now.Before(f.bannedUntil) {
+		ban := g.cfg.BanTime << min(f.bans, 16)
+		if ban <= 0 || ban > g.cfg.MaxBanTime {
+			ban = g.cfg.MaxBanTime
+		}
+
+		f.bans++
+		f.bannedUntil = now.Add(ban)
+		f.count = 0
+
+		countAuthBan(kind)
+		log.Printf("brute force: %s %q is banned for %s after %d failed attempts", kind, key, ban, g.cfg.MaxFailures)
+	}
+
+	return max(f.count, 1)
+}
+
+// succeeded forgets failed attempts of the username, the failures of the client ip are kept:
+// the attacker having valid credentials must not be able to reset them.
+func (g *bruteForceGuard) succeeded(user string) {
+	if g == nil {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if f, ok := g.users.Peek(user); ok {
+		f.count = 0
+	}
+}
+
+// authBan is active ban
+type authBan struct {
+	Kind  string    `json:"kind"` // ip or user
+	Key   string    `json:"key"`
+	Bans  int       `json:"bans"` // the number of bans so far
+	Until time.Time `json:"until"`
+}
+
+// bans returns the active bans
+func (g *bruteForceGuard) bans() []authBan {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	res := make([]authBan, 0)
+	now := time.Now()
+
+	for kind, cache := range map[string]*lru.Cache[string, *authAttempts]{banIP: g.ips, banUser: g.users} {
+		for _, key := range cache.Keys() {
+			if f, ok := cache.Peek(key); ok && now.Before(f.bannedUntil) {
+				res = append(res, authBan{Kind: kind, Key: key, Bans: f.bans, Until: f.bannedUntil})
+			}
+		}
+	}
+
+	slices.SortFunc(res, func(a, b authBan) int {
+		return strings.Compare(a.Kind+" "+a.Key, b.Kind+" "+b.Key)
+	})
+
+	return res
+}
+
+// unban forgets the failures and bans of the ip or username, all of them if kind is empty
+func (g *bruteForceGuard) unban(kind, key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	switch kind {
+	case banIP:
+		if addr, err := netip.ParseAddr(key); err == nil {
+			key = addr.Unmap().String()
+		}
+		g.ips.Remove(key)
+	case banUser:
+		g.users.Remove(key)
+	case "":
+		g.ips.Purge()
+		g.users.Purge()
+	}
+}
+
+// ServeHTTP lists the active bans on GET, and clears them on DELETE: all of them or the one given by
+// "ip" or "user" query parameter.
+func (g *bruteForceGuard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(g.bans())
+
+	case http.MethodDelete:
+		query := r.URL.Query()
+		switch {
+		case query.Has(banIP):
+			g.unban(banIP, query.Get(banIP))
+		case query.Has(banUser):
+			g.unban(banUser, query.Get(banUser))
+		default:
+			g.unban("", "")
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestBruteForceGuard(t *testing.T) *bruteForceGuard {
+	t.Helper()
+
+	cfg := defaultConfig().BruteForce
+	cfg.MaxFailures = 3
+	cfg.Backoff = 100 * time.Millisecond
+	cfg.MaxBackoff = 300 * time.Millisecond
+	cfg.Allow = []string{"10.0.0.0/8"}
+
+	g := newBruteForceGuard()
+	if err := g.update(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	return g
+}
+
+func Test_bruteForceGuard(t *testing.T) {
+	var (
+		attacker = &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}
+		office   = &net.TCPAddr{IP: net.ParseIP("10.1.1.1")}
+		other    = &net.TCPAddr{IP: net.ParseIP("198.51.100.1")}
+	)
+
+	g := newTestBruteForceGuard(t)
+
+	// the reply delay grows exponentially up to max
+	var delays []time.Duration
+	for i := 0; i < 2; i++ {
+		if err := g.check(attacker, "alice"); err != nil {
+			t.Fatalf("check() #%d error = %v", i, err)
+		}
+		delays = append(delays, g.failed(attacker, "alice"))
+	}
+	if delays[0] != 100*time.Millisecond || delays[1] != 200*time.Millisecond {
+		t.Errorf("delays = %v, want [100ms 200ms]", delays)
+	}
+
+	// the third failure bans both the ip and the username
+	g.failed(attacker, "alice")
+	if err := g.check(attacker, "bob"); !errors.Is(err, errDenied) {
+		t.Errorf("check(banned ip) error = %v, want %v", err, errDenied)
+	}
+	if err := g.check(other, "alice"); !errors.Is(err, errDenied) {
+		t.Errorf("check(banned user) error = %v, want %v", err, errDenied)
+	}
+	if isDenied(g.check(other, "alice")) {
+		t.Error("banned attempt is counted as denied credentials")
+	}
+
+	// trusted networks are never banned or delayed
+	if err := g.check(office, "alice"); err != nil {
+		t.Errorf("check(trusted) error = %v", err)
+	}
+	if d := g.failed(office, "carol"); d != 0 {
+		t.Errorf("failed(trusted) delay = %s, want 0", d)
+	}
+
+	bans := g.bans()
+	if len(bans) != 2 || bans[0].Kind != banIP || bans[0].Key != "192.0.2.1" || bans[1].Kind != banUser || bans[1].Key != "alice" {
+		t.Fatalf("bans() = %+v", bans)
+	}
+	if ban := time.Until(bans[0].Until); ban < 14*time.Minute || ban > bruteForceBanTime {
+		t.Errorf("ban time = %s, want %s", ban, bruteForceBanTime)
+	}
+
+	g.unban(banUser, "alice")
+	if err := g.check(other, "alice"); err != nil {
+		t.Errorf("check(unbanned user) error = %v", err)
+	}
+	if err := g.check(attacker, "alice"); err == nil {
+		t.Error("check(banned ip) error = nil")
+	}
+
+	g.unban("", "")
+	if bans := g.bans(); len(bans) != 0 {
+		t.Errorf("bans() after clear = %+v", bans)
+	}
+}
+
+func Test_bruteForceGuard_repeatedBan(t *testing.T) {
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}
+	g := newTestBruteForceGuard(t)
+
+	for ban := 1; ban <= 2; ban++ {
+		for i := 0; i < 3; i++ {
+			g.failed(client, "alice")
+		}
+
+		f, _ := g.ips.Peek(clientKey(client))
+		if got, want := time.Until(f.bannedUntil), bruteForceBanTime<<(ban-1); got > want || got < want-time.Minute {
+			t.Errorf("ban #%d time = %s, want %s", ban, got, want)
+		}
+
+		// the ban is expired
+		f.bannedUntil = time.Now()
+	}
+}
+
+func Test_bruteForceGuard_success(t *testing.T) {
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}
+	g := newTestBruteForceGuard(t)
+
+	g.failed(client, "alice")
+	g.failed(client, "alice")
+	g.succeeded("alice")
+
+	// the failures of ip are kept, the ones of user are forgotten
+	g.failed(client, "alice")
+	if err := g.check(&net.TCPAddr{IP: net.ParseIP("198.51.100.1")}, "alice"); err != nil {
+		t.Errorf("check(user) error = %v", err)
+	}
+	if err := g.check(client, "bob"); err == nil {
+		t.Error("check(ip) error = nil")
+	}
+}
+
+func Test_bruteForceGuard_disabled(t *testing.T) {
+	var g *bruteForceGuard
+	if err := g.check(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, "alice"); err != nil {
+		t.Errorf("check() error = %v", err)
+	}
+	if d := g.failed(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, "alice"); d != 0 {
+		t.Errorf("failed() = %s", d)
+	}
+}
+
+func Test_bruteForceGuard_ServeHTTP(t *testing.T) {
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}
+	g := newTestBruteForceGuard(t)
+	for i := 0; i < 3; i++ {
+		g.failed(client, "alice")
+	}
+
+	list := func() []authBan {
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/bans", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET status = %d", rec.Code)
+		}
+
+		var res []authBan
+		if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	if bans := list(); len(bans) != 2 {
+		t.Fatalf("GET = %+v, want 2 bans", bans)
+	}
+
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/bans?ip=::ffff:192.0.2.1", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE status = %d", rec.Code)
+	}
+	if bans := list(); len(bans) != 1 || bans[0].Kind != banUser {
+		t.Errorf("GET after DELETE = %+v, want user ban", bans)
+	}
+
+	rec = httptest.NewRecorder()
+	g.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/bans", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+var (
+	errClientDenied = errors.New("client address is not allowed")
+	errAuthRequired = errors.New("client must authenticate, but no auth methods are enabled")
+)
+
+// clientFilter checks the client source address right after the connection is accepted
+type clientFilter struct {
+	allow  []netip.Prefix // empty allows everyone
+	deny   []netip.Prefix // exceptions of allow list
+	noauth []netip.Prefix // the clients allowed to skip authentication, empty means everyone
+}
+
+// newClientFilter creates filter by config
+func newClientFilter(cfg clientsConfig) (*clientFilter, error) {
+	var (
+		f    = new(clientFilter)
+		errs []error
+	)
+
+	parse := func(key string, list []string) []netip.Prefix {
+		var res []netip.Prefix
+		for i, s := range list {
+			prefix, err := parsePrefix(s)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("clients.%s[%d]: %w", key, i, err))
+				continue
+			}
+			res = append(res, prefix)
+		}
+		return res
+	}
+
+	f.allow = parse("allow", cfg.Allow)
+	f.deny = parse("deny", cfg.Deny)
+	f.noauth = parse("noauth", cfg.NoAuth)
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// check returns error if the client is not allowed to connect.
+// The clients of unix socket have no address, the access to them is controlled by the socket file permissions.
+func (f *clientFilter) check(client net.Addr) error {
+	if _, ok := client.(unixPeer); ok {
+		return nil
+	}
+
+	addr := addrPortOf(client).Addr()
+
+	if containsAddr(f.deny, addr) || (len(f.allow) > 0 && !containsAddr(f.allow, addr)) {
+		return fmt.Errorf("%w: %s", errClientDenied, addr)
+	}
+
+	return nil
+}
+
+// allowNoAuth reports whether the client may skip authentication if noauth is enabled,
+// the clients of unix socket may skip it as they are allowed by the socket file permissions
+func (f *clientFilter) allowNoAuth(client net.Addr) bool {
+	if _, ok := client.(unixPeer); ok {
+		return true
+	}
+
+	return len(f.noauth) == 0 || containsAddr(f.noauth, addrPortOf(client).Addr())
+}
+
+// clientKey returns the key the client is counted by in per ip session limits, bandwidth buckets and brute force
+// protection: ip address, or user id of unix socket client. It's empty if the client is not counted per ip.
+func clientKey(client net.Addr) string {
+	if p, ok := client.(unixPeer); ok {
+		if p.uid < 0 {
+			return ""
+		}
+		return p.String()
+	}
+
+	return addrPortOf(client).Addr().String()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func Test_clientFilter(t *testing.T) {
+	f, err := newClientFilter(clientsConfig{
+		Allow:  []string{"10.0.0.0/8", "203.0.113.0/24"},
+		Deny:   []string{"10.66.0.0/16"},
+		NoAuth: []string{"10.0.0.0/8"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip         string
+		wantDenied bool
+		wantNoAuth bool
+	}{
+		{ip: "10.1.2.3", wantNoAuth: true},
+		{ip: "::ffff:10.1.2.3", wantNoAuth: true},
+		{ip: "203.0.113.10"},
+		{ip: "10.66.1.1", wantDenied: true, wantNoAuth: true},
+		{ip: "198.51.100.1", wantDenied: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			client := &net.TCPAddr{IP: net.ParseIP(tt.ip), Port: 40000}
+
+			if err := f.check(client); errors.Is(err, errClientDenied) != tt.wantDenied {
+				t.Errorf("check() error = %v, want denied %v", err, tt.wantDenied)
+			}
+			if got := f.allowNoAuth(client); got != tt.wantNoAuth {
+				t.Errorf("allowNoAuth() = %v, want %v", got, tt.wantNoAuth)
+			}
+		})
+	}
+
+	// unix socket clients have no address
+	if err := f.check(unixPeer{uid: 1000}); err != nil {
+		t.Errorf("check(unix) error = %v", err)
+	}
+	if !f.allowNoAuth(unixPeer{uid: 1000}) {
+		t.Error("allowNoAuth(unix) = false")
+	}
+}
+
+func Test_clientKey(t *testing.T) {
+	tests := []struct {
+		client net.Addr
+		want   string
+	}{
+		{client: &net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 40000}, want: "192.0.2.1"},
+		{client: unixPeer{uid: 1000}, want: "uid:1000"},
+		{client: unixPeer{uid: -1}, want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := clientKey(tt.client); got != tt.want {
+			t.Errorf("clientKey(%s) = %q, want %q", tt.client, got, tt.want)
+		}
+	}
+}
+
+func Test_clientFilter_empty(t *testing.T) {
+	f, err := newClientFilter(clientsConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 40000}
+	if err := f.check(client); err != nil {
+		t.Errorf("check() error = %v", err)
+	}
+	if !f.allowNoAuth(client) {
+		t.Error("allowNoAuth() = false")
+	}
+}
+
+func Test_settings_newProtocol_noauthNetworks(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.NoAuth = true
+	cfg.Clients.NoAuth = []string{"10.0.0.0/8"}
+
+	srv := new(server)
+	if err := srv.reload(cfg); err != nil {
+		t.Fatalf("reload() error = %v", err)
+	}
+	st := srv.settings.Load()
+
+	office := newSession(&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 40000})
+	if _, err := st.newProtocol(office, nil); err != nil {
+		t.Errorf("newProtocol(office) error = %v", err)
+	}
+
+	other := newSession(&net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 40000})
+	if _, err := st.newProtocol(other, nil); !errors.Is(err, errAuthRequired) {
+		t.Errorf("newProtocol(other) error = %v, want %v", err, errAuthRequired)
+	}
+}
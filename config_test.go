@@ -0,0 +1,461 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setEnv sets (or unsets if value is empty) environment variable for the test duration
+func setEnv(t *testing.T, key, value string) {
+	t.Helper()
+
+	old, had := os.LookupEnv(key)
+	if value == "" {
+		os.Unsetenv(key)
+	} else {
+		os.Setenv(key, value)
+	}
+
+	t.Cleanup(func() {
+		if had {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// writeFile writes content to the temporary file and returns its path
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+
+	return path
+}
+
+func Test_loadConfig_port(t *testing.T) {
+	tests := []struct {
+		name    string
+		envPort string
+		want    int
+		wantErr bool
+	}{
+		{
+			name:    "empty",
+			envPort: "",
+			want:    1080,
+		},
+		{
+			name:    "common case",
+			envPort: "9999",
+			want:    9999,
+		},
+		{
+			name:    "not a number",
+			envPort: "http",
+			wantErr: true,
+		},
+		{
+			name:    "out of range",
+			envPort: "65536",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnv(t, envConfig, "")
+			setEnv(t, envPort, tt.envPort)
+
+			cfg, err := loadConfig(nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("loadConfig() error = nil; wantErr = true")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadConfig() error = %v", err)
+			}
+
+			if cfg.Port != tt.want {
+				t.Fatalf("port = %d, want %d", cfg.Port, tt.want)
+			}
+		})
+	}
+}
+
+func Test_loadConfig_precedence(t *testing.T) {
+	path := writeFile(t, "proxyme.yaml", `
+host: 10.0.0.1
+port: 2000
+bind_ip: 10.0.0.2
+users: "file:pass"
+timeouts:
+  connect: 3s
+dns:
+  cache_size: 10
+`)
+
+	setEnv(t, envConfig, path)
+	setEnv(t, envHost, "")
+	setEnv(t, envPort, "3000")
+	setEnv(t, envBindIP, "10.0.0.3")
+	setEnv(t, envNoAuth, "")
+	setEnv(t, envUsers, "")
+	setEnv(t, envMetricsListen, "")
+
+	cfg, err := loadConfig([]string{"-port", "4000", "-noauth"})
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+
+	checks := []struct {
+		name string
+		got  any
+		want any
+	}{
+		{"host from file", cfg.Host, "10.0.0.1"},
+		{"port from flag", cfg.Port, 4000},
+		{"bind_ip from env", cfg.BindIP, "10.0.0.3"},
+		{"noauth from flag", cfg.NoAuth, true},
+		{"users from file", cfg.Users, "file:pass"},
+		{"connect timeout from file", cfg.Timeouts.Connect, 3 * time.Second},
+		{"idle timeout default", cfg.Timeouts.Idle, time.Hour},
+		{"dns cache size from file", cfg.DNS.CacheSize, 10},
+		{"dns cache ttl default", cfg.DNS.CacheTTL, dnsCacheTTL},
+	}
+
+	for _, c := range checks {
+		if c.got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, c.got, c.want)
+		}
+	}
+}
+
+func Test_config_listener(t *testing.T) {
+	path := writeFile(t, "proxyme.yaml", `
+users: "alice:secret"
+acl:
+  default: deny
+limits:
+  max_sessions: 100
+listeners:
+  - name: internal
+    listen: 10.0.0.1:1080
+    noauth: true
+    users: ""
+    auth_backends: []
+    limits:
+      max_sessions: 10
+`)
+
+	setEnv(t, envConfig, path)
+	setEnv(t, envUsers, "")
+	setEnv(t, envNoAuth, "")
+
+	cfg, err := loadConfig(nil)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+
+	l := cfg.listener(cfg.Listeners[0])
+
+	checks := []struct {
+		name string
+		got  any
+		want any
+	}{
+		{"noauth overridden", l.NoAuth, true},
+		{"users overridden", l.Users, ""},
+		{"auth backends overridden", l.Auth != nil && len(l.Auth) == 0, true},
+		{"limits overridden", l.Limits.MaxSessions, 10},
+		{"acl inherited", l.ACL.Default, "deny"},
+		{"timeouts inherited", l.Timeouts.Idle, time.Hour},
+		{"top level noauth", cfg.NoAuth, false},
+		{"top level limits", cfg.Limits.MaxSessions, 100},
+	}
+
+	for _, c := range checks {
+		if c.got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, c.got, c.want)
+		}
+	}
+}
+
+func Test_loadConfig_errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{
+			name:    "unknown key",
+			content: "timeouts:\n  conect: 3s\n",
+			wantErr: "field conect not found",
+		},
+		{
+			name:    "invalid type",
+			content: "port: http\n",
+			wantErr: "line 1",
+		},
+		{
+			name:    "invalid duration",
+			content: "timeouts:\n  idle: -1s\n",
+			wantErr: "timeouts.idle: must be positive",
+		},
+		{
+			name:    "invalid bind ip",
+			content: "bind_ip: localhost\n",
+			wantErr: "bind_ip: invalid ip address",
+		},
+		{
+			name:    "unknown auth backend",
+			content: "auth_backends:\n  - type: kerberos\n",
+			wantErr: "auth_backends[0].type: must be one of",
+		},
+		{
+			name:    "invalid auth backend",
+			content: "auth_backends:\n  - type: ldap\n    ldap:\n      url: ldap://localhost\n      bind_dn: cn=admin\n",
+			wantErr: "auth_backends[0].ldap.bind_dn: must contain {username}",
+		},
+		{
+			name:    "invalid nested value",
+			content: "dns:\n  cache_size: 0\n",
+			wantErr: "dns.cache_size: must be positive",
+		},
+		{
+			name:    "dns max ttl less than min ttl",
+			content: "dns:\n  min_ttl: 1m\n  max_ttl: 30s\n",
+			wantErr: "dns.max_ttl: must not be less than min_ttl 1m0s, got 30s",
+		},
+		{
+			name:    "negative dns ttl",
+			content: "dns:\n  negative_ttl: -1s\n",
+			wantErr: "dns.negative_ttl: must not be negative",
+		},
+		{
+			name:    "invalid dns rewrite",
+			content: "dns:\n  rewrites:\n    - domains: [.example]\n",
+			wantErr: "dns.rewrites[0].addresses: one of addresses, domain or block must be specified",
+		},
+		{
+			name:    "invalid http listen",
+			content: "http:\n  listen: 3128\n",
+			wantErr: "http.listen: address 3128: missing port in address",
+		},
+		{
+			name:    "empty socks4 username",
+			content: "socks4:\n  users:\n    app: \"\"\n",
+			wantErr: "socks4.users.app: username must not be empty",
+		},
+		{
+			name:    "tls key without cert",
+			content: "tls:\n  key: /etc/proxyme/tls.key\n",
+			wantErr: "tls.cert: must be specified with key and client_ca",
+		},
+		{
+			name:    "invalid tls min version",
+			content: "tls:\n  cert: tls.crt\n  key: tls.key\n  min_version: \"1.1\"\n",
+			wantErr: `tls.min_version: must be 1.2 or 1.3, got "1.1"`,
+		},
+		{
+			name:    "tls noauth without client ca",
+			content: "tls:\n  cert: tls.crt\n  key: tls.key\n  noauth: true\n",
+			wantErr: "tls.client_ca: is required by client_auth and noauth",
+		},
+		{
+			name:    "invalid protocol",
+			content: "protocol: socks4\n",
+			wantErr: `protocol: must be auto, socks5 or http, got "socks4"`,
+		},
+		{
+			name:    "invalid listener protocol",
+			content: "listeners:\n  - listen: :1081\n    protocol: ftp\n",
+			wantErr: `listeners[0].protocol: must be auto, socks5 or http, got "ftp"`,
+		},
+		{
+			name:    "no listeners",
+			content: "port: 0\n",
+			wantErr: "port: the main listener is disabled, but there are no listeners or http.listen",
+		},
+		{
+			name:    "invalid listener address",
+			content: "listeners:\n  - listen: 1081\n",
+			wantErr: "listeners[0].listen: address 1081: missing port in address",
+		},
+		{
+			name:    "duplicate listener",
+			content: "listeners:\n  - listen: :1081\n  - name: :1081\n    listen: :1082\n",
+			wantErr: `listeners[1].name: duplicate listener ":1081"`,
+		},
+		{
+			name:    "empty unix socket path",
+			content: "listeners:\n  - listen: \"unix:\"\n",
+			wantErr: "listeners[0].listen: unix socket path must be specified",
+		},
+		{
+			name:    "socket settings of tcp listener",
+			content: "listeners:\n  - listen: :1081\n    socket:\n      mode: \"0660\"\n",
+			wantErr: "listeners[0].socket: is only for unix socket",
+		},
+		{
+			name:    "invalid socket mode",
+			content: "listeners:\n  - listen: unix:/run/proxyme.sock\n    socket:\n      mode: rw\n",
+			wantErr: `listeners[0].socket.mode: must be octal file mode, got "rw"`,
+		},
+		{
+			name:    "invalid listener settings",
+			content: "noauth: true\nlisteners:\n  - listen: :1081\n    noauth: false\n    clients:\n      noauth: [10.0.0.0/8]\n",
+			wantErr: "listeners[0].clients.noauth: requires noauth to be enabled",
+		},
+		{
+			name:    "invalid access log format",
+			content: "access_log:\n  format: xml\n",
+			wantErr: "access_log.format: must be json or logfmt",
+		},
+		{
+			name:    "invalid gssapi protection",
+			content: "gssapi:\n  protection: privacy\n",
+			wantErr: "gssapi.protection: must be integrity or confidentiality",
+		},
+		{
+			name:    "invalid udp idle timeout",
+			content: "udp:\n  idle_timeout: -1s\n",
+			wantErr: "udp.idle_timeout: must be positive",
+		},
+		{
+			name:    "invalid brute force allow list",
+			content: "brute_force:\n  allow: [10.0.0.0/33]\n",
+			wantErr: "brute_force.allow[0]",
+		},
+		{
+			name:    "noauth networks without noauth",
+			content: "clients:\n  noauth: [10.0.0.0/8]\n",
+			wantErr: "clients.noauth: requires noauth to be enabled",
+		},
+		{
+			name:    "invalid client allow list",
+			content: "clients:\n  allow: [office]\n",
+			wantErr: "clients.allow[0]",
+		},
+		{
+			name:    "negative session limit",
+			content: "limits:\n  max_sessions_per_ip: -1\n",
+			wantErr: "limits: max_sessions, max_sessions_per_ip and max_sessions_per_user must not be negative",
+		},
+		{
+			name:    "negative bandwidth limit",
+			content: "bandwidth:\n  users:\n    alice:\n      upload: -1\n",
+			wantErr: "bandwidth.users.alice: upload and download must not be negative",
+		},
+		{
+			name:    "negative metrics user labels",
+			content: "metrics:\n  user_labels: -1\n",
+			wantErr: "metrics.user_labels: must not be negative",
+		},
+		{
+			name:    "invalid upstream proxy scheme",
+			content: "upstreams:\n  - proxies: [https://proxy.example.com:3128]\n",
+			wantErr: "upstreams[0].proxies[0]: scheme must be socks5 or http",
+		},
+		{
+			name:    "unknown outbound pool",
+			content: "outbound:\n  pools:\n    - name: main\n      addresses: [203.0.113.10]\n  users:\n    alice: premium\n",
+			wantErr: `outbound.users.alice: unknown pool "premium"`,
+		},
+		{
+			name:    "invalid dial family",
+			content: "dial:\n  family: ipv4\n",
+			wantErr: "dial.family: must be v4_first, v6_first, v4_only or v6_only",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnv(t, envConfig, "")
+			setEnv(t, envPort, "")
+			setEnv(t, envBindIP, "")
+
+			path := writeFile(t, "proxyme.yaml", tt.content)
+
+			_, err := loadConfig([]string{"-config", path})
+			if err == nil {
+				t.Fatalf("loadConfig() error = nil, want %q", tt.wantErr)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("loadConfig() error = %q, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_loadConfig_json(t *testing.T) {
+	setEnv(t, envPort, "")
+
+	path := writeFile(t, "proxyme.json", `{"port": 1081, "keepalive": {"enable": false}}`)
+
+	cfg, err := loadConfig([]string{"-config", path})
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+
+	if cfg.Port != 1081 || cfg.KeepAlive.Enable {
+		t.Fatalf("got port %d keepalive %v, want 1081 false", cfg.Port, cfg.KeepAlive.Enable)
+	}
+}
+
+func Test_loadConfig_toml(t *testing.T) {
+	setEnv(t, envPort, "")
+
+	path := writeFile(t, "proxyme.toml", `
+port = 1081
+
+[keepalive]
+enable = false
+
+[dns]
+cache_ttl = "30s"
+
+[[upstreams]]
+name = "corp"
+proxies = ["socks5://192.0.2.1:1080"]
+destinations = [".corp.example.com"]
+`)
+
+	cfg, err := loadConfig([]string{"-config", path})
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+
+	if cfg.Port != 1081 || cfg.KeepAlive.Enable || cfg.DNS.CacheTTL != 30*time.Second || len(cfg.Upstreams) != 1 || cfg.Upstreams[0].Name != "corp" {
+		t.Fatalf("got port %d keepalive %v dns ttl %s upstreams %+v", cfg.Port, cfg.KeepAlive.Enable, cfg.DNS.CacheTTL, cfg.Upstreams)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{name: "unknown key", content: "[dns]\ncache_ttl = \"30s\"\ncache_tll = \"1m\"\n", wantErr: "dns.cache_tll: field cache_tll not found"},
+		{name: "unknown key of array", content: "[[upstreams]]\nname = \"corp\"\nproxy = \"x\"\n", wantErr: "upstreams[0].proxy: field proxy not found"},
+		{name: "invalid value", content: "port = \"http\"\n", wantErr: "port: cannot unmarshal"},
+		{name: "invalid toml", content: "port = \n", wantErr: "proxyme.toml"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig([]string{"-config", writeFile(t, "proxyme.toml", tt.content)})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("loadConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
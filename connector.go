@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/dblokhin/proxyme"
+)
+
+// address family preferences, see dial section of config
+const (
+	familyV4First = "v4_first"
+	familyV6First = "v6_first"
+	familyV4Only  = "v4_only"
+	familyV6Only  = "v6_only"
+)
+
+// connectionAttemptDelay is the default delay of the next address attempt, RFC 8305
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// connector establishes connections to the remote servers on behalf of socks5 clients
+type connector struct {
+	resolver *resolver     // dns resolver with lru cache
+	acl      *acl          // destination access rules
+	upstream upstreams     // parent proxies forwarding rules, empty if all destinations are dialed directly
+	outbound *outbound     // source addresses of the connections
+	guard    *egressGuard  // internal networks protection, nil if disabled
+	timeout  time.Duration // max connection time
+
+	family         string        // address family preference
+	attemptTimeout time.Duration // max time of single address attempt, 0 means no limit but timeout
+	fallbackDelay  time.Duration // the delay of the next address attempt
+}
+
+// routing is the dns resolver, parent proxies and source addresses shared by all the listeners. Their state:
+// dns cache, failed parents and round robin counters, is kept on reload unless their config is changed.
+type routing struct {
+	dns       dnsConfig
+	upstreams []upstreamConfig
+	outbound  outboundConfig
+
+	resolver *resolver
+	upstream upstreams
+	out      *outbound
+}
+
+// newRouting builds the routing by config, the parts of prev with the same config are reused. prev may be nil.
+func newRouting(cfg config, prev *routing) (*routing, error) {
+	rt := &routing{
+		dns:       cfg.DNS,
+		upstreams: cfg.Upstreams,
+		outbound:  cfg.Outbound,
+	}
+
+	var err error
+
+	if prev != nil && reflect.DeepEqual(prev.dns, cfg.DNS) {
+		rt.resolver = prev.resolver
+	} else if rt.resolver, err = newDNSResolver(cfg.DNS); err != nil {
+		return nil, err
+	}
+
+	if prev != nil && reflect.DeepEqual(prev.upstreams, cfg.Upstreams) {
+		rt.upstream = prev.upstream
+	} else if rt.upstream, err = newUpstreams(cfg.Upstreams); err != nil {
+		return nil, err
+	}
+
+	if prev != nil && reflect.DeepEqual(prev.outbound, cfg.Outbound) {
+		rt.out = prev.out
+	} else if rt.out, err = newOutbound(cfg.Outbound); err != nil {
+		return nil, err
+	}
+
+	return rt, nil
+}
+
+// newDNSResolver creates caching resolver with static hosts and rewrite rules using the configured dns servers,
+// the system ones if not configured
+func newDNSResolver(cfg dnsConfig) (*resolver, error) {
+	dns, err := newDNSRouter(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	overrides, err := newDNSOverrides(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	res := newResolver(cfg)
+	res.overrides = overrides
+	if dns != nil {
+		res.resolver = dns
+	}
+
+	return res, nil
+}
+
+// newConnector creates connector by config, the routing is shared with the other connectors
+func newConnector(cfg config, rt *routing) (connector, error) {
+	rules, err := newACL(cfg.ACL)
+	if err != nil {
+		return connector{}, err
+	}
+
+	guard, err := newEgressGuard(cfg.Egress)
+	if err != nil {
+		return connector{}, err
+	}
+
+	return connector{
+		resolver: rt.resolver,
+		acl:      rules,
+		upstream: rt.upstream,
+		outbound: rt.out,
+		guard:    guard,
+		timeout:  cfg.Timeouts.Connect,
+
+		family:         cfg.Dial.Family,
+		attemptTimeout: cfg.Dial.AttemptTimeout,
+		fallbackDelay:  cfg.Dial.FallbackDelay,
+	}, nil
+}
+
+// connect connects to remote server using dns resolver with lru cache
+func (c connector) connect(sess *session, addressType int, addr []byte, port int) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.TODO(), c.timeout)
+	defer cancel()
+
+	start := time.Now()
+	req := socks5Request{cmd: cmdConnect, atyp: byte(addressType), addr: addr, port: port} // nolint
+
+	// the denied domains are not resolved, the forwarded ones are resolved by the parent proxy
+	if addressType == atypDomain {
+		if err := c.authorizeDomain(sess, string(addr), port); err != nil {
+			return nil, err
+		}
+
+		sess.setTarget(req, nil)
+		if conn, ok, err := c.forwardDomain(ctx, sess, string(addr), port); ok {
+			if err != nil {
+				countDialError(err)
+				return nil, err
+			}
+
+			connectDuration.Observe(time.Since(start).Seconds())
+			return conn, nil
+		}
+	}
+
+	domain, ips, err := c.resolve(ctx, addressType, addr)
+	if err != nil {
+		countDialError(err)
+		return nil, err
+	}
+
+	sess.setTarget(req, ips[0])
+
+	ips, err = c.authorize(sess, domain, ips, port)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, ip, err := c.forward(ctx, sess, domain, ips, port)
+	if err != nil {
+		countDialError(err)
+		return nil, err
+	}
+
+	sess.setTarget(req, ip)
+	connectDuration.Observe(time.Since(start).Seconds())
+
+	return conn, nil
+}
+
+// forward connects to the destination through the matched upstream, or directly if nothing matched.
+// The parent proxy gets the domain requested by the client and resolves it on its own.
+// It returns the connection and the address connected to.
+func (c connector) forward(ctx context.Context, sess *session, domain string, ips []net.IP, port int) (net.Conn, net.IP, error) {
+	u := c.upstream.match(sess.username(), domain, ips[0], port)
+	if u == nil {
+		return c.dialAddrs(ctx, sess, ips, port)
+	}
+
+	host := domain
+	if host == "" {
+		host = ips[0].String()
+	}
+
+	conn, err := c.dialUpstream(ctx, sess, u, host, port)
+	return conn, ips[0], err
+}
+
+// forwardDomain connects to the domain through the parent proxy without resolving it. It's done only if
+// the domain is allowed by the acl rules and matched by the forwarding rule without its addresses, ok is false
+// otherwise and the domain is resolved to check the rules matching ip addresses.
+func (c connector) forwardDomain(ctx context.Context, sess *session, domain string, port int) (conn net.Conn, ok bool, err error) {
+	allow, rule, decided := c.acl.checkDomain(sess.username(), domain, port)
+	if !decided || !allow {
+		return nil, false, nil
+	}
+
+	u, decided := c.upstream.matchDomain(sess.username(), domain, port)
+	if !decided || u == nil {
+		return nil, false, nil
+	}
+
+	countACLDecision(true, rule)
+
+	conn, err = c.dialUpstream(ctx, sess, u, domain, port)
+	return conn, true, err
+}
+
+// dialUpstream connects to the destination host through the parent proxies of the forwarding rule,
+// the parents are connected from the source address of the session
+func (c connector) dialUpstream(ctx context.Context, sess *session, u *upstream, host string, port int) (net.Conn, error) {
+	sess.setUpstream(u.name)
+
+	return u.dial(ctx, func(ip net.IP) (*net.Dialer, error) {
+		return c.outbound.dialer(sess, ip)
+	}, host, port)
+}
+
+// dialAddrs connects to the first responding address, RFC 8305 "Happy Eyeballs". The addresses are tried in
+// order, the next attempt is started when the previous one failed or after fallback delay, whichever is first.
+// The first established connection wins, the others are canceled.
+func (c connector) dialAddrs(ctx context.Context, sess *session, ips []net.IP, port int) (net.Conn, net.IP, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type attempt struct {
+		conn net.Conn
+		ip   net.IP
+		err  error
+	}
+
+	var (
+		results  = make(chan attempt, len(ips))
+		next     int
+		running  int
+		firstErr error
+	)
+
+	startNext := func() {
+		ip := ips[next]
+		next++
+		running++
+
+		go func() {
+			conn, err := c.dialAttempt(ctx, sess, ip, port)
+			results <- attempt{conn: conn, ip: ip, err: err}
+		}()
+	}
+
+	startNext()
+	fallback := time.NewTimer(c.fallbackDelay)
+	defer fallback.Stop()
+
+	for running > 0 {
+		select {
+		case <-fallback.C:
+			if next < len(ips) {
+				startNext()
+				fallback.Reset(c.fallbackDelay)
+			}
+
+		case a := <-results:
+			running--
+			countDialAttempt(a.ip, a.err == nil)
+
+			if a.err == nil {
+				// the attempts lost the race are closed on finish
+				go func(n int) {
+					for ; n > 0; n-- {
+						if a := <-results; a.conn != nil {
+							_ = a.conn.Close()
+						}
+					}
+				}(running)
+
+				return a.conn, a.ip, nil
+			}
+
+			if firstErr == nil {
+				firstErr = a.err
+			}
+			if next < len(ips) {
+				startNext()
+				fallback.Reset(c.fallbackDelay)
+			}
+		}
+	}
+
+	return nil, nil, firstErr
+}
+
+// dialAttempt connects to the single address from the source address of the session
+func (c connector) dialAttempt(ctx context.Context, sess *session, ip net.IP, port int) (net.Conn, error) {
+	d, err := c.outbound.dialer(sess, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.attemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.attemptTimeout)
+		defer cancel()
+	}
+
+	return c.dial(ctx, d, ip, port)
+}
+
+// dial connects to the remote address, the errors are mapped to socks5 reply codes
+func (c connector) dial(ctx context.Context, d *net.Dialer, ip net.IP, port int) (net.Conn, error) {
+	dialAddr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+
+	conn, err := d.DialContext(ctx, "tcp", dialAddr)
+	if err != nil {
+		if errors.Is(err, syscall.EHOSTUNREACH) {
+			return conn, fmt.Errorf("%w: %v", proxyme.ErrHostUnreachable, err)
+		}
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return conn, fmt.Errorf("%w: %v", proxyme.ErrConnectionRefused, err)
+		}
+		if errors.Is(err, syscall.ENETUNREACH) {
+			return conn, fmt.Errorf("%w: %v", proxyme.ErrNetworkUnreachable, err)
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return conn, fmt.Errorf("%w: %v", proxyme.ErrTTLExpired, err)
+		}
+		return conn, err
+	}
+
+	_ = conn.(*net.TCPConn).SetLinger(0) // nolint
+
+	return conn, nil
+}
+
+// resolve returns the addresses of the destination in the order of dialing, domain is empty if the destination
+// is ip address. The addresses of disabled family are skipped.
+func (c connector) resolve(ctx context.Context, addressType int, addr []byte) (string, []net.IP, error) {
+	if addressType != atypDomain {
+		ips := sortAddrs([]net.IP{addr}, c.family)
+		if len(ips) == 0 {
+			return "", nil, fmt.Errorf("%w: %s is disabled by %s", proxyme.ErrNetworkUnreachable, net.IP(addr), c.family)
+		}
+
+		return "", ips, nil
+	}
+
+	ips, err := c.resolver.lookupDomain(ctx, addr)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %v", proxyme.ErrHostUnreachable, err)
+	}
+
+	ips = sortAddrs(ips, c.family)
+	if len(ips) == 0 {
+		return "", nil, fmt.Errorf("%w: %s has no addresses allowed by %s", proxyme.ErrHostUnreachable, addr, c.family)
+	}
+
+	return string(addr), ips, nil
+}
+
+// sortAddrs returns the addresses of allowed families interleaved starting with the preferred family, RFC 8305
+func sortAddrs(ips []net.IP, family string) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	switch family {
+	case familyV4Only:
+		return v4
+	case familyV6Only:
+		return v6
+	case familyV6First:
+		v4, v6 = v6, v4
+	}
+
+	res := make([]net.IP, 0, len(ips))
+	for i := 0; i < max(len(v4), len(v6)); i++ {
+		if i < len(v4) {
+			res = append(res, v4[i])
+		}
+		if i < len(v6) {
+			res = append(res, v6[i])
+		}
+	}
+
+	return res
+}
+
+// authorizeDomain checks the domain by the acl rules before resolving it. The domain allowed by the rules, or
+// not decided by them, is checked again with the resolved addresses.
+func (c connector) authorizeDomain(sess *session, domain string, port int) error {
+	allow, rule, decided := c.acl.checkDomain(sess.username(), domain, port)
+	if !decided || allow {
+		return nil
+	}
+
+	countACLDecision(false, rule)
+	return fmt.Errorf("%w: %s by %s", proxyme.ErrNotAllowed, net.JoinHostPort(domain, strconv.Itoa(port)), rule)
+}
+
+// authorize returns the addresses the session is allowed to connect to. The acl decision is counted once:
+// by the first allowed address, or by the first denied one if nothing is allowed.
+func (c connector) authorize(sess *session, domain string, ips []net.IP, port int) ([]net.IP, error) {
+	var (
+		allowed    []net.IP
+		denied     error
+		deniedRule string
+	)
+
+	for _, ip := range ips {
+		// the resolved address is checked and dialed as is, so dns rebinding is not possible
+		if !c.guard.allowed(ip) {
+			if denied == nil {
+				denied = fmt.Errorf("%w: %s is internal address", proxyme.ErrNotAllowed, ip)
+			}
+			continue
+		}
+
+		allow, rule := c.acl.check(sess.username(), domain, ip, port)
+		if !allow {
+			if deniedRule == "" {
+				deniedRule = rule
+			}
+			if denied == nil {
+				denied = fmt.Errorf("%w: %s by %s", proxyme.ErrNotAllowed, net.JoinHostPort(ip.String(), strconv.Itoa(port)), rule)
+			}
+			continue
+		}
+
+		if len(allowed) == 0 {
+			countACLDecision(true, rule)
+		}
+		allowed = append(allowed, ip)
+	}
+
+	if len(allowed) == 0 {
+		if deniedRule != "" {
+			countACLDecision(false, deniedRule)
+		}
+		return nil, denied
+	}
+
+	return allowed, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dblokhin/proxyme"
+)
+
+func Test_sortAddrs(t *testing.T) {
+	var (
+		a4 = net.IPv4(192, 0, 2, 1)
+		b4 = net.IPv4(192, 0, 2, 2)
+		a6 = net.ParseIP("2001:db8::1")
+		b6 = net.ParseIP("2001:db8::2")
+		c6 = net.ParseIP("2001:db8::3")
+	)
+
+	ips := []net.IP{a6, b6, a4, c6, b4}
+
+	tests := []struct {
+		family string
+		want   []net.IP
+	}{
+		{family: familyV4First, want: []net.IP{a4, a6, b4, b6, c6}},
+		{family: familyV6First, want: []net.IP{a6, a4, b6, b4, c6}},
+		{family: familyV4Only, want: []net.IP{a4, b4}},
+		{family: familyV6Only, want: []net.IP{a6, b6, c6}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.family, func(t *testing.T) {
+			got := sortAddrs(ips, tt.family)
+			if len(got) != len(tt.want) {
+				t.Fatalf("sortAddrs() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if !got[i].Equal(tt.want[i]) {
+					t.Fatalf("sortAddrs() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// newTestConnector returns connector resolving any domain to ips
+func newTestConnector(t *testing.T, ips ...net.IP) connector {
+	t.Helper()
+
+	rules, err := newACL(aclConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newResolver(dnsConfig{CacheSize: 10, CacheTTL: time.Minute})
+	r.resolver = fakeResolver{
+		fnLookupIP: func(context.Context, string, string) ([]net.IP, error) {
+			return ips, nil
+		},
+	}
+
+	return connector{
+		resolver:      r,
+		acl:           rules,
+		timeout:       time.Second,
+		family:        familyV4First,
+		fallbackDelay: connectionAttemptDelay,
+	}
+}
+
+func Test_connector_connect_fallback(t *testing.T) {
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close()
+
+	port := ls.Addr().(*net.TCPAddr).Port
+
+	// nothing listens on 127.0.0.2, the connection is refused
+	c := newTestConnector(t, net.IPv4(127, 0, 0, 2), net.IPv4(127, 0, 0, 1))
+	sess := newSession(nil)
+
+	conn, err := c.connect(sess, atypDomain, []byte("example.com"), port)
+	if err != nil {
+		t.Fatalf("connect() error = %v", err)
+	}
+	_ = conn.Close()
+
+	if !sess.resolved.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("resolved ip = %s, want the connected one 127.0.0.1", sess.resolved)
+	}
+
+	// all the addresses failed
+	ls.Close()
+	if _, err := c.connect(newSession(nil), atypDomain, []byte("example.com"), port); !errors.Is(err, proxyme.ErrConnectionRefused) {
+		t.Errorf("connect() error = %v, want %v", err, proxyme.ErrConnectionRefused)
+	}
+}
+
+func Test_connector_connect_deniedDomain(t *testing.T) {
+	c := newTestConnector(t)
+	c.resolver.resolver = fakeResolver{
+		fnLookupIP: func(context.Context, string, string) ([]net.IP, error) {
+			t.Error("denied domain is resolved")
+			return nil, errors.New("lookup failed")
+		},
+	}
+
+	rules, err := newACL(aclConfig{Rules: []aclRuleConfig{{Action: aclDeny, Destinations: []string{".blocked.example"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.acl = rules
+
+	if _, err := c.connect(newSession(nil), atypDomain, []byte("www.blocked.example"), 443); !errors.Is(err, proxyme.ErrNotAllowed) {
+		t.Errorf("connect() error = %v, want %v", err, proxyme.ErrNotAllowed)
+	}
+}
+
+func Test_connector_connect_forwardedDomain(t *testing.T) {
+	c := newTestConnector(t)
+	c.resolver.resolver = fakeResolver{
+		fnLookupIP: func(context.Context, string, string) ([]net.IP, error) {
+			t.Error("forwarded domain is resolved")
+			return nil, errors.New("no such host")
+		},
+	}
+
+	us, err := newUpstreams([]upstreamConfig{{
+		Name:         "corp",
+		Proxies:      []string{"http://alice:secret@" + fakeHTTPParent(t, http.StatusOK)},
+		Destinations: []string{".corp.example.com"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.upstream = us
+
+	sess := newSession(nil)
+	conn, err := c.connect(sess, atypDomain, []byte("git.corp.example.com"), 443)
+	if err != nil {
+		t.Fatalf("connect() error = %v", err)
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	got, _ := io.ReadAll(conn)
+	if string(got) != "git.corp.example.com:443" {
+		t.Errorf("parent got %q, want git.corp.example.com:443", got)
+	}
+	if sess.upstream != "corp" || sess.resolved != nil {
+		t.Errorf("session upstream = %q, resolved = %v, want corp and nothing resolved", sess.upstream, sess.resolved)
+	}
+}
+
+func Test_connector_dialAddrs_attemptTimeout(t *testing.T) {
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close()
+
+	port := ls.Addr().(*net.TCPAddr).Port
+
+	// the documentation address either times out or is unreachable, the next address is tried anyway
+	c := newTestConnector(t)
+	c.attemptTimeout = 100 * time.Millisecond
+	c.fallbackDelay = time.Minute
+
+	start := time.Now()
+	conn, ip, err := c.dialAddrs(context.Background(), newSession(nil), []net.IP{net.IPv4(192, 0, 2, 1), net.IPv4(127, 0, 0, 1)}, port)
+	if err != nil {
+		t.Fatalf("dialAddrs() error = %v", err)
+	}
+	_ = conn.Close()
+
+	if !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("dialAddrs() ip = %s, want 127.0.0.1", ip)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("dialAddrs() took %s", elapsed)
+	}
+}
+
+func Test_connector_resolve_family(t *testing.T) {
+	c := newTestConnector(t, net.ParseIP("2001:db8::1"))
+	c.family = familyV4Only
+
+	if _, _, err := c.resolve(context.Background(), atypDomain, []byte("example.com")); !errors.Is(err, proxyme.ErrHostUnreachable) {
+		t.Errorf("resolve(domain) error = %v, want %v", err, proxyme.ErrHostUnreachable)
+	}
+	if _, _, err := c.resolve(context.Background(), atypIPv6, net.ParseIP("2001:db8::1")); !errors.Is(err, proxyme.ErrNetworkUnreachable) {
+		t.Errorf("resolve(ipv6) error = %v, want %v", err, proxyme.ErrNetworkUnreachable)
+	}
+}
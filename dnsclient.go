@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dns server schemes
+const (
+	dnsUDP   = "udp"   // udp with tcp fallback for truncated replies
+	dnsTCP   = "tcp"   // tcp only
+	dnsTLS   = "tls"   // DNS-over-TLS, RFC 7858
+	dnsHTTPS = "https" // DNS-over-HTTPS, RFC 8484
+)
+
+// defaults, see dns section of config
+const (
+	dnsTimeout      = 5 * time.Second
+	dnsMaxReplySize = 65535
+	dnsUDPSize      = 1232 // max udp reply size advertised by EDNS0, RFC 6891
+)
+
+// dnsRouter resolves domains using configured dns servers instead of the system resolver. The domains matched by
+// the route are resolved by its servers (split horizon), the others by the default servers. The servers of the
+// route are tried in order until one of them replies, "not found" reply is final.
+type dnsRouter struct {
+	routes   []dnsRoute
+	servers  []*dnsServer // default servers, empty means the system resolver
+	fallback interface {
+		LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+	}
+	timeout time.Duration // max time of the query to single server
+}
+
+type dnsRoute struct {
+	rule    aclRule // only domains of the rule are used
+	servers []*dnsServer
+}
+
+// dnsServer is single dns server
+type dnsServer struct {
+	url       string
+	scheme    string
+	addr      string // host:port, empty for https
+	tlsConfig *tls.Config
+	client    *http.Client
+}
+
+// newDNSRouter creates resolver by config, it returns nil if the system resolver is used for all the domains.
+// Errors are prefixed by config key.
+func newDNSRouter(cfg dnsConfig) (*dnsRouter, error) {
+	if len(cfg.Servers) == 0 && len(cfg.Routes) == 0 {
+		return nil, nil
+	}
+
+	var errs []error
+
+	r := &dnsRouter{
+		fallback: net.DefaultResolver,
+		timeout:  cfg.Timeout,
+	}
+	if r.timeout == 0 {
+		r.timeout = dnsTimeout
+	}
+
+	parseServers := func(key string, list []string) []*dnsServer {
+		var res []*dnsServer
+		for i, s := range list {
+			server, err := newDNSServer(s)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s[%d]: %w", key, i, err))
+				continue
+			}
+			res = append(res, server)
+		}
+		return res
+	}
+
+	r.servers = parseServers("dns.servers", cfg.Servers)
+
+	for i, rc := range cfg.Routes {
+		key := fmt.Sprintf("dns.routes[%d]", i)
+
+		rule, err := newACLRule(aclRuleConfig{Action: aclAllow, Destinations: rc.Domains})
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("%s.%w", key, err))
+		case len(rc.Domains) == 0 || rule.any || len(rule.nets) > 0:
+			errs = append(errs, fmt.Errorf("%s.domains: must be domain names", key))
+		case len(rc.Servers) == 0:
+			errs = append(errs, fmt.Errorf("%s.servers: must be specified", key))
+		}
+
+		r.routes = append(r.routes, dnsRoute{
+			rule:    rule,
+			servers: parseServers(key+".servers", rc.Servers),
+		})
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// newDNSServer parses server url: udp://ip:port, tcp://ip:port, tls://host:port, https://host/path.
+// The scheme is udp and the port is 53 if omitted. The server name of tls certificate is the host
+// or server_name query parameter.
+func newDNSServer(s string) (*dnsServer, error) {
+	if !strings.Contains(s, "://") {
+		s = dnsUDP + "://" + s
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dns server: %w", err)
+	}
+
+	server := &dnsServer{
+		url:    s,
+		scheme: u.Scheme,
+		addr:   u.Host,
+	}
+
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("host must be specified, got %q", s)
+	}
+
+	switch u.Scheme {
+	case dnsUDP, dnsTCP:
+		if _, err := netip.ParseAddr(u.Hostname()); err != nil {
+			return nil, fmt.Errorf("host must be ip address, got %q", u.Hostname())
+		}
+		if u.Port() == "" {
+			server.addr = net.JoinHostPort(u.Hostname(), "53")
+		}
+	case dnsTLS:
+		if u.Port() == "" {
+			server.addr = net.JoinHostPort(u.Hostname(), "853")
+		}
+		server.tlsConfig = &tls.Config{
+			ServerName: u.Hostname(),
+			MinVersion: tls.VersionTLS12,
+		}
+		if name := u.Query().Get("server_name"); name != "" {
+			server.tlsConfig.ServerName = name
+		}
+	case dnsHTTPS:
+		server.addr = ""
+		server.client = &http.Client{
+			Transport: &http.Transport{
+				Proxy:             nil, // never send dns queries through the environment proxy
+				ForceAttemptHTTP2: true,
+				TLSClientConfig:   &tls.Config{MinVersion: tls.VersionTLS12},
+			},
+		}
+	default:
+		return nil, fmt.Errorf("scheme must be udp, tcp, tls or https, got %q", u.Scheme)
+	}
+
+	return server, nil
+}
+
+// LookupIP resolves the domain by the servers of matched route
+func (r *dnsRouter) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	ips, _, err := r.lookupIPTTL(ctx, network, host)
+	return ips, err
+}
+
+// lookupIPTTL resolves the domain by the servers of matched route and returns the ttl of the addresses, or the ttl
+// of "not found" reply. The ttl is ttlUnknown if the domain is resolved by the system resolver.
+func (r *dnsRouter) lookupIPTTL(ctx context.Context, network, host string) ([]net.IP, time.Duration, error) {
+	servers := r.servers
+
+	domain := normalizeDomain(host)
+	for _, route := range r.routes {
+		if route.rule.matchDomain(domain) {
+			servers = route.servers
+			break
+		}
+	}
+
+	if len(servers) == 0 {
+		ips, err := r.fallback.LookupIP(ctx, network, host)
+		return ips, ttlUnknown, err
+	}
+
+	var errs []error
+	for _, s := range servers {
+		ips, ttl, err := r.lookup(ctx, s, network, host)
+		if err == nil {
+			return ips, ttl, nil
+		}
+
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, ttl, err
+		}
+
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, 0, errors.Join(errs...)
+}
+
+func (r *dnsRouter) lookup(ctx context.Context, s *dnsServer, network, host string) ([]net.IP, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	return s.lookup(ctx, network, host)
+}
+
+// lookup queries A and/or AAAA records of the host depending on network: ip, ip4 or ip6. The ttl is the minimal one
+// of the answers. If there are no addresses, "not found" error is returned with ttl of the negative reply.
+func (s *dnsServer) lookup(ctx context.Context, network, host string) ([]net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host, Server: s.url}
+	}
+
+	types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	switch network {
+	case "ip4":
+		types = types[:1]
+	case "ip6":
+		types = types[1:]
+	}
+
+	type answer struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+
+	answers := make([]answer, len(types))
+	var wg sync.WaitGroup
+	for i, qtype := range types {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a := &answers[i]
+			a.ips, a.ttl, a.err = s.query(ctx, name, qtype)
+		}()
+	}
+	wg.Wait()
+
+	var (
+		ips  []net.IP
+		ttl  = ttlUnknown
+		errs []error
+	)
+	for _, a := range answers {
+		var dnsErr *net.DNSError
+		if errors.As(a.err, &dnsErr) && dnsErr.IsNotFound {
+			// the same as no records, the ttl is the one of negative reply
+			a.err = nil
+		}
+		if a.err != nil {
+			errs = append(errs, a.err)
+			continue
+		}
+
+		ips = append(ips, a.ips...)
+		if a.ttl != ttlUnknown && (ttl == ttlUnknown || a.ttl < ttl) {
+			ttl = a.ttl
+		}
+	}
+
+	switch {
+	case len(ips) > 0:
+		return ips, ttl, nil
+	case len(errs) > 0:
+		return nil, 0, errors.Join(errs...)
+	}
+
+	return nil, ttl, &net.DNSError{Err: "no such host", Name: host, Server: s.url, IsNotFound: true}
+}
+
+// query makes single dns query, no records is not an error. The ttl of negative reply is taken from SOA record
+// of authority section, RFC 2308.
+func (s *dnsServer) query(ctx context.Context, name dnsmessage.Name, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	var id [2]byte
+	_, _ = rand.Read(id[:])
+	question := dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: binary.BigEndian.Uint16(id[:]), RecursionDesired: true})
+	b.EnableCompression()
+	_ = b.StartQuestions()
+	_ = b.Question(question)
+	_ = b.StartAdditionals()
+	var opt dnsmessage.ResourceHeader
+	_ = opt.SetEDNS0(dnsUDPSize, dnsmessage.RCodeSuccess, false)
+	_ = b.OPTResource(opt, dnsmessage.OPTResource{})
+	msg, err := b.Finish()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	reply, err := s.exchange(ctx, msg)
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: name.String(), Server: s.url, IsTimeout: errors.Is(err, os.ErrDeadlineExceeded)}
+	}
+
+	var p dnsmessage.Parser
+	header, err := p.Start(reply)
+	if err == nil && header.Truncated && s.scheme == dnsUDP {
+		// the reply doesn't fit udp datagram, retry over tcp
+		if reply, err = s.exchangeStream(ctx, msg); err == nil {
+			header, err = p.Start(reply)
+		}
+	}
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: name.String(), Server: s.url}
+	}
+
+	if !isDNSReply(msg, reply) {
+		return nil, 0, &net.DNSError{Err: "invalid reply", Name: name.String(), Server: s.url}
+	}
+
+	switch header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, negativeTTL(&p), &net.DNSError{Err: "no such host", Name: name.String(), Server: s.url, IsNotFound: true}
+	default:
+		return nil, 0, &net.DNSError{Err: "server replied " + header.RCode.String(), Name: name.String(), Server: s.url, IsTemporary: true}
+	}
+
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: name.String(), Server: s.url}
+	}
+
+	var (
+		ips []net.IP
+		ttl = ttlUnknown
+	)
+	for {
+		h, err := p.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return nil, 0, &net.DNSError{Err: err.Error(), Name: name.String(), Server: s.url}
+		}
+
+		switch h.Type {
+		case dnsmessage.TypeA:
+			a, err := p.AResource()
+			if err != nil {
+				return nil, 0, &net.DNSError{Err: err.Error(), Name: name.String(), Server: s.url}
+			}
+			ips = append(ips, net.IP(a.A[:]))
+		case dnsmessage.TypeAAAA:
+			aaaa, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, &net.DNSError{Err: err.Error(), Name: name.String(), Server: s.url}
+			}
+			ips = append(ips, net.IP(aaaa.AAAA[:]))
+		default:
+			// the ttl of cname chain counts too
+			_ = p.SkipAnswer()
+		}
+
+		if d := time.Duration(h.TTL) * time.Second; ttl == ttlUnknown || d < ttl {
+			ttl = d
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, negativeTTL(&p), nil
+	}
+
+	return ips, ttl, nil
+}
+
+// negativeTTL returns ttl of negative reply from SOA record of authority section, the parser must be
+// positioned before the answers
+func negativeTTL(p *dnsmessage.Parser) time.Duration {
+	_ = p.SkipAllQuestions()
+	_ = p.SkipAllAnswers()
+
+	for {
+		h, err := p.AuthorityHeader()
+		if err != nil {
+			return ttlUnknown
+		}
+		if h.Type != dnsmessage.TypeSOA {
+			_ = p.SkipAuthority()
+			continue
+		}
+
+		soa, err := p.SOAResource()
+		if err != nil {
+			return ttlUnknown
+		}
+
+		return time.Duration(min(h.TTL, soa.MinTTL)) * time.Second
+	}
+}
+
+// exchange sends the query and returns the reply
+func (s *dnsServer) exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	switch s.scheme {
+	case dnsUDP:
+		return s.exchangeUDP(ctx, msg)
+	case dnsTCP, dnsTLS:
+		return s.exchangeStream(ctx, msg)
+	default:
+		return s.exchangeHTTPS(ctx, msg)
+	}
+}
+
+func (s *dnsServer) exchangeUDP(ctx context.Context, msg []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	// the datagrams of other queries and the forged replies of other questions are skipped
+	buf := make([]byte, dnsUDPSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if isDNSReply(msg, buf[:n]) {
+			return buf[:n], nil
+		}
+	}
+}
+
+// isDNSReply reports whether the message is the reply to the query: the same id and question, RFC 5452
+func isDNSReply(query, reply []byte) bool {
+	var qp, rp dnsmessage.Parser
+
+	qh, err := qp.Start(query)
+	if err != nil {
+		return false
+	}
+	rh, err := rp.Start(reply)
+	if err != nil || rh.ID != qh.ID || !rh.Response {
+		return false
+	}
+
+	q, err := qp.Question()
+	if err != nil {
+		return false
+	}
+	r, err := rp.Question()
+	if err != nil {
+		return false
+	}
+
+	return r.Type == q.Type && r.Class == q.Class && strings.EqualFold(r.Name.String(), q.Name.String())
+}
+
+// exchangeStream sends the query over tcp or tls connection, RFC 1035, RFC 7858
+func (s *dnsServer) exchangeStream(ctx context.Context, msg []byte) ([]byte, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if s.scheme == dnsTLS {
+		d := tls.Dialer{Config: s.tlsConfig}
+		conn, err = d.DialContext(ctx, "tcp", s.addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", s.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...)); err != nil { // nolint: gosec
+		return nil, err
+	}
+
+	size := make([]byte, 2)
+	if _, err := io.ReadFull(conn, size); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, binary.BigEndian.Uint16(size))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+
+	return reply, nil
+}
+
+// exchangeHTTPS sends the query by POST request, RFC 8484
+func (s *dnsServer) exchangeHTTPS(ctx context.Context, msg []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, fmt.Errorf("%w: %v", os.ErrDeadlineExceeded, err)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	reply, err := io.ReadAll(io.LimitReader(resp.Body, dnsMaxReplySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) > dnsMaxReplySize {
+		return nil, errors.New("reply is too large")
+	}
+
+	return reply, nil
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNSReply replies A records of the known names with ttl 60s, other names are not found with negative ttl 15s
+func fakeDNSReply(query []byte, records map[string]net.IP) []byte {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+
+	ip, found := records[q.Name.String()]
+
+	header.Response = true
+	header.RCode = dnsmessage.RCodeSuccess
+	if !found {
+		header.RCode = dnsmessage.RCodeNameError
+	}
+
+	b := dnsmessage.NewBuilder(nil, header)
+	_ = b.StartQuestions()
+	_ = b.Question(q)
+	_ = b.StartAnswers()
+	if found && q.Type == dnsmessage.TypeA {
+		var a dnsmessage.AResource
+		copy(a.A[:], ip.To4())
+		_ = b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}, a)
+	}
+
+	if !found {
+		_ = b.StartAuthorities()
+		_ = b.SOAResource(
+			dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("test."), Class: dnsmessage.ClassINET, TTL: 300},
+			dnsmessage.SOAResource{NS: dnsmessage.MustNewName("ns.test."), MBox: dnsmessage.MustNewName("admin.test."), MinTTL: 15},
+		)
+	}
+
+	reply, _ := b.Finish()
+	return reply
+}
+
+// fakeDNSServer serves dns over udp and tcp on the same port and returns the address
+func fakeDNSServer(t *testing.T, records map[string]net.IP) string {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(fakeDNSReply(buf[:n], records), addr)
+		}
+	}()
+
+	ls, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ls.Close() })
+	go serveDNSStream(ls, records)
+
+	return pc.LocalAddr().String()
+}
+
+// serveDNSStream serves length prefixed dns messages
+func serveDNSStream(ls net.Listener, records map[string]net.IP) {
+	for {
+		conn, err := ls.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+			for {
+				size := make([]byte, 2)
+				if _, err := io.ReadFull(conn, size); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(size))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+
+				reply := fakeDNSReply(query, records)
+				_, _ = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(reply))), reply...))
+			}
+		}()
+	}
+}
+
+func newTestDNSRouter(t *testing.T, cfg dnsConfig) *dnsRouter {
+	t.Helper()
+
+	cfg.Timeout = time.Second
+	r, err := newDNSRouter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+func Test_dnsRouter_lookupIPTTL(t *testing.T) {
+	var (
+		public = fakeDNSServer(t, map[string]net.IP{
+			"www.example.test.": net.IPv4(192, 0, 2, 1),
+			"git.corp.test.":    net.IPv4(192, 0, 2, 2),
+		})
+		internal = fakeDNSServer(t, map[string]net.IP{
+			"git.corp.test.": net.IPv4(10, 0, 0, 2),
+		})
+		down = closedAddr(t)
+	)
+
+	r := newTestDNSRouter(t, dnsConfig{
+		Servers: []string{"tcp://" + down, public},
+		Routes: []dnsRouteConfig{
+			{Domains: []string{".corp.test"}, Servers: []string{"tcp://" + internal, public}},
+		},
+	})
+
+	tests := []struct {
+		name         string
+		host         string
+		want         net.IP
+		wantTTL      time.Duration
+		wantNotFound bool
+	}{
+		{name: "failover", host: "www.example.test", want: net.IPv4(192, 0, 2, 1), wantTTL: time.Minute},
+		{name: "split horizon", host: "git.corp.test", want: net.IPv4(10, 0, 0, 2), wantTTL: time.Minute},
+		{name: "not found is final", host: "wiki.corp.test", wantTTL: 15 * time.Second, wantNotFound: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ips, ttl, err := r.lookupIPTTL(context.Background(), "ip", tt.host)
+			if ttl != tt.wantTTL {
+				t.Errorf("lookupIPTTL() ttl = %s, want %s", ttl, tt.wantTTL)
+			}
+			if tt.wantNotFound {
+				var dnsErr *net.DNSError
+				if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+					t.Fatalf("lookupIPTTL() error = %v, want not found", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("lookupIPTTL() error = %v", err)
+			}
+			if len(ips) != 1 || !ips[0].Equal(tt.want) {
+				t.Errorf("lookupIPTTL() = %v, want %s", ips, tt.want)
+			}
+		})
+	}
+}
+
+func Test_dnsServer_exchangeUDP_forged(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	// the reply of the other question with the same id comes first
+	go func() {
+		buf := make([]byte, 512)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := buf[:n]
+
+		var p dnsmessage.Parser
+		header, _ := p.Start(query)
+		q, _ := p.Question()
+
+		header.Response = true
+		forged := dnsmessage.NewBuilder(nil, header)
+		_ = forged.StartQuestions()
+		_ = forged.Question(dnsmessage.Question{Name: dnsmessage.MustNewName("evil.test."), Type: q.Type, Class: q.Class})
+		msg, _ := forged.Finish()
+		_, _ = pc.WriteTo(msg, addr)
+
+		_, _ = pc.WriteTo(fakeDNSReply(query, map[string]net.IP{"www.example.test.": net.IPv4(192, 0, 2, 1)}), addr)
+	}()
+
+	r := newTestDNSRouter(t, dnsConfig{Servers: []string{pc.LocalAddr().String()}})
+	ips, _, err := r.lookupIPTTL(context.Background(), "ip4", "www.example.test")
+	if err != nil {
+		t.Fatalf("lookupIPTTL() error = %v", err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("lookupIPTTL() = %v, want 192.0.2.1", ips)
+	}
+}
+
+func Test_isDNSReply(t *testing.T) {
+	build := func(id uint16, response bool, name string, qtype dnsmessage.Type) []byte {
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: response})
+		_ = b.StartQuestions()
+		_ = b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET})
+		msg, _ := b.Finish()
+		return msg
+	}
+
+	query := build(1, false, "www.example.test.", dnsmessage.TypeA)
+
+	tests := []struct {
+		name  string
+		reply []byte
+		want  bool
+	}{
+		{name: "reply", reply: build(1, true, "www.example.test.", dnsmessage.TypeA), want: true},
+		{name: "name case", reply: build(1, true, "WWW.Example.test.", dnsmessage.TypeA), want: true},
+		{name: "other id", reply: build(2, true, "www.example.test.", dnsmessage.TypeA)},
+		{name: "other name", reply: build(1, true, "evil.test.", dnsmessage.TypeA)},
+		{name: "other type", reply: build(1, true, "www.example.test.", dnsmessage.TypeAAAA)},
+		{name: "not response", reply: build(1, false, "www.example.test.", dnsmessage.TypeA)},
+		{name: "garbage", reply: []byte{0, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isDNSReply(query, tt.reply); got != tt.want {
+				t.Errorf("isDNSReply() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_dnsRouter_encrypted(t *testing.T) {
+	records := map[string]net.IP{"www.example.test.": net.IPv4(192, 0, 2, 1)}
+
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(fakeDNSReply(query, records))
+	}))
+	defer doh.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(doh.Certificate())
+
+	dot, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: doh.TLS.Certificates, MinVersion: tls.VersionTLS12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dot.Close()
+	go serveDNSStream(dot, records)
+
+	tests := []struct {
+		name   string
+		server string
+	}{
+		{name: "dns over tls", server: "tls://" + dot.Addr().String() + "?server_name=example.com"},
+		{name: "dns over https", server: doh.URL + "/dns-query"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestDNSRouter(t, dnsConfig{Servers: []string{tt.server}})
+
+			s := r.servers[0]
+			if s.tlsConfig != nil {
+				s.tlsConfig.RootCAs = roots
+			}
+			if s.client != nil {
+				s.client = doh.Client()
+			}
+
+			ips, err := r.LookupIP(context.Background(), "ip4", "www.example.test")
+			if err != nil {
+				t.Fatalf("LookupIP() error = %v", err)
+			}
+			if len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 1)) {
+				t.Errorf("LookupIP() = %v", ips)
+			}
+		})
+	}
+}
+
+func Test_newDNSRouter_errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     dnsConfig
+		wantErr string
+	}{
+		{name: "unknown scheme", cfg: dnsConfig{Servers: []string{"quic://1.1.1.1"}}, wantErr: "dns.servers[0]: scheme must be udp, tcp, tls or https"},
+		{name: "udp server by name", cfg: dnsConfig{Servers: []string{"dns.google"}}, wantErr: "dns.servers[0]: host must be ip address"},
+		{name: "route without domains", cfg: dnsConfig{Routes: []dnsRouteConfig{{Servers: []string{"10.0.0.53"}}}}, wantErr: "dns.routes[0].domains: must be domain names"},
+		{name: "route by cidr", cfg: dnsConfig{Routes: []dnsRouteConfig{{Domains: []string{"10.0.0.0/8"}, Servers: []string{"10.0.0.53"}}}}, wantErr: "dns.routes[0].domains: must be domain names"},
+		{name: "route without servers", cfg: dnsConfig{Routes: []dnsRouteConfig{{Domains: []string{".corp.test"}}}}, wantErr: "dns.routes[0].servers: must be specified"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newDNSRouter(tt.cfg)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("newDNSRouter() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if r, err := newDNSRouter(dnsConfig{}); r != nil || err != nil {
+		t.Errorf("newDNSRouter(system) = %v, %v, want nil", r, err)
+	}
+}
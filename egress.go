@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+)
+
+// defaultEgressDeny is the list of non-public networks the clients are not allowed to connect to
+var defaultEgressDeny = []string{
+	"0.0.0.0/8",      // "this" network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // carrier-grade nat
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local, cloud metadata endpoints
+	"172.16.0.0/12",  // private
+	"192.0.0.0/24",   // ietf protocol assignments
+	"192.168.0.0/16", // private
+	"198.18.0.0/15",  // benchmarking
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved, broadcast
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"64:ff9b:1::/48", // local-use nat64, the embedded ipv4 address depends on the network
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link-local
+	"ff00::/8",       // multicast
+}
+
+// the prefixes embedding ipv4 address, the address is reached through nat64 or 6to4 gateway
+var (
+	nat64Prefix     = netip.MustParsePrefix("64:ff9b::/96") // well-known nat64 prefix, rfc 6052
+	sixToFourPrefix = netip.MustParsePrefix("2002::/16")    // 6to4, rfc 3056
+)
+
+// egressGuard protects internal networks from the proxy clients (SSRF). It checks the final ip address
+// the proxy is going to connect to, so the domains resolved to internal addresses are covered as well.
+type egressGuard struct {
+	deny  []netip.Prefix
+	allow []netip.Prefix // exceptions of deny list
+	local map[netip.Addr]struct{}
+}
+
+// newEgressGuard creates guard by config, returns nil if the guard is disabled
+func newEgressGuard(cfg egressGuardConfig) (*egressGuard, error) {
+	if !cfg.Enable {
+		return nil, nil
+	}
+
+	deny := cfg.Deny
+	if len(deny) == 0 {
+		deny = defaultEgressDeny
+	}
+
+	var errs []error
+	g := new(egressGuard)
+
+	for i, s := range deny {
+		prefix, err := parsePrefix(s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("egress_guard.deny[%d]: %w", i, err))
+			continue
+		}
+		g.deny = append(g.deny, prefix)
+	}
+
+	for i, s := range cfg.Allow {
+		prefix, err := parsePrefix(s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("egress_guard.allow[%d]: %w", i, err))
+			continue
+		}
+		g.allow = append(g.allow, prefix)
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	// the addresses of the host itself: the proxy, metrics and other services listening on public ip
+	if cfg.DenyLocalAddresses {
+		g.local = localAddresses()
+	}
+
+	return g, nil
+}
+
+// parsePrefix parses cidr or single ip address
+func parsePrefix(s string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return prefix, err
+	}
+
+	return prefix.Masked(), nil
+}
+
+func localAddresses() map[netip.Addr]struct{} {
+	res := make(map[netip.Addr]struct{})
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Println("egress guard: local addresses:", err)
+		return res
+	}
+
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		if addr, ok := netip.AddrFromSlice(ipNet.IP); ok {
+			res[addr.Unmap()] = struct{}{}
+		}
+	}
+
+	return res
+}
+
+// allowed reports whether the connection to ip is allowed
+func (g *egressGuard) allowed(ip net.IP) bool {
+	if g == nil {
+		return true
+	}
+
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+
+	return g.allowedAddr(addr.Unmap())
+}
+
+// allowedAddr reports whether the connection to addr is allowed, the ipv4 address embedded into nat64
+// or 6to4 address is checked as well
+func (g *egressGuard) allowedAddr(addr netip.Addr) bool {
+	if containsAddr(g.allow, addr) {
+		return true
+	}
+
+	if _, ok := g.local[addr]; ok {
+		return false
+	}
+
+	if containsAddr(g.deny, addr) {
+		return false
+	}
+
+	if v4, ok := embeddedIPv4(addr); ok {
+		return g.allowedAddr(v4)
+	}
+
+	return true
+}
+
+// embeddedIPv4 returns ipv4 address embedded into nat64 well-known prefix or 6to4 address
+func embeddedIPv4(addr netip.Addr) (netip.Addr, bool) {
+	b := addr.As16()
+
+	switch {
+	case nat64Prefix.Contains(addr):
+		return netip.AddrFrom4([4]byte(b[12:16])), true
+	case sixToFourPrefix.Contains(addr):
+		return netip.AddrFrom4([4]byte(b[2:6])), true
+	}
+
+	return netip.Addr{}, false
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
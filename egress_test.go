@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func Test_egressGuard_allowed(t *testing.T) {
+	guard, err := newEgressGuard(egressGuardConfig{
+		Enable: true,
+		Allow:  []string{"10.1.0.0/16", "fd00::1"},
+	})
+	if err != nil {
+		t.Fatalf("newEgressGuard() error = %v", err)
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"1.1.1.1", true},
+		{"2606:4700:4700::1111", true},
+		{"127.0.0.1", false},
+		{"127.1.2.3", false},
+		{"169.254.169.254", false},
+		{"10.0.0.1", false},
+		{"172.16.5.4", false},
+		{"192.168.0.1", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::1", false},
+		{"::", false},
+		{"fe80::1", false},
+		{"fd12:3456::1", false},
+		{"::ffff:127.0.0.1", false}, // ipv4 mapped
+		{"::ffff:169.254.169.254", false},
+		{"64:ff9b::a9fe:a9fe", false}, // nat64 of 169.254.169.254
+		{"64:ff9b::7f00:1", false},    // nat64 of 127.0.0.1
+		{"64:ff9b::101:101", true},    // nat64 of 1.1.1.1
+		{"64:ff9b:1::a00:1", false},   // local-use nat64
+		{"2002:7f00:1::", false},      // 6to4 of 127.0.0.1
+		{"2002:a9fe:a9fe::1", false},  // 6to4 of 169.254.169.254
+		{"2002:101:101::1", true},     // 6to4 of 1.1.1.1
+		{"64:ff9b::a01:203", true},    // nat64 of allowlisted 10.1.2.3
+		{"10.1.2.3", true},            // allowlist
+		{"fd00::1", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := guard.allowed(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("allowed(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_egressGuard_custom(t *testing.T) {
+	guard, err := newEgressGuard(egressGuardConfig{
+		Enable: true,
+		Deny:   []string{"203.0.113.0/24", "198.51.100.7"},
+	})
+	if err != nil {
+		t.Fatalf("newEgressGuard() error = %v", err)
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"203.0.113.10", false},
+		{"198.51.100.7", false},
+		{"198.51.100.8", true},
+		{"10.0.0.1", true}, // custom list replaces the default one
+	}
+
+	for _, tt := range tests {
+		if got := guard.allowed(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("allowed(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func Test_egressGuard_local(t *testing.T) {
+	guard, err := newEgressGuard(egressGuardConfig{
+		Enable:             true,
+		Deny:               []string{"192.0.2.0/24"},
+		DenyLocalAddresses: true,
+	})
+	if err != nil {
+		t.Fatalf("newEgressGuard() error = %v", err)
+	}
+
+	for addr := range guard.local {
+		if guard.allowed(addr.AsSlice()) {
+			t.Errorf("local address %s is allowed", addr)
+		}
+	}
+}
+
+func Test_egressGuard_disabled(t *testing.T) {
+	guard, err := newEgressGuard(egressGuardConfig{Enable: false})
+	if err != nil {
+		t.Fatalf("newEgressGuard() error = %v", err)
+	}
+
+	if !guard.allowed(net.ParseIP("127.0.0.1")) {
+		t.Errorf("disabled guard must allow everything")
+	}
+}
+
+func Test_newEgressGuard_errors(t *testing.T) {
+	_, err := newEgressGuard(egressGuardConfig{
+		Enable: true,
+		Deny:   []string{"10.0.0.0/8", "localhost"},
+		Allow:  []string{"10.0.0.0/40"},
+	})
+
+	for _, want := range []string{"egress_guard.deny[1]", "egress_guard.allow[0]"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("newEgressGuard() error = %v, want %q", err, want)
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+
+	"github.com/dblokhin/proxyme"
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// min protection levels of the config
+const (
+	gssProtectionIntegrity       = "integrity"
+	gssProtectionConfidentiality = "confidentiality"
+)
+
+// protection levels of socks5 gssapi subnegotiation, RFC 1961
+const (
+	gssLevelIntegrity       = 1
+	gssLevelConfidentiality = 2
+	gssLevelSelective       = 3
+)
+
+// krb5 mechanism token ids and wrap token flags, RFC 4121
+var (
+	tokAPReq = []byte{0x01, 0x00}
+	tokAPRep = []byte{0x02, 0x00}
+	tokWrap  = []byte{0x05, 0x04}
+)
+
+const (
+	wrapSentByAcceptor = 0x01
+	wrapSealed         = 0x02
+	wrapAcceptorSubkey = 0x04
+)
+
+// states of the security context
+const (
+	gssAccept          = iota // waiting for AP-REQ
+	gssProtection             // waiting for the client protection level
+	gssProtectionReply        // server replies the protection level
+	gssEstablished            // messages are protected by negotiated level
+)
+
+var (
+	errGSSProtection   = errors.New("gssapi: protection level is not acceptable")
+	errGSSInvalidToken = errors.New("gssapi: invalid token")
+)
+
+// kerberos accepts GSSAPI Kerberos V5 security contexts of the clients by service keytab
+type kerberos struct {
+	settings   *service.Settings
+	minLevel   byte
+	stripRealm bool
+}
+
+func newKerberos(cfg gssapiConfig) (*kerberos, error) {
+	kt, err := keytab.Load(cfg.Keytab)
+	if err != nil {
+		return nil, fmt.Errorf("load keytab: %w", err)
+	}
+
+	opts := []func(*service.Settings){service.DecodePAC(false)}
+	if cfg.Principal != "" {
+		opts = append(opts, service.KeytabPrincipal(cfg.Principal))
+	}
+
+	k := &kerberos{
+		settings:   service.NewSettings(kt, opts...),
+		minLevel:   gssLevelIntegrity,
+		stripRealm: cfg.StripRealm,
+	}
+
+	if cfg.Protection == gssProtectionConfidentiality {
+		k.minLevel = gssLevelConfidentiality
+	}
+
+	return k, nil
+}
+
+// newContext creates security context for a new client
+func (k *kerberos) newContext() (proxyme.GSSAPI, error) {
+	return &krb5Context{kerberos: k}, nil
+}
+
+// krb5Context is the security context of single client. Once it's established, the first message
+// is the protection level requested by the client, the rest are the wrapped socks5 messages and data.
+type krb5Context struct {
+	*kerberos
+
+	state   int
+	user    string
+	key     types.EncryptionKey // initiator subkey or ticket session key
+	level   byte                // negotiated protection level
+	sendSeq uint64
+	recvSeq uint64 // expected sequence number of the next initiator token
+}
+
+// AcceptContext verifies AP-REQ of the client and returns AP-REP if mutual authentication is requested
+func (c *krb5Context) AcceptContext(token []byte) ([]byte, bool, error) {
+	if c.state != gssAccept {
+		return nil, false, fmt.Errorf("%w: context is already established", errGSSInvalidToken)
+	}
+
+	var tok spnego.KRB5Token
+	if err := tok.Unmarshal(token); err != nil {
+		return nil, false, fmt.Errorf("gssapi: %w", err)
+	}
+	if !tok.IsAPReq() {
+		return nil, false, fmt.Errorf("%w: AP-REQ expected", errGSSInvalidToken)
+	}
+
+	req := &tok.APReq
+	ok, creds, err := service.VerifyAPREQ(req, c.settings)
+	if err != nil {
+		return nil, false, fmt.Errorf("gssapi: %w", err)
+	}
+	if !ok {
+		return nil, false, fmt.Errorf("%w: AP-REQ is not valid", errGSSInvalidToken)
+	}
+
+	c.key = req.Ticket.DecryptedEncPart.Key
+	if len(req.Authenticator.SubKey.KeyValue) > 0 {
+		c.key = req.Authenticator.SubKey
+	}
+
+	// only RFC 4121 tokens are supported, rc4 and des use the legacy ones
+	switch c.key.KeyType {
+	case etypeID.AES128_CTS_HMAC_SHA1_96, etypeID.AES256_CTS_HMAC_SHA1_96,
+		etypeID.AES128_CTS_HMAC_SHA256_128, etypeID.AES256_CTS_HMAC_SHA384_192:
+	default:
+		return nil, false, fmt.Errorf("gssapi: encryption type %d is not supported", c.key.KeyType)
+	}
+
+	c.user = creds.CName().PrincipalNameString()
+	if !c.stripRealm {
+		c.user += "@" + creds.Realm()
+	}
+
+	// without mutual authentication the acceptor uses initiator sequence number
+	c.sendSeq = uint64(req.Authenticator.SeqNumber) // nolint
+	c.recvSeq = uint64(req.Authenticator.SeqNumber) // nolint
+	c.state = gssProtection
+
+	if !types.IsFlagSet(&req.APOptions, flags.APOptionMutualRequired) {
+		return nil, true, nil
+	}
+
+	seq, err := rand.Int(rand.Reader, big.NewInt(1<<30))
+	if err != nil {
+		return nil, false, err
+	}
+	c.sendSeq = seq.Uint64()
+
+	rep, err := newAPRep(req, c.sendSeq)
+	if err != nil {
+		return nil, false, fmt.Errorf("gssapi: %w", err)
+	}
+
+	return rep, true, nil
+}
+
+// principal returns the client name, valid after the context is established
+func (c *krb5Context) principal() string {
+	return c.user
+}
+
+// Decode unwraps the client message. The first message is the protection level requested by the client:
+// it's checked against the min level, selective protection is answered by confidentiality.
+func (c *krb5Context) Decode(data []byte) ([]byte, error) {
+	if c.state < gssProtection {
+		return nil, fmt.Errorf("%w: context is not established", errGSSInvalidToken)
+	}
+
+	msg, sealed, err := c.unwrap(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.state == gssProtection {
+		if len(msg) != 1 || msg[0] < gssLevelIntegrity || msg[0] > gssLevelSelective {
+			return nil, fmt.Errorf("%w: invalid protection level message", errGSSInvalidToken)
+		}
+
+		level := min(msg[0], gssLevelConfidentiality)
+		if level < c.minLevel {
+			return nil, errGSSProtection
+		}
+
+		c.level = level
+		c.state = gssProtectionReply
+
+		return []byte{level}, nil
+	}
+
+	if c.level == gssLevelConfidentiality && !sealed {
+		return nil, fmt.Errorf("%w: message is not encrypted", errGSSInvalidToken)
+	}
+
+	return msg, nil
+}
+
+// Encode wraps the server message with negotiated protection, protection level reply is integrity protected only
+func (c *krb5Context) Encode(data []byte) ([]byte, error) {
+	switch c.state {
+	case gssProtectionReply:
+		c.state = gssEstablished
+		return c.wrap(data, false)
+	case gssEstablished:
+		return c.wrap(data, c.level == gssLevelConfidentiality)
+	}
+
+	return nil, fmt.Errorf("%w: context is not established", errGSSInvalidToken)
+}
+
+// wrap makes RFC 4121 wrap token of the acceptor
+func (c *krb5Context) wrap(data []byte, seal bool) ([]byte, error) {
+	et, err := crypto.GetEtype(c.key.KeyType)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, gssapi.HdrLen)
+	copy(header, tokWrap)
+	header[2] = wrapSentByAcceptor
+	header[3] = gssapi.FillerByte
+	binary.BigEndian.PutUint64(header[8:], c.sendSeq)
+	c.sendSeq++
+
+	if !seal {
+		// checksum of data and the header with zero EC and RRC
+		cksum, err := et.GetChecksumHash(c.key.KeyValue, slices.Concat(data, header), keyusage.GSSAPI_ACCEPTOR_SEAL)
+		if err != nil {
+			return nil, err
+		}
+
+		binary.BigEndian.PutUint16(header[4:], uint16(len(cksum))) // nolint
+		return slices.Concat(header, data, cksum), nil
+	}
+
+	header[2] |= wrapSealed
+	_, encrypted, err := et.EncryptMessage(c.key.KeyValue, slices.Concat(data, header), keyusage.GSSAPI_ACCEPTOR_SEAL)
+	if err != nil {
+		return nil, err
+	}
+
+	return slices.Concat(header, encrypted), nil
+}
+
+// unwrap verifies RFC 4121 wrap token of the initiator and returns its data
+func (c *krb5Context) unwrap(token []byte) ([]byte, bool, error) {
+	if len(token) < gssapi.HdrLen || token[0] != tokWrap[0] || token[1] != tokWrap[1] || token[3] != gssapi.FillerByte {
+		return nil, false, fmt.Errorf("%w: wrap token expected", errGSSInvalidToken)
+	}
+
+	flags := token[2]
+	if flags&(wrapSentByAcceptor|wrapAcceptorSubkey) != 0 {
+		return nil, false, fmt.Errorf("%w: unexpected flags %#x", errGSSInvalidToken, flags)
+	}
+
+	et, err := crypto.GetEtype(c.key.KeyType)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ec := int(binary.BigEndian.Uint16(token[4:]))
+	rrc := int(binary.BigEndian.Uint16(token[6:]))
+
+	header := slices.Clone(token[:gssapi.HdrLen])
+	binary.BigEndian.PutUint16(header[6:], 0)
+	body := rotateLeft(token[gssapi.HdrLen:], rrc)
+
+	if flags&wrapSealed == 0 {
+		if ec > len(body) {
+			return nil, false, fmt.Errorf("%w: invalid checksum length", errGSSInvalidToken)
+		}
+
+		data, cksum := body[:len(body)-ec], body[len(body)-ec:]
+		binary.BigEndian.PutUint16(header[4:], 0)
+
+		want, err := et.GetChecksumHash(c.key.KeyValue, slices.Concat(data, header), keyusage.GSSAPI_INITIATOR_SEAL)
+		if err != nil {
+			return nil, false, err
+		}
+		if !hmac.Equal(want, cksum) {
+			return nil, false, fmt.Errorf("%w: checksum mismatch", errGSSInvalidToken)
+		}
+
+		if err := c.acceptSeq(header); err != nil {
+			return nil, false, err
+		}
+
+		return data, false, nil
+	}
+
+	if len(body) < et.GetConfounderByteSize()+et.GetHMACBitLength()/8 {
+		return nil, false, fmt.Errorf("%w: message is too short", errGSSInvalidToken)
+	}
+
+	plain, err := et.DecryptMessage(c.key.KeyValue, body, keyusage.GSSAPI_INITIATOR_SEAL)
+	if err != nil {
+		return nil, false, fmt.Errorf("gssapi: %w", err)
+	}
+
+	// plain text is data | filler of EC bytes | header copy
+	if len(plain) < ec+gssapi.HdrLen || !hmac.Equal(plain[len(plain)-gssapi.HdrLen:], header) {
+		return nil, false, fmt.Errorf("%w: header mismatch", errGSSInvalidToken)
+	}
+
+	if err := c.acceptSeq(header); err != nil {
+		return nil, false, err
+	}
+
+	return plain[:len(plain)-gssapi.HdrLen-ec], true, nil
+}
+
+// acceptSeq checks the sequence number of verified token, the tokens are neither replayed nor reordered,
+// RFC 4121 section 4.2.6.2
+func (c *krb5Context) acceptSeq(header []byte) error {
+	seq := binary.BigEndian.Uint64(header[8:])
+	if seq != c.recvSeq {
+		return fmt.Errorf("%w: sequence number %d, want %d", errGSSInvalidToken, seq, c.recvSeq)
+	}
+
+	c.recvSeq++
+	return nil
+}
+
+func rotateLeft(b []byte, n int) []byte {
+	if len(b) == 0 {
+		return b
+	}
+
+	n %= len(b)
+	return slices.Concat(b[n:], b[:n])
+}
+
+// newAPRep makes AP-REP mechanism token in reply to verified AP-REQ
+func newAPRep(req *messages.APReq, seq uint64) ([]byte, error) {
+	part, err := asn1.Marshal(messages.EncAPRepPart{
+		CTime:          req.Authenticator.CTime,
+		Cusec:          req.Authenticator.Cusec,
+		SequenceNumber: int64(seq), // nolint
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	encPart, err := crypto.GetEncryptedData(
+		asn1tools.AddASNAppTag(part, asnAppTag.EncAPRepPart),
+		req.Ticket.DecryptedEncPart.Key,
+		keyusage.AP_REP_ENCPART,
+		0,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	rep, err := asn1.Marshal(messages.APRep{
+		PVNO:    iana.PVNO,
+		MsgType: msgtype.KRB_AP_REP,
+		EncPart: encPart,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return mechToken(tokAPRep, asn1tools.AddASNAppTag(rep, asnAppTag.APREP)), nil
+}
+
+// mechToken frames krb5 message as GSSAPI token, RFC 2743 section 3.1
+func mechToken(tokID, msg []byte) []byte {
+	oid, _ := asn1.Marshal(gssapi.OIDKRB5.OID())
+	return asn1tools.AddASNAppTag(slices.Concat(oid, tokID, msg), 0)
+}
+
+// sessionGSSAPI records the client principal as the session user once the context is established
+type sessionGSSAPI struct {
+	proxyme.GSSAPI
+	sess *session
+}
+
+func (s sessionGSSAPI) AcceptContext(token []byte) ([]byte, bool, error) {
+	out, done, err := s.GSSAPI.AcceptContext(token)
+	if err != nil {
+		s.sess.setAuthenticated(false)
+	}
+	if err == nil && done {
+		if p, ok := s.GSSAPI.(interface{ principal() string }); ok {
+			s.sess.setUser(p.principal())
+		}
+		s.sess.setAuthenticated(true)
+	}
+
+	return out, done, err
+}
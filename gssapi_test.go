@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+const (
+	testRealm = "EXAMPLE.COM"
+	testSPN   = "rcmd/proxy.example.com"
+)
+
+// writeKeytab writes service keytab and returns its path
+func writeKeytab(t *testing.T, kt *keytab.Keytab) string {
+	t.Helper()
+
+	data, err := kt.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "proxy.keytab")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// newTestKerberos creates acceptor with keytab of testSPN
+func newTestKerberos(t *testing.T, cfg gssapiConfig) (*kerberos, *keytab.Keytab) {
+	t.Helper()
+
+	kt := keytab.New()
+	if err := kt.AddEntry(testSPN, testRealm, "service secret", time.Now(), 1, etypeID.AES256_CTS_HMAC_SHA1_96); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Keytab = writeKeytab(t, kt)
+	k, err := newKerberos(cfg)
+	if err != nil {
+		t.Fatalf("newKerberos() error = %v", err)
+	}
+
+	return k, kt
+}
+
+// testInitiator is the client side of security context
+type testInitiator struct {
+	key types.EncryptionKey // the key protecting the messages of context
+	seq uint64              // sequence number of the next wrap token
+}
+
+// newAPReqToken plays KDC and initiator roles: issues service ticket for the user and makes AP-REQ token.
+// It returns the token, the ticket session key and the initiator.
+func newAPReqToken(t *testing.T, kt *keytab.Keytab, user string, mutual bool) ([]byte, types.EncryptionKey, *testInitiator) {
+	t.Helper()
+
+	now := time.Now().UTC()
+	cname := types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, user)
+	sname := types.NewPrincipalName(nametype.KRB_NT_SRV_INST, testSPN)
+
+	tkt, sessionKey, err := messages.NewTicket(cname, testRealm, sname, testRealm, types.NewKrbFlags(), kt,
+		etypeID.AES256_CTS_HMAC_SHA1_96, 1, now, now, now.Add(time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := types.NewAuthenticator(testRealm, cname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.GenerateSeqNumberAndSubKey(etypeID.AES256_CTS_HMAC_SHA1_96, 32); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := messages.NewAPReq(tkt, sessionKey, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mutual {
+		types.SetFlag(&req.APOptions, flags.APOptionMutualRequired)
+	}
+
+	msg, err := req.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return mechToken(tokAPReq, msg), sessionKey, &testInitiator{key: auth.SubKey, seq: uint64(auth.SeqNumber)}
+}
+
+// wrap makes the next wrap token of the client, sealed tokens are rotated by rrc like SSPI does
+func (i *testInitiator) wrap(t *testing.T, data []byte, seal bool, rrc int) []byte {
+	t.Helper()
+
+	seq := i.seq
+	i.seq++
+
+	if !seal {
+		et, _ := crypto.GetEtype(i.key.KeyType)
+		wt := gssapi.WrapToken{EC: uint16(et.GetHMACBitLength() / 8), SndSeqNum: seq, Payload: data}
+		if err := wt.SetCheckSum(i.key, keyusage.GSSAPI_INITIATOR_SEAL); err != nil {
+			t.Fatal(err)
+		}
+		b, err := wt.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	key := i.key
+	header := []byte{0x05, 0x04, wrapSealed, 0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(header[8:], seq)
+	et, _ := crypto.GetEtype(key.KeyType)
+	_, encrypted, err := et.EncryptMessage(key.KeyValue, slices.Concat(data, header), keyusage.GSSAPI_INITIATOR_SEAL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	binary.BigEndian.PutUint16(header[6:], uint16(rrc))
+	n := len(encrypted) - rrc%len(encrypted)
+	return slices.Concat(header, encrypted[n:], encrypted[:n])
+}
+
+// acceptorUnwrap verifies wrap token of the server
+func acceptorUnwrap(t *testing.T, key types.EncryptionKey, token []byte) ([]byte, bool) {
+	t.Helper()
+
+	if token[2]&wrapSealed == 0 {
+		var wt gssapi.WrapToken
+		if err := wt.Unmarshal(token, true); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := wt.Verify(key, keyusage.GSSAPI_ACCEPTOR_SEAL); !ok {
+			t.Fatalf("Verify() error = %v", err)
+		}
+		return wt.Payload, false
+	}
+
+	plain, err := crypto.DecryptMessage(token[gssapi.HdrLen:], key, keyusage.GSSAPI_ACCEPTOR_SEAL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain[len(plain)-gssapi.HdrLen:], token[:gssapi.HdrLen]) {
+		t.Fatal("header mismatch")
+	}
+
+	return plain[:len(plain)-gssapi.HdrLen], true
+}
+
+func Test_krb5Context(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       gssapiConfig
+		mutual    bool
+		level     byte
+		seal      bool
+		rrc       int
+		wantUser  string
+		wantLevel byte
+	}{
+		{
+			name:      "integrity",
+			level:     gssLevelIntegrity,
+			wantUser:  "alice@" + testRealm,
+			wantLevel: gssLevelIntegrity,
+		},
+		{
+			name:      "confidentiality with mutual authentication",
+			mutual:    true,
+			level:     gssLevelConfidentiality,
+			seal:      true,
+			wantUser:  "alice@" + testRealm,
+			wantLevel: gssLevelConfidentiality,
+		},
+		{
+			name:      "selective is answered by confidentiality",
+			cfg:       gssapiConfig{StripRealm: true, Principal: testSPN},
+			level:     gssLevelSelective,
+			seal:      true,
+			rrc:       28,
+			wantUser:  "alice",
+			wantLevel: gssLevelConfidentiality,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, kt := newTestKerberos(t, tt.cfg)
+			token, sessionKey, client := newAPReqToken(t, kt, "alice", tt.mutual)
+
+			gss, _ := k.newContext()
+			sess := newSession(nil)
+			ctx := sessionGSSAPI{GSSAPI: gss, sess: sess}
+
+			out, done, err := ctx.AcceptContext(token)
+			if err != nil || !done {
+				t.Fatalf("AcceptContext() = %v, %v", done, err)
+			}
+			if got := sess.username(); got != tt.wantUser {
+				t.Errorf("session user = %q, want %q", got, tt.wantUser)
+			}
+
+			if tt.mutual {
+				var rep messages.APRep
+				if err := rep.Unmarshal(out[len(mechToken(tokAPRep, nil)):]); err != nil {
+					t.Fatalf("AP-REP error = %v", err)
+				}
+				b, err := crypto.DecryptEncPart(rep.EncPart, sessionKey, keyusage.AP_REP_ENCPART)
+				if err != nil {
+					t.Fatalf("AP-REP decrypt error = %v", err)
+				}
+				var part messages.EncAPRepPart
+				if err := part.Unmarshal(b); err != nil {
+					t.Fatalf("AP-REP enc part error = %v", err)
+				}
+			} else if out != nil {
+				t.Errorf("AcceptContext() token = %x, want nil", out)
+			}
+
+			// protection level subnegotiation
+			level, err := gss.Decode(client.wrap(t, []byte{tt.level}, false, 0))
+			if err != nil {
+				t.Fatalf("Decode(level) error = %v", err)
+			}
+			if !bytes.Equal(level, []byte{tt.wantLevel}) {
+				t.Fatalf("Decode(level) = %v, want %d", level, tt.wantLevel)
+			}
+
+			reply, err := gss.Encode(level)
+			if err != nil {
+				t.Fatalf("Encode(level) error = %v", err)
+			}
+			if data, sealed := acceptorUnwrap(t, client.key, reply); sealed || !bytes.Equal(data, level) {
+				t.Errorf("level reply = %v sealed %v", data, sealed)
+			}
+
+			// socks5 messages
+			msg, err := gss.Decode(client.wrap(t, []byte("request"), tt.seal, tt.rrc))
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if string(msg) != "request" {
+				t.Errorf("Decode() = %q, want %q", msg, "request")
+			}
+
+			reply, err = gss.Encode([]byte("reply"))
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+			if data, sealed := acceptorUnwrap(t, client.key, reply); sealed != tt.seal || string(data) != "reply" {
+				t.Errorf("Encode() = %q sealed %v, want %q sealed %v", data, sealed, "reply", tt.seal)
+			}
+
+			if tt.seal {
+				if _, err := gss.Decode(client.wrap(t, []byte("plain"), false, 0)); !errors.Is(err, errGSSInvalidToken) {
+					t.Errorf("Decode(not sealed) error = %v, want %v", err, errGSSInvalidToken)
+				}
+			}
+		})
+	}
+}
+
+func Test_krb5Context_errors(t *testing.T) {
+	k, kt := newTestKerberos(t, gssapiConfig{Protection: gssProtectionConfidentiality})
+
+	t.Run("wrong service key", func(t *testing.T) {
+		other := keytab.New()
+		_ = other.AddEntry(testSPN, testRealm, "another secret", time.Now(), 1, etypeID.AES256_CTS_HMAC_SHA1_96)
+		token, _, _ := newAPReqToken(t, other, "alice", false)
+
+		gss, _ := k.newContext()
+		if _, _, err := gss.AcceptContext(token); err == nil {
+			t.Error("AcceptContext() error = nil")
+		}
+	})
+
+	t.Run("garbage token", func(t *testing.T) {
+		gss, _ := k.newContext()
+		if _, _, err := gss.AcceptContext([]byte("garbage")); err == nil {
+			t.Error("AcceptContext() error = nil")
+		}
+	})
+
+	t.Run("data before context", func(t *testing.T) {
+		gss, _ := k.newContext()
+		if _, err := gss.Encode([]byte("x")); !errors.Is(err, errGSSInvalidToken) {
+			t.Errorf("Encode() error = %v, want %v", err, errGSSInvalidToken)
+		}
+	})
+
+	t.Run("protection level below min", func(t *testing.T) {
+		token, _, client := newAPReqToken(t, kt, "alice", false)
+
+		gss, _ := k.newContext()
+		if _, _, err := gss.AcceptContext(token); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := gss.Decode(client.wrap(t, []byte{gssLevelIntegrity}, false, 0)); !errors.Is(err, errGSSProtection) {
+			t.Errorf("Decode() error = %v, want %v", err, errGSSProtection)
+		}
+	})
+
+	t.Run("tampered message", func(t *testing.T) {
+		token, _, client := newAPReqToken(t, kt, "alice", false)
+
+		gss, _ := k.newContext()
+		if _, _, err := gss.AcceptContext(token); err != nil {
+			t.Fatal(err)
+		}
+
+		msg := client.wrap(t, []byte{gssLevelConfidentiality}, true, 0)
+		msg[len(msg)-1] ^= 1
+		if _, err := gss.Decode(msg); err == nil {
+			t.Error("Decode() error = nil")
+		}
+	})
+}
+
+func Test_krb5Context_sequence(t *testing.T) {
+	k, kt := newTestKerberos(t, gssapiConfig{})
+
+	tests := []struct {
+		name string
+		next func(client *testInitiator, prev []byte) []byte
+	}{
+		{
+			name: "replayed message",
+			next: func(_ *testInitiator, prev []byte) []byte { return prev },
+		},
+		{
+			name: "skipped message",
+			next: func(client *testInitiator, _ []byte) []byte {
+				_ = client.wrap(t, []byte("lost"), false, 0)
+				return client.wrap(t, []byte("request"), false, 0)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, _, client := newAPReqToken(t, kt, "alice", false)
+
+			gss, _ := k.newContext()
+			if _, _, err := gss.AcceptContext(token); err != nil {
+				t.Fatal(err)
+			}
+
+			level := client.wrap(t, []byte{gssLevelIntegrity}, false, 0)
+			if _, err := gss.Decode(level); err != nil {
+				t.Fatalf("Decode(level) error = %v", err)
+			}
+			if _, err := gss.Encode([]byte{gssLevelIntegrity}); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := gss.Decode(tt.next(client, level)); !errors.Is(err, errGSSInvalidToken) {
+				t.Errorf("Decode() error = %v, want %v", err, errGSSInvalidToken)
+			}
+		})
+	}
+}
+
+func Test_newKerberos_missingKeytab(t *testing.T) {
+	if _, err := newKerberos(gssapiConfig{Keytab: filepath.Join(t.TempDir(), "none")}); err == nil {
+		t.Error("newKerberos() error = nil")
+	}
+}
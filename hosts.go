@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// dnsHostsRule is the rule name of static hosts in metrics
+const dnsHostsRule = "hosts"
+
+// dnsOverrides resolves the domains by static hosts and rewrite rules before the dns cache and servers
+type dnsOverrides struct {
+	hosts    map[string][]net.IP // exact domains
+	rewrites []dnsRewrite        // the first matched rule wins
+}
+
+type dnsRewrite struct {
+	name   string
+	rule   aclRule        // domain patterns
+	regex  *regexp.Regexp // nil if the rule matches domain patterns
+	ips    []net.IP       // the domain is resolved to the addresses
+	domain string         // or the other domain is resolved instead, regex submatches are expanded
+	block  bool           // or the domain is not found
+}
+
+// dnsOverride is the result of matched hosts entry or rewrite rule
+type dnsOverride struct {
+	rule   string
+	ips    []net.IP
+	domain string // resolve the domain instead, empty if ips or block
+	block  bool
+}
+
+// newDNSOverrides compiles hosts and rewrites of dns config, it returns nil if there is nothing to override.
+// Errors are prefixed by config key.
+func newDNSOverrides(cfg dnsConfig) (*dnsOverrides, error) {
+	if len(cfg.Hosts) == 0 && len(cfg.Rewrites) == 0 {
+		return nil, nil
+	}
+
+	var errs []error
+
+	o := &dnsOverrides{
+		hosts: make(map[string][]net.IP, len(cfg.Hosts)),
+	}
+
+	for _, domain := range slices.Sorted(maps.Keys(cfg.Hosts)) {
+		key := "dns.hosts." + domain
+
+		if domain == "" || strings.ContainsAny(domain, "*/: ") {
+			errs = append(errs, fmt.Errorf("%s: must be domain name", key))
+			continue
+		}
+
+		ips, err := parseOverrideAddrs(cfg.Hosts[domain])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+			continue
+		}
+
+		o.hosts[normalizeDomain(domain)] = ips
+	}
+
+	for i, rc := range cfg.Rewrites {
+		key := fmt.Sprintf("dns.rewrites[%d]", i)
+
+		rewrite, err := newDNSRewrite(rc)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s.%w", key, err))
+			continue
+		}
+
+		if rewrite.name == "" {
+			rewrite.name = key
+		}
+
+		o.rewrites = append(o.rewrites, rewrite)
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+func newDNSRewrite(cfg dnsRewriteConfig) (dnsRewrite, error) {
+	rewrite := dnsRewrite{
+		name:   cfg.Name,
+		domain: normalizeDomain(cfg.Domain),
+		block:  cfg.Block,
+	}
+
+	switch {
+	case len(cfg.Domains) > 0 && cfg.Regex != "":
+		return rewrite, errors.New("regex: domains and regex are mutually exclusive")
+	case cfg.Regex != "":
+		regex, err := regexp.Compile(cfg.Regex)
+		if err != nil {
+			return rewrite, fmt.Errorf("regex: %w", err)
+		}
+		rewrite.regex = regex
+	default:
+		rule, err := newACLRule(aclRuleConfig{Action: aclAllow, Destinations: cfg.Domains})
+		if err != nil || len(cfg.Domains) == 0 || rule.any || len(rule.nets) > 0 {
+			return rewrite, errors.New("domains: must be domain names")
+		}
+		rewrite.rule = rule
+	}
+
+	targets := 0
+	for _, set := range []bool{len(cfg.Addresses) > 0, cfg.Domain != "", cfg.Block} {
+		if set {
+			targets++
+		}
+	}
+	if targets != 1 {
+		return rewrite, errors.New("addresses: one of addresses, domain or block must be specified")
+	}
+
+	if len(cfg.Addresses) > 0 {
+		ips, err := parseOverrideAddrs(cfg.Addresses)
+		if err != nil {
+			return rewrite, fmt.Errorf("addresses: %w", err)
+		}
+		rewrite.ips = ips
+	}
+
+	return rewrite, nil
+}
+
+func parseOverrideAddrs(list []string) ([]net.IP, error) {
+	if len(list) == 0 {
+		return nil, errors.New("must be ip addresses")
+	}
+
+	ips := make([]net.IP, 0, len(list))
+	for _, s := range list {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ip address %q", s)
+		}
+		ips = append(ips, net.IP(addr.Unmap().AsSlice()))
+	}
+
+	return ips, nil
+}
+
+// match returns the override of the domain by static hosts or the first matched rewrite rule
+func (o *dnsOverrides) match(host string) (dnsOverride, bool) {
+	if o == nil {
+		return dnsOverride{}, false
+	}
+
+	domain := normalizeDomain(host)
+	if ips, ok := o.hosts[domain]; ok {
+		return dnsOverride{rule: dnsHostsRule, ips: ips}, true
+	}
+
+	for _, rw := range o.rewrites {
+		res := dnsOverride{rule: rw.name, ips: rw.ips, domain: rw.domain, block: rw.block}
+
+		switch {
+		case rw.regex != nil:
+			m := rw.regex.FindStringSubmatchIndex(domain)
+			if m == nil {
+				continue
+			}
+			if res.domain != "" {
+				res.domain = string(rw.regex.ExpandString(nil, rw.domain, domain, m))
+			}
+		case !rw.rule.matchDomain(domain):
+			continue
+		}
+
+		return res, true
+	}
+
+	return dnsOverride{}, false
+}
+
+// addrs returns the addresses of the network: ip, ip4 or ip6. Blocked domain or no addresses of the network
+// is "not found" error.
+func (d dnsOverride) addrs(network, host string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, ip := range d.ips {
+		v4 := ip.To4() != nil
+		if network == "ip" || network == "ip4" && v4 || network == "ip6" && !v4 {
+			ips = append(ips, ip)
+		}
+	}
+
+	if d.block || len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	return ips, nil
+}
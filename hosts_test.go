@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_resolver_overrides(t *testing.T) {
+	overrides, err := newDNSOverrides(dnsConfig{
+		Hosts: map[string][]string{
+			"api.internal": {"10.0.0.5", "2001:db8::5"},
+		},
+		Rewrites: []dnsRewriteConfig{
+			{Name: "staging", Domains: []string{"*.staging.example"}, Addresses: []string{"10.0.0.10"}},
+			{Name: "trackers", Regex: `^ads?[0-9]*\.`, Block: true},
+			{Name: "mirror", Regex: `^(.+)\.mirror\.example$`, Domain: "$1.example.com"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resolved []string
+	r := newResolver(dnsConfig{CacheSize: 10})
+	r.overrides = overrides
+	r.resolver = fakeResolver{
+		fnLookupIP: func(_ context.Context, _, host string) ([]net.IP, error) {
+			resolved = append(resolved, host)
+			return []net.IP{net.IPv4(192, 0, 2, 1)}, nil
+		},
+	}
+
+	tests := []struct {
+		name         string
+		network      string
+		host         string
+		want         []net.IP
+		wantNotFound bool
+		wantResolved string
+	}{
+		{name: "hosts", network: "ip", host: "API.internal.", want: []net.IP{net.ParseIP("10.0.0.5").To4(), net.ParseIP("2001:db8::5")}},
+		{name: "hosts of family", network: "ip6", host: "api.internal", want: []net.IP{net.ParseIP("2001:db8::5")}},
+		{name: "rewrite to addresses", network: "ip", host: "web.staging.example", want: []net.IP{net.ParseIP("10.0.0.10").To4()}},
+		{name: "no addresses of family", network: "ip6", host: "web.staging.example", wantNotFound: true},
+		{name: "blocked", network: "ip", host: "ads1.tracker.example", wantNotFound: true},
+		{name: "rewrite to domain", network: "ip", host: "www.mirror.example", want: []net.IP{net.IPv4(192, 0, 2, 1)}, wantResolved: "www.example.com"},
+		{name: "not matched", network: "ip", host: "staging.example", want: []net.IP{net.IPv4(192, 0, 2, 1)}, wantResolved: "staging.example"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolved = nil
+
+			ips, err := r.LookupIP(context.Background(), tt.network, tt.host)
+			if tt.wantNotFound {
+				var dnsErr *net.DNSError
+				if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+					t.Fatalf("LookupIP() error = %v, want not found", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("LookupIP() error = %v", err)
+			}
+			if !reflect.DeepEqual(ips, tt.want) {
+				t.Errorf("LookupIP() = %v, want %v", ips, tt.want)
+			}
+			if tt.wantResolved == "" && len(resolved) > 0 || tt.wantResolved != "" && !reflect.DeepEqual(resolved, []string{tt.wantResolved}) {
+				t.Errorf("resolved domains = %v, want %q", resolved, tt.wantResolved)
+			}
+		})
+	}
+}
+
+func Test_newDNSOverrides_errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     dnsConfig
+		wantErr string
+	}{
+		{
+			name:    "invalid hosts address",
+			cfg:     dnsConfig{Hosts: map[string][]string{"api.internal": {"api"}}},
+			wantErr: `dns.hosts.api.internal: invalid ip address "api"`,
+		},
+		{
+			name:    "hosts pattern",
+			cfg:     dnsConfig{Hosts: map[string][]string{"*.internal": {"10.0.0.5"}}},
+			wantErr: "dns.hosts.*.internal: must be domain name",
+		},
+		{
+			name:    "domains and regex",
+			cfg:     dnsConfig{Rewrites: []dnsRewriteConfig{{Domains: []string{".example"}, Regex: "example", Block: true}}},
+			wantErr: "dns.rewrites[0].regex: domains and regex are mutually exclusive",
+		},
+		{
+			name:    "invalid regex",
+			cfg:     dnsConfig{Rewrites: []dnsRewriteConfig{{Regex: "(", Block: true}}},
+			wantErr: "dns.rewrites[0].regex: error parsing regexp",
+		},
+		{
+			name:    "rewrite by cidr",
+			cfg:     dnsConfig{Rewrites: []dnsRewriteConfig{{Domains: []string{"10.0.0.0/8"}, Block: true}}},
+			wantErr: "dns.rewrites[0].domains: must be domain names",
+		},
+		{
+			name:    "no target",
+			cfg:     dnsConfig{Rewrites: []dnsRewriteConfig{{Domains: []string{".example"}}}},
+			wantErr: "dns.rewrites[0].addresses: one of addresses, domain or block must be specified",
+		},
+		{
+			name:    "multiple targets",
+			cfg:     dnsConfig{Rewrites: []dnsRewriteConfig{{Domains: []string{".example"}, Domain: "example.com", Block: true}}},
+			wantErr: "dns.rewrites[0].addresses: one of addresses, domain or block must be specified",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newDNSOverrides(tt.cfg)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("newDNSOverrides() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if o, err := newDNSOverrides(dnsConfig{}); o != nil || err != nil {
+		t.Errorf("newDNSOverrides(empty) = %v, %v, want nil", o, err)
+	}
+}
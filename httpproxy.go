@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dblokhin/proxyme"
+)
+
+// httpRealm is the realm of Basic proxy authentication
+const httpRealm = "proxyme"
+
+var errBadTarget = errors.New("invalid target host")
+
+// hopHeaders are the headers of single connection, they are not forwarded, RFC 9110
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// httpProxy serves single client connection of http proxy: CONNECT tunnels and the requests with absolute uri.
+// The requests are authenticated once per connection.
+type httpProxy struct {
+	st    *settings
+	sess  *session
+	conn  net.Conn
+	admit func() error
+
+	authenticate func(username, password []byte) error // nil if username/password authentication is disabled
+	noAuth       bool
+	authorized   bool
+
+	// the connection of forwarded requests, it's reused by the next requests to the same host
+	remote     net.Conn
+	remoteHost string
+	remoteBuf  *bufio.Reader
+}
+
+// serveHTTP serves http proxy client connection
+func (st *settings) serveHTTP(sess *session, client net.Conn, admit func() error) {
+	// there is no socks5 handshake, the connection only counts and limits the traffic
+	conn := &clientConn{
+		Conn:  client,
+		sess:  sess,
+		shape: st.shaper.open(sess),
+		state: stateRelay,
+	}
+	defer conn.shape.close()
+
+	p := &httpProxy{
+		st:           st,
+		sess:         sess,
+		conn:         conn,
+		admit:        admit,
+		authenticate: st.authenticate(sess),
+		noAuth:       st.allowNoAuth(sess),
+	}
+
+	p.serve()
+}
+
+// serve reads the client requests until the connection is closed or tunnelled
+func (p *httpProxy) serve() {
+	defer p.closeRemote()
+
+	// the headers are limited like by http server, the body is not
+	lr := &io.LimitedReader{R: p.conn, N: http.DefaultMaxHeaderBytes}
+	br := bufio.NewReader(lr)
+
+	for {
+		lr.N = http.DefaultMaxHeaderBytes
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			var ne net.Error
+			switch {
+			case lr.N == 0:
+				// the limited reader reports the headers exceeding the limit as EOF
+				p.sess.setStatus(http.StatusRequestHeaderFieldsTooLarge)
+				p.sess.setCloseReason("request headers too large")
+				rejectHTTP(p.conn, http.StatusRequestHeaderFieldsTooLarge)
+				return
+			case !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.As(err, &ne):
+				p.reply(http.StatusBadRequest, nil, true)
+			}
+			p.sess.setCloseReason(closeReason(err, "client closed"))
+			return
+		}
+		lr.N = math.MaxInt64
+
+		if err := p.authorize(req); err != nil {
+			if !p.replyAuth(req, err) {
+				p.sess.setCloseReason(err.Error())
+				return
+			}
+			continue
+		}
+
+		if req.Method == http.MethodConnect {
+			p.tunnel(req, br)
+			return
+		}
+
+		if !p.forward(req) {
+			return
+		}
+	}
+}
+
+// authorize checks Proxy-Authorization header of the first request, the next requests of the connection
+// are authorized by it
+func (p *httpProxy) authorize(req *http.Request) error {
+	if p.authorized {
+		return nil
+	}
+
+	header := req.Header.Get("Proxy-Authorization")
+	if header == "" || p.authenticate == nil {
+		if !p.noAuth {
+			return errAuthRequired
+		}
+
+		p.sess.setMethod(authNone)
+		p.authorized = true
+		return nil
+	}
+
+	p.sess.setMethod(authPassword)
+
+	user, pass, ok := parseBasicAuth(header)
+	if !ok {
+		p.sess.setAuthenticated(false)
+		return errDenied
+	}
+
+	if err := p.authenticate([]byte(user), []byte(pass)); err != nil {
+		p.sess.setAuthenticated(false)
+		return err
+	}
+
+	p.sess.setAuthenticated(true)
+	p.authorized = true
+	return nil
+}
+
+// replyAuth replies failed authorization, it reports whether the client may retry on the same connection
+func (p *httpProxy) replyAuth(req *http.Request, err error) bool {
+	if !errors.Is(err, errDenied) && !errors.Is(err, errAuthRequired) {
+		log.Println(err)
+		p.reply(http.StatusServiceUnavailable, nil, true)
+		return false
+	}
+
+	// the client repeats the request with credentials
+	_, drainErr := io.Copy(io.Discard, req.Body)
+	keepAlive := drainErr == nil && !req.Close && p.authenticate != nil
+
+	p.reply(http.StatusProxyAuthRequired, http.Header{
+		"Proxy-Authenticate": {`Basic realm="` + httpRealm + `"`},
+	}, !keepAlive)
+
+	return keepAlive
+}
+
+// tunnel connects to the destination of CONNECT request and relays the data as is
+func (p *httpProxy) tunnel(req *http.Request, br *bufio.Reader) {
+	remote, err := p.connect(req.Host)
+	if err != nil {
+		p.fail(err)
+		return
+	}
+	defer remote.Close()
+
+	p.sess.setStatus(http.StatusOK)
+	if _, err := io.WriteString(p.conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+
+	// the client could send the data without waiting for the reply
+	if n := br.Buffered(); n > 0 {
+		data, _ := br.Peek(n)
+		if _, err := remote.Write(data); err != nil {
+			p.sess.setCloseReason(closeReason(err, "remote closed"))
+			return
+		}
+	}
+
+	relay(p.conn, remote)
+}
+
+// forward sends the request with absolute uri to the destination and relays the response back.
+// It reports whether the client connection may serve the next request.
+func (p *httpProxy) forward(req *http.Request) bool {
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		p.reply(http.StatusBadRequest, nil, true)
+		return false
+	}
+
+	host := req.URL.Host
+	if req.URL.Port() == "" {
+		host = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+
+	removeHopHeaders(req.Header)
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header["User-Agent"] = []string{""} // don't let the request get the default one
+	}
+
+	resp, err := p.roundTrip(req, host)
+	// informational responses precede the final one
+	for err == nil && resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+		if err = resp.Write(p.conn); err != nil {
+			return false
+		}
+		resp, err = http.ReadResponse(p.remoteBuf, req)
+	}
+	if err != nil {
+		p.closeRemote()
+		p.fail(err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	// the response of unknown length is finished by closing the connection
+	keepAlive := !req.Close && !resp.Close &&
+		(resp.ContentLength >= 0 || slices.Contains(resp.TransferEncoding, "chunked"))
+
+	removeHopHeaders(resp.Header)
+	resp.Close = !keepAlive
+
+	p.sess.setStatus(resp.StatusCode)
+	if err := resp.Write(p.conn); err != nil {
+		p.closeRemote()
+		return false
+	}
+
+	if !keepAlive {
+		p.closeRemote()
+	}
+
+	return keepAlive
+}
+
+// roundTrip sends the request to the host and reads the response. The request without body is repeated on
+// the new connection if the reused one is closed by the remote host meanwhile.
+func (p *httpProxy) roundTrip(req *http.Request, host string) (*http.Response, error) {
+	reused := p.remote != nil && p.remoteHost == host
+
+	if err := p.dialRemote(host); err != nil {
+		return nil, err
+	}
+
+	resp, err := p.exchange(req)
+	if err != nil && reused && (req.Body == nil || req.Body == http.NoBody) {
+		p.closeRemote()
+		if err := p.dialRemote(host); err != nil {
+			return nil, err
+		}
+		resp, err = p.exchange(req)
+	}
+
+	return resp, err
+}
+
+func (p *httpProxy) exchange(req *http.Request) (*http.Response, error) {
+	if err := req.Write(p.remote); err != nil {
+		return nil, err
+	}
+
+	return http.ReadResponse(p.remoteBuf, req)
+}
+
+// dialRemote connects to the host of forwarded request unless the connection to it is open
+func (p *httpProxy) dialRemote(host string) error {
+	if p.remote != nil && p.remoteHost == host {
+		return nil
+	}
+	p.closeRemote()
+
+	remote, err := p.connect(host)
+	if err != nil {
+		return err
+	}
+
+	p.remote, p.remoteHost, p.remoteBuf = remote, host, bufio.NewReader(remote)
+	return nil
+}
+
+func (p *httpProxy) closeRemote() {
+	if p.remote != nil {
+		_ = p.remote.Close()
+		p.remote, p.remoteHost, p.remoteBuf = nil, "", nil
+	}
+}
+
+// connect dials host:port on behalf of the session like socks5 CONNECT request
+func (p *httpProxy) connect(hostport string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, errBadTarget
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 || host == "" {
+		return nil, errBadTarget
+	}
+
+	if err := p.admit(); err != nil {
+		return nil, err
+	}
+
+	addressType, addr := atypDomain, []byte(host)
+	if ip, err := netip.ParseAddr(host); err == nil {
+		addressType, addr = atypIPv6, ip.AsSlice()
+		if ip.Is4() {
+			addressType = atypIPv4
+		}
+	}
+
+	return p.st.connector.connect(p.sess, addressType, addr, port)
+}
+
+// fail replies the error of connecting or forwarding and closes the connection
+func (p *httpProxy) fail(err error) {
+	p.sess.setCloseReason(err.Error())
+	p.reply(httpStatus(err), nil, true)
+}
+
+// reply writes empty response with the status
+func (p *httpProxy) reply(status int, header http.Header, closeConn bool) {
+	p.sess.setStatus(status)
+
+	if header == nil {
+		header = make(http.Header)
+	}
+
+	resp := &http.Response{
+		StatusCode: status,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Close:      closeConn,
+	}
+
+	_ = resp.Write(p.conn)
+}
+
+// httpStatus returns the status of failed connection to the destination
+func httpStatus(err error) int {
+	var ne net.Error
+
+	switch {
+	case errors.Is(err, errBadTarget):
+		return http.StatusBadRequest
+	case errors.Is(err, proxyme.ErrNotAllowed):
+		return http.StatusForbidden
+	case errors.Is(err, proxyme.ErrTTLExpired), errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &ne) && ne.Timeout():
+		return http.StatusGatewayTimeout
+	}
+
+	return http.StatusBadGateway
+}
+
+// parseBasicAuth parses Basic credentials of Proxy-Authorization header, RFC 7617
+func parseBasicAuth(header string) (string, string, bool) {
+	const prefix = "basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header[len(prefix):]))
+	if err != nil {
+		return "", "", false
+	}
+
+	return strings.Cut(string(decoded), ":")
+}
+
+// removeHopHeaders removes the headers of single connection and the ones listed in Connection header
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
+	}
+
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// rejectHTTP replies the status to http proxy client and closes the connection.
+// The request is drained to make the client get the reply instead of connection reset.
+func rejectHTTP(conn net.Conn, status int) {
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(rejectTimeout))
+
+	reply := "HTTP/1.1 " + strconv.Itoa(status) + " " + http.StatusText(status) + "\r\n" +
+		"Connection: close\r\nContent-Length: 0\r\n\r\n"
+	if _, err := io.WriteString(conn, reply); err != nil {
+		return
+	}
+
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+
+	_, _ = io.Copy(io.Discard, io.LimitReader(conn, http.DefaultMaxHeaderBytes))
+}
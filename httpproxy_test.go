@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_server_serveHTTP(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" || r.Header.Get("Proxy-Connection") != "" {
+			http.Error(w, "hop-by-hop headers are forwarded", http.StatusBadRequest)
+			return
+		}
+		_, _ = io.WriteString(w, "hello "+r.URL.Path)
+	}))
+	defer backend.Close()
+
+	tlsBackend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "secure "+r.URL.Path)
+	}))
+	defer tlsBackend.Close()
+
+	cfg := defaultConfig()
+	cfg.Users = "alice:secret"
+	cfg.Egress.Enable = false
+	proxy := startServer(t, cfg, (*server).ListenAndServeHTTP)
+
+	tests := []struct {
+		name       string
+		user       *url.Userinfo
+		target     string
+		wantStatus int
+		wantBody   string
+		wantErr    string
+	}{
+		{name: "forward", user: url.UserPassword("alice", "secret"), target: backend.URL + "/path", wantStatus: http.StatusOK, wantBody: "hello /path"},
+		{name: "connect", user: url.UserPassword("alice", "secret"), target: tlsBackend.URL + "/path", wantStatus: http.StatusOK, wantBody: "secure /path"},
+		{name: "no credentials", target: backend.URL, wantStatus: http.StatusProxyAuthRequired},
+		{name: "wrong password", user: url.UserPassword("alice", "wrong"), target: backend.URL, wantStatus: http.StatusProxyAuthRequired},
+		{name: "connect without credentials", target: tlsBackend.URL, wantErr: "Proxy Authentication Required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := tlsBackend.Client().Transport.(*http.Transport).Clone()
+			transport.Proxy = http.ProxyURL(&url.URL{Scheme: "http", Host: proxy, User: tt.user})
+			defer transport.CloseIdleConnections()
+
+			resp, err := (&http.Client{Transport: transport}).Get(tt.target)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Get() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			defer resp.Body.Close()
+
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if tt.wantBody != "" && string(body) != tt.wantBody {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+			if tt.wantStatus == http.StatusProxyAuthRequired && resp.Header.Get("Proxy-Authenticate") == "" {
+				t.Error("Proxy-Authenticate header is missing")
+			}
+		})
+	}
+}
+
+func Test_server_serveHTTP_denied(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "hello")
+	}))
+	defer backend.Close()
+
+	// the egress guard denies loopback destinations
+	cfg := defaultConfig()
+	cfg.NoAuth = true
+	proxy := startServer(t, cfg, (*server).ListenAndServeHTTP)
+
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	host := strings.TrimPrefix(backend.URL, "http://")
+	if _, err := io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := make([]byte, 12)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(reply); got != "HTTP/1.1 403" {
+		t.Errorf("reply = %q, want HTTP/1.1 403", got)
+	}
+}
+
+func Test_server_serveHTTP_headersTooLarge(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.NoAuth = true
+	proxy := startServer(t, cfg, (*server).ListenAndServeHTTP)
+
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	go func() {
+		_, _ = io.WriteString(conn, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nX-Large: "+
+			strings.Repeat("x", http.DefaultMaxHeaderBytes)+"\r\n\r\n")
+	}()
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply := make([]byte, 12)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(reply); got != "HTTP/1.1 431" {
+		t.Errorf("reply = %q, want HTTP/1.1 431", got)
+	}
+}
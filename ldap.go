@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapAuth checks credentials by LDAP simple bind as the user
+type ldapAuth struct {
+	url      string // ldap://host:389 or ldaps://host:636
+	bindDN   string // bind DN template, {username} is replaced by escaped username
+	startTLS bool
+	timeout  time.Duration
+}
+
+func newLDAPAuth(cfg ldapConfig, timeout time.Duration) ldapAuth {
+	return ldapAuth{
+		url:      cfg.URL,
+		bindDN:   cfg.BindDN,
+		startTLS: cfg.StartTLS,
+		timeout:  timeout,
+	}
+}
+
+func (a ldapAuth) authenticate(username, password []byte) error {
+	// empty password means unauthenticated bind that is successful for most servers
+	if len(username) == 0 || len(password) == 0 {
+		return errDenied
+	}
+
+	conn, err := ldap.DialURL(a.url, ldap.DialWithDialer(&net.Dialer{Timeout: a.timeout}))
+	if err != nil {
+		return fmt.Errorf("ldap: %w", err)
+	}
+	defer conn.Close()
+
+	conn.SetTimeout(a.timeout)
+
+	if a.startTLS {
+		u, err := url.Parse(a.url)
+		if err != nil {
+			return fmt.Errorf("ldap: %w", err)
+		}
+
+		if err := conn.StartTLS(&tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}); err != nil {
+			return fmt.Errorf("ldap start tls: %w", err)
+		}
+	}
+
+	dn := strings.ReplaceAll(a.bindDN, "{username}", ldap.EscapeDN(string(username)))
+	if err := conn.Bind(dn, string(password)); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return errDenied
+		}
+
+		return fmt.Errorf("ldap bind: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// fakeLDAP is in-process LDAP server that handles simple bind requests only
+type fakeLDAP struct {
+	ls    net.Listener
+	users map[string]string // dn -> password
+}
+
+func newFakeLDAP(t *testing.T, users map[string]string) *fakeLDAP {
+	t.Helper()
+
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeLDAP{ls: ls, users: users}
+	t.Cleanup(func() { _ = ls.Close() })
+
+	go func() {
+		for {
+			conn, err := ls.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+
+	return f
+}
+
+func (f *fakeLDAP) url() string {
+	return "ldap://" + f.ls.Addr().String()
+}
+
+func (f *fakeLDAP) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+
+		msgID := packet.Children[0].Value.(int64)
+		req := packet.Children[1]
+		if req.Tag != ldap.ApplicationBindRequest || len(req.Children) < 3 {
+			return // unbind or unsupported request
+		}
+
+		dn := req.Children[1].Value.(string)
+		password := req.Children[2].Data.String()
+
+		code := ldap.LDAPResultSuccess
+		if pass, ok := f.users[dn]; !ok || pass != password {
+			code = ldap.LDAPResultInvalidCredentials
+		}
+
+		resp := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+		resp.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, msgID, "MessageID"))
+		bind := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationBindResponse, nil, "Bind Response")
+		bind.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "resultCode"))
+		bind.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+		bind.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+		resp.AppendChild(bind)
+
+		if _, err := conn.Write(resp.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+func Test_ldapAuth(t *testing.T) {
+	srv := newFakeLDAP(t, map[string]string{
+		"uid=alice,ou=people,dc=example,dc=com":      "1234",
+		`uid=bob\,admin,ou=people,dc=example,dc=com`: "secret",
+	})
+
+	a := newLDAPAuth(ldapConfig{
+		URL:    srv.url(),
+		BindDN: "uid={username},ou=people,dc=example,dc=com",
+	}, time.Second)
+
+	tests := []struct {
+		name        string
+		username    string
+		password    string
+		expectedErr error
+	}{
+		{"valid user", "alice", "1234", nil},
+		{"escaped username", "bob,admin", "secret", nil},
+		{"invalid password", "alice", "4321", errDenied},
+		{"non-existent user", "nobody", "1234", errDenied},
+		{"empty password is not unauthenticated bind", "alice", "", errDenied},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := a.authenticate([]byte(tt.username), []byte(tt.password))
+			if !errors.Is(err, tt.expectedErr) {
+				t.Errorf("expected error %v, got %v", tt.expectedErr, err)
+			}
+		})
+	}
+}
+
+func Test_ldapAuth_unavailable(t *testing.T) {
+	srv := newFakeLDAP(t, nil)
+	url := srv.url()
+	_ = srv.ls.Close()
+
+	a := newLDAPAuth(ldapConfig{URL: url, BindDN: "uid={username}"}, time.Second)
+
+	err := a.authenticate([]byte("alice"), []byte("1234"))
+	if err == nil || errors.Is(err, errDenied) {
+		t.Errorf("expected failure, got %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dblokhin/proxyme"
+	"golang.org/x/time/rate"
+)
+
+// session rejection reasons, see sessionLimits
+const (
+	rejectTotal      = "total"
+	rejectPerIP      = "per_ip"
+	rejectPerUser    = "per_user"
+	rejectAcceptRate = "accept_rate"
+	rejectClient     = "client_denied"
+)
+
+// rejectTimeout is max time to reject the client politely
+const rejectTimeout = time.Second
+
+// limitsConfig is the caps of concurrent sessions, 0 means unlimited
+type limitsConfig struct {
+	MaxSessions        int     `yaml:"max_sessions"`          // all the clients together
+	MaxSessionsPerIP   int     `yaml:"max_sessions_per_ip"`   // the clients of the same ip address
+	MaxSessionsPerUser int     `yaml:"max_sessions_per_user"` // the sessions of the same authenticated user
+	AcceptRate         float64 `yaml:"accept_rate"`           // new connections per second
+	AcceptBurst        int     `yaml:"accept_burst"`          // new connections accepted at once, accept_rate by default
+}
+
+// sessionLimits counts the active sessions: total, per client ip and per user.
+// The counters survive the config reloads, the new limits are applied to the new sessions.
+type sessionLimits struct {
+	mu     sync.Mutex
+	cfg    limitsConfig
+	total  int
+	ips    map[string]int
+	users  map[string]int
+	accept *rate.Limiter
+}
+
+func newSessionLimits() *sessionLimits {
+	return &sessionLimits{
+		ips:    make(map[string]int),
+		users:  make(map[string]int),
+		accept: rate.NewLimiter(rate.Inf, 0),
+	}
+}
+
+func (l *sessionLimits) update(cfg limitsConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.cfg = cfg
+
+	if cfg.AcceptRate <= 0 {
+		l.accept.SetLimit(rate.Inf)
+		return
+	}
+
+	burst := cfg.AcceptBurst
+	if burst <= 0 {
+		burst = max(int(cfg.AcceptRate), 1)
+	}
+	l.accept.SetBurst(burst)
+	l.accept.SetLimit(rate.Limit(cfg.AcceptRate))
+}
+
+// enter takes the session slot of the client, it fails if the limits are exceeded
+func (l *sessionLimits) enter(client net.Addr) (*sessionSlot, error) {
+	ip := clientKey(client)
+
+	if !l.accept.Allow() {
+		return nil, l.reject(rejectAcceptRate, fmt.Errorf("%w: too many new connections", proxyme.ErrNotAllowed))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.cfg.MaxSessions > 0 && l.total >= l.cfg.MaxSessions {
+		return nil, l.reject(rejectTotal, fmt.Errorf("%w: too many sessions", proxyme.ErrNotAllowed))
+	}
+	if l.cfg.MaxSessionsPerIP > 0 && ip != "" && l.ips[ip] >= l.cfg.MaxSessionsPerIP {
+		return nil, l.reject(rejectPerIP, fmt.Errorf("%w: too many sessions from %s", proxyme.ErrNotAllowed, ip))
+	}
+
+	l.total++
+	if ip != "" {
+		l.ips[ip]++
+	}
+
+	return &sessionSlot{limits: l, ip: ip}, nil
+}
+
+// enterUser takes the session slot of the user, must be called with lock held
+func (l *sessionLimits) enterUser(user string) error {
+	if l.cfg.MaxSessionsPerUser > 0 && l.users[user] >= l.cfg.MaxSessionsPerUser {
+		return l.reject(rejectPerUser, fmt.Errorf("%w: too many sessions of user %q", proxyme.ErrNotAllowed, user))
+	}
+
+	l.users[user]++
+	return nil
+}
+
+// reject counts the rejected session
+func (l *sessionLimits) reject(reason string, err error) error {
+	countRejectedSession(reason)
+	return err
+}
+
+// decrement decrements counter by key, must be called with lock held
+func decrement(counters map[string]int, key string) {
+	counters[key]--
+	if counters[key] <= 0 {
+		delete(counters, key)
+	}
+}
+
+// sessionSlot is the place of the session in the limits, it must be left when the session is finished
+type sessionSlot struct {
+	limits *sessionLimits
+	ip     string
+
+	mu       sync.Mutex
+	user     string
+	hasUser  bool // the user slot is taken
+	finished bool
+}
+
+// enterUser takes the slot of authenticated user, it is no-op for anonymous clients and taken slot
+func (s *sessionSlot) enterUser(user string) error {
+	if user == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.hasUser || s.finished {
+		return nil
+	}
+
+	s.limits.mu.Lock()
+	defer s.limits.mu.Unlock()
+
+	if err := s.limits.enterUser(user); err != nil {
+		return err
+	}
+
+	s.user = user
+	s.hasUser = true
+
+	return nil
+}
+
+func (s *sessionSlot) leave() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.finished {
+		return
+	}
+	s.finished = true
+
+	s.limits.mu.Lock()
+	defer s.limits.mu.Unlock()
+
+	s.limits.total--
+	if s.ip != "" {
+		decrement(s.limits.ips, s.ip)
+	}
+	if s.hasUser {
+		decrement(s.limits.users, s.user)
+	}
+}
+
+// rejectConn tells socks5 client there are no acceptable auth methods and closes the connection.
+// The greeting is drained to make the client get the reply instead of connection reset.
+func rejectConn(conn net.Conn) {
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(rejectTimeout))
+	if _, err := conn.Write([]byte{socks5Version, authNoAcceptable}); err != nil {
+		return
+	}
+
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+
+	const maxGreeting = 2 + 255
+	_, _ = io.Copy(io.Discard, io.LimitReader(conn, maxGreeting))
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/dblokhin/proxyme"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_sessionLimits(t *testing.T) {
+	var (
+		office = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+		home   = &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 40000}
+	)
+
+	l := newSessionLimits()
+	l.update(limitsConfig{MaxSessions: 3, MaxSessionsPerIP: 2, MaxSessionsPerUser: 1})
+
+	tests := []struct {
+		name       string
+		client     net.Addr
+		user       string
+		wantReason string
+	}{
+		{name: "first", client: office, user: "alice"},
+		{name: "anonymous", client: office},
+		{name: "over per ip", client: office, wantReason: rejectPerIP},
+		{name: "over per user", client: home, user: "alice", wantReason: rejectPerUser},
+		{name: "over total", client: home, wantReason: rejectTotal},
+	}
+
+	var slots []*sessionSlot
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rejected := sessionsRejected.WithLabelValues(tt.wantReason)
+			before := testutil.ToFloat64(rejected)
+
+			slot, err := l.enter(tt.client)
+			if err == nil {
+				slots = append(slots, slot)
+				err = slot.enterUser(tt.user)
+			}
+
+			if tt.wantReason == "" {
+				if err != nil {
+					t.Fatalf("enter() error = %v", err)
+				}
+				return
+			}
+
+			if !errors.Is(err, proxyme.ErrNotAllowed) {
+				t.Fatalf("enter() error = %v, want %v", err, proxyme.ErrNotAllowed)
+			}
+			if got := testutil.ToFloat64(rejected) - before; got != 1 {
+				t.Errorf("rejected{%s} increased by %v, want 1", tt.wantReason, got)
+			}
+		})
+	}
+
+	for _, slot := range slots {
+		slot.leave()
+		slot.leave() // no-op
+	}
+	if l.total != 0 || len(l.ips) != 0 || len(l.users) != 0 {
+		t.Errorf("slots are not released: total %d, ips %v, users %v", l.total, l.ips, l.users)
+	}
+}
+
+func Test_sessionLimits_acceptRate(t *testing.T) {
+	l := newSessionLimits()
+	l.update(limitsConfig{AcceptRate: 1, AcceptBurst: 2})
+
+	client := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+	for i := 0; i < 2; i++ {
+		if _, err := l.enter(client); err != nil {
+			t.Fatalf("enter() #%d error = %v", i, err)
+		}
+	}
+	if _, err := l.enter(client); err == nil {
+		t.Error("enter() over accept rate error = nil")
+	}
+
+	// limits are hot changeable
+	l.update(limitsConfig{})
+	if _, err := l.enter(client); err != nil {
+		t.Errorf("enter() unlimited error = %v", err)
+	}
+}
+
+func Test_rejectConn(t *testing.T) {
+	client, server := tcpPair(t)
+
+	go rejectConn(server)
+
+	if _, err := client.Write([]byte{socks5Version, 1, authNone}); err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if string(reply) != string([]byte{socks5Version, authNoAcceptable}) {
+		t.Errorf("reply = %v, want no acceptable methods", reply)
+	}
+}
+
+func Test_clientConn_admit(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	sess := newSession(nil)
+	errDenied := errors.New("too many sessions")
+	conn := &clientConn{Conn: server, sess: sess, admit: func() error { return errDenied }}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- fakeHandler(conn, authNone, repSucceeded)
+		_ = conn.Close()
+	}()
+
+	go func() {
+		_, _ = client.Write([]byte{5, 1, 0, 5, 1, 0, 1, 8, 8, 8, 8, 0, 53})
+	}()
+
+	reply, _ := io.ReadAll(client)
+	if err := <-errc; !errors.Is(err, errDenied) {
+		t.Errorf("handler error = %v, want %v", err, errDenied)
+	}
+	if len(reply) != 2+10 || reply[3] != repNotAllowed {
+		t.Errorf("reply = %v, want method reply and not allowed reply", reply)
+	}
+	if sess.reply != repNotAllowed {
+		t.Errorf("session reply = %d, want %d", sess.reply, repNotAllowed)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// listen address prefixes, TCP address "host:port" has no prefix
+const (
+	listenUnix    = "unix:"    // unix:/run/proxyme.sock
+	listenSystemd = "systemd:" // systemd:name of socket activation, the first passed socket if the name is empty
+)
+
+// systemd socket activation, sd_listen_fds(3)
+const (
+	envListenPID     = "LISTEN_PID"
+	envListenFDs     = "LISTEN_FDS"
+	envListenFDNames = "LISTEN_FDNAMES"
+	systemdFirstFD   = 3
+)
+
+var errNoSystemdSocket = errors.New("no socket passed by systemd")
+
+// systemd is the sockets passed by systemd, they are taken once by the listeners
+var systemd struct {
+	once    sync.Once
+	mu      sync.Mutex
+	sockets []systemdSocket
+	err     error
+}
+
+type systemdSocket struct {
+	name string
+	file *os.File
+}
+
+// listen opens the listener of the address: TCP "host:port", unix socket or the socket passed by systemd
+func listen(ctx context.Context, l listenerConfig) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(l.Listen, listenUnix):
+		return listenUnixSocket(ctx, strings.TrimPrefix(l.Listen, listenUnix), l.Socket)
+	case strings.HasPrefix(l.Listen, listenSystemd):
+		return systemdListener(strings.TrimPrefix(l.Listen, listenSystemd))
+	}
+
+	lc := net.ListenConfig{}
+	return lc.Listen(ctx, "tcp", l.Listen)
+}
+
+// listenUnixSocket listens the unix socket and sets its file mode and owner. The socket is created in a private
+// directory and moved into place once they are set, so it's never accessible beyond them. The socket file left
+// by the previous run is replaced unless it's used, the file is removed on close.
+func listenUnixSocket(ctx context.Context, path string, sock socketConfig) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		var d net.Dialer
+		if conn, err := d.DialContext(ctx, "unix", path); err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("socket %s is used by another process", path)
+		}
+	}
+
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".proxyme-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "s")
+
+	lc := net.ListenConfig{}
+	ls, err := lc.Listen(ctx, "unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	ul := ls.(*net.UnixListener)
+	ul.SetUnlinkOnClose(false)
+
+	if err := setSocketOwner(tmp, sock); err != nil {
+		_ = ul.Close()
+		return nil, err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		_ = ul.Close()
+		return nil, err
+	}
+
+	return &unixSocketListener{UnixListener: ul, path: path}, nil
+}
+
+// unixSocketListener removes the socket file on close, the file is moved from the path it's created at
+type unixSocketListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixSocketListener) Close() error {
+	err := l.UnixListener.Close()
+	if err == nil {
+		_ = os.Remove(l.path)
+	}
+
+	return err
+}
+
+// setSocketOwner sets file mode, owner and group of the socket file if given
+func setSocketOwner(path string, sock socketConfig) error {
+	if sock.Mode != "" {
+		mode, err := strconv.ParseUint(sock.Mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("socket mode: %w", err)
+		}
+		if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+			return err
+		}
+	}
+
+	if sock.Owner == "" && sock.Group == "" {
+		return nil
+	}
+
+	uid, gid := -1, -1
+	if sock.Owner != "" {
+		u, err := user.Lookup(sock.Owner)
+		if err != nil {
+			if u, err = user.LookupId(sock.Owner); err != nil {
+				return fmt.Errorf("socket owner: %w", err)
+			}
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+
+	if sock.Group != "" {
+		g, err := user.LookupGroup(sock.Group)
+		if err != nil {
+			if g, err = user.LookupGroupId(sock.Group); err != nil {
+				return fmt.Errorf("socket group: %w", err)
+			}
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	return os.Chown(path, uid, gid)
+}
+
+// unixPeer is the address of unix socket client, the client is identified by the user id of its process
+type unixPeer struct {
+	uid int // -1 if unknown
+}
+
+func (p unixPeer) Network() string { return "unix" }
+
+func (p unixPeer) String() string {
+	if p.uid < 0 {
+		return "unix"
+	}
+
+	return "uid:" + strconv.Itoa(p.uid)
+}
+
+// clientAddr returns the address of the client, the clients of unix socket are identified by their user id
+func clientAddr(conn net.Conn) net.Addr {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return conn.RemoteAddr()
+	}
+
+	uid, err := peerUID(uc)
+	if err != nil {
+		uid = -1
+	}
+
+	return unixPeer{uid: uid}
+}
+
+// systemdListener takes the socket passed by systemd by FileDescriptorName of socket unit,
+// any of them if the name is empty
+func systemdListener(name string) (net.Listener, error) {
+	systemd.once.Do(func() {
+		systemd.sockets, systemd.err = systemdSockets(os.Getenv, systemdFirstFD)
+
+		// the sockets are not passed on to the child processes
+		for _, env := range []string{envListenPID, envListenFDs, envListenFDNames} {
+			_ = os.Unsetenv(env)
+		}
+	})
+
+	systemd.mu.Lock()
+	defer systemd.mu.Unlock()
+
+	if systemd.err != nil {
+		return nil, systemd.err
+	}
+
+	for i, s := range systemd.sockets {
+		if name != "" && s.name != name {
+			continue
+		}
+
+		systemd.sockets = append(systemd.sockets[:i], systemd.sockets[i+1:]...)
+		defer s.file.Close()
+
+		return net.FileListener(s.file)
+	}
+
+	return nil, fmt.Errorf("%w: %q", errNoSystemdSocket, name)
+}
+
+// systemdSockets returns the sockets passed to the process, the file descriptors start from firstFD
+func systemdSockets(getenv func(string) string, firstFD int) ([]systemdSocket, error) {
+	if getenv(envListenPID) != strconv.Itoa(os.Getpid()) {
+		return nil, fmt.Errorf("%w: %s is not the process id", errNoSystemdSocket, envListenPID)
+	}
+
+	n, err := strconv.Atoi(getenv(envListenFDs))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("%w: invalid %s %q", errNoSystemdSocket, envListenFDs, getenv(envListenFDs))
+	}
+
+	var names []string
+	if v := getenv(envListenFDNames); v != "" {
+		names = strings.Split(v, ":")
+	}
+
+	sockets := make([]systemdSocket, n)
+	for i := range sockets {
+		sockets[i].name = "unknown" // sd_listen_fds_with_names(3)
+		if i < len(names) {
+			sockets[i].name = names[i]
+		}
+		sockets[i].file = os.NewFile(uintptr(firstFD+i), sockets[i].name)
+	}
+
+	return sockets, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_listen_unix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxyme.sock")
+
+	// the socket file left by the killed process
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	ls, err := listen(context.Background(), listenerConfig{Listen: listenUnix + path, Socket: socketConfig{Mode: "0600"}})
+	if err != nil {
+		t.Fatalf("listen() error = %v", err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0o600 {
+		t.Errorf("socket file mode = %s, want socket 0600", fi.Mode())
+	}
+
+	// the private directory the socket is created in is removed
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("socket directory has %d entries, want the socket only", len(entries))
+	}
+
+	_ = ls.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file is not removed on close: %v", err)
+	}
+}
+
+func Test_listen_unixInUse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxyme.sock")
+
+	// the socket of running process
+	running, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer running.Close()
+
+	if ls, err := listen(context.Background(), listenerConfig{Listen: listenUnix + path}); err == nil {
+		_ = ls.Close()
+		t.Fatal("listen() error = nil, want the socket in use")
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("the socket of running process is removed: %v", err)
+	}
+	_ = conn.Close()
+}
+
+func Test_server_ListenAndServeListener_unix(t *testing.T) {
+	echo := startEchoServer(t)
+	path := filepath.Join(t.TempDir(), "proxyme.sock")
+
+	cfg := defaultConfig()
+	cfg.NoAuth = true
+	cfg.Egress.Enable = false
+	cfg.Clients.Allow = []string{"192.0.2.0/24"} // doesn't apply to unix socket clients
+	cfg.Listeners = []listenerConfig{{Name: "sidecar", Listen: listenUnix + path}}
+
+	srv := new(server)
+	if err := srv.reload(cfg); err != nil {
+		t.Fatalf("reload() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan any)
+	go func() {
+		_ = srv.ListenAndServeListener(ctx, cfg.Listeners[0])
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	for i := 0; i < 100 && conn == nil; i++ {
+		if conn, err = net.Dial("unix", path); err != nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if conn == nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	request := append([]byte{socks4Version, cmdConnect, byte(echo >> 8), byte(echo), 0, 0, 0, 1}, "\x00localhost\x00"...)
+	if reply := exchange(t, conn, request, socks4ReplySize); reply[1] != socks4Granted {
+		t.Fatalf("reply = %v", reply)
+	}
+	if got := exchange(t, conn, []byte("ping"), 4); string(got) != "ping" {
+		t.Errorf("relayed %q", got)
+	}
+}
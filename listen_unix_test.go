@@ -0,0 +1,92 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func Test_systemdSockets(t *testing.T) {
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close()
+
+	// the duplicated descriptor of the listener is passed as the socket, it's owned by the passed file
+	f, err := ls.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Dup(int(f.Fd()))
+	_ = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{
+		envListenPID:     strconv.Itoa(os.Getpid()),
+		envListenFDs:     "1",
+		envListenFDNames: "proxyme.socket",
+	}
+	getenv := func(key string) string { return env[key] }
+
+	sockets, err := systemdSockets(getenv, fd)
+	if err != nil {
+		t.Fatalf("systemdSockets() error = %v", err)
+	}
+	if len(sockets) != 1 || sockets[0].name != "proxyme.socket" {
+		t.Fatalf("systemdSockets() = %v, want proxyme.socket", sockets)
+	}
+
+	inherited, err := net.FileListener(sockets[0].file)
+	_ = sockets[0].file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inherited.Close()
+
+	if inherited.Addr().String() != ls.Addr().String() {
+		t.Errorf("inherited listener %s, want %s", inherited.Addr(), ls.Addr())
+	}
+
+	env[envListenPID] = "1"
+	if _, err := systemdSockets(getenv, fd); !errors.Is(err, errNoSystemdSocket) {
+		t.Errorf("systemdSockets(other pid) error = %v, want %v", err, errNoSystemdSocket)
+	}
+}
+
+func Test_clientAddr_unix(t *testing.T) {
+	ls, err := net.Listen("unix", filepath.Join(t.TempDir(), "proxyme.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close()
+
+	client, err := net.Dial("unix", ls.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := ls.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	want := unixPeer{uid: os.Getuid()}
+	if runtime.GOOS != "linux" {
+		want.uid = -1
+	}
+	if got := clientAddr(conn); got != want {
+		t.Errorf("clientAddr() = %v, want %v", got, want)
+	}
+}
@@ -6,16 +6,15 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
 	"strconv"
+	"sync"
 	"syscall"
-	"time"
-
-	"github.com/dblokhin/proxyme"
 )
 
 const (
@@ -24,14 +23,29 @@ const (
 	envBindIP        = "PROXY_BIND_IP"       // ipv4/ipv6 address to make BIND socks5 operations
 	envNoAuth        = "PROXY_NOAUTH"        // yes, true, 1
 	envUsers         = "PROXY_USERS"         // user:pass,user2:pass2
+	envUsersFile     = "PROXY_USERS_FILE"    // path to htpasswd file (bcrypt, argon2id)
+	envKeytab        = "PROXY_KEYTAB"        // path to kerberos keytab file, enables GSSAPI auth method
+	envAccessLog     = "PROXY_ACCESS_LOG"    // access log output: stdout, stderr, file path, syslog
 	envMetricsListen = "METRICS_LISTEN_ADDR" // TCP address for the server to listen on in the form "host:port"
+	envHTTPListen    = "PROXY_HTTP_LISTEN"   // TCP address of http proxy "host:port", empty means disabled
+	envTLSCert       = "PROXY_TLS_CERT"      // path to tls certificate file, enables tls of the main listener
+	envTLSKey        = "PROXY_TLS_KEY"       // path to tls private key file
+	envConfig        = "PROXY_CONFIG"        // path to the config file
 )
 
 func main() {
+	cfg, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	ctx, _ := signal.NotifyContext(context.TODO(), syscall.SIGTERM, syscall.SIGINT)
 
-	addr := os.Getenv(envMetricsListen)
-	ms := runMetrics(addr)
+	bruteForce := newBruteForceGuard()
+	ms := runMetrics(cfg.Metrics, bruteForce)
 
 	go func() {
 		<-ctx.Done()
@@ -42,79 +56,103 @@ func main() {
 		}
 	}()
 
-	if err := runMain(ctx); err != nil {
+	if err := runMain(ctx, cfg, bruteForce); err != nil {
 		log.Fatal(err)
 	}
 }
 
 // runMain returns error for os.Exit(1)
-func runMain(ctx context.Context) error {
-	opts, err := parseOptions()
+func runMain(ctx context.Context, cfg config, bruteForce *bruteForceGuard) error {
+	accessLog, err := newAccessLog(cfg.AccessLog)
 	if err != nil {
-		return fmt.Errorf("parse options: %w", err)
+		return err
 	}
+	defer accessLog.Close()
 
-	socks5, err := proxyme.New(opts)
-	if err != nil {
-		return fmt.Errorf("init socks5 protocol: %w", err)
+	srv := &server{accessLog: accessLog, bruteForce: bruteForce}
+	if err := srv.reload(cfg); err != nil {
+		return err
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go reloadOnSignal(ctx, srv, hup)
+
+	// the other listeners are stopped if the main one fails
+	ctx, cancel := context.WithCancel(ctx)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	// start http proxy
+	if listen := cfg.HTTP.Listen; listen != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			log.Println("starting http proxy on", listen)
+			if err := srv.ListenAndServeHTTP(ctx, listen); err != nil {
+				log.Println(err)
+			}
+		}()
 	}
 
-	srv := server{socks5}
-	host := os.Getenv(envHost)
-	port := getPort()
-	addr := net.JoinHostPort(host, port)
+	// start the listeners with own settings
+	for _, l := range cfg.Listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			log.Printf("starting listener %s on %s", l.name(), l.Listen)
+			if err := srv.ListenAndServeListener(ctx, l); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+
+	// the main listener is disabled, the others serve until shutdown
+	if cfg.Port == 0 {
+		<-ctx.Done()
+		return nil
+	}
+
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
 
 	// start socks5 proxy
 	log.Println("starting on", addr)
-	if err := srv.ListenAndServe(ctx, addr); err != nil {
-		log.Println(err)
+	if err := srv.listenAndServe(ctx, listenerConfig{Listen: addr, Protocol: cfg.Protocol}, &srv.settings); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("listen %s: %w", addr, err)
 	}
 
 	return nil
 }
 
-// customConnect connects to remote server using dns resolver with lru cache
-func customConnect(addressType int, addr []byte, port int) (net.Conn, error) {
-	const (
-		maxConnTime = 10 * time.Second
-		domainType  = 3
-	)
-
-	ctx, cancel := context.WithTimeout(context.TODO(), maxConnTime)
-	defer cancel()
+// reloadOnSignal re-reads configuration on every signal and applies it to the new sessions,
+// the sessions in progress keep running with the old settings.
+// Listen addresses, metrics server and access log output are not reloadable, they require restart.
+func reloadOnSignal(ctx context.Context, srv *server, sig chan os.Signal) {
+	defer signal.Stop(sig)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sig:
+		}
 
-	// get the ip addr
-	ip := net.IP(addr)
-	if addressType == domainType {
-		dip, err := defaultDomainResolver(ctx, addr)
+		cfg, err := loadConfig(os.Args[1:])
 		if err != nil {
-			return nil, fmt.Errorf("%w: %v", proxyme.ErrHostUnreachable, err)
+			log.Println("reload config:", err)
+			continue
 		}
 
-		ip = dip
-	}
-
-	dialAddr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
-
-	d := net.Dialer{}
-	conn, err := d.DialContext(ctx, "tcp", dialAddr)
-	if err != nil {
-		if errors.Is(err, syscall.EHOSTUNREACH) {
-			return conn, fmt.Errorf("%w: %v", proxyme.ErrHostUnreachable, err)
-		}
-		if errors.Is(err, syscall.ECONNREFUSED) {
-			return conn, fmt.Errorf("%w: %v", proxyme.ErrConnectionRefused, err)
-		}
-		if errors.Is(err, syscall.ENETUNREACH) {
-			return conn, fmt.Errorf("%w: %v", proxyme.ErrNetworkUnreachable, err)
-		}
-		if errors.Is(err, os.ErrDeadlineExceeded) {
-			return conn, fmt.Errorf("%w: %v", proxyme.ErrTTLExpired, err)
+		if err := srv.reload(cfg); err != nil {
+			log.Println("reload config:", err)
+			continue
 		}
-		return conn, err
-	}
-
-	_ = conn.(*net.TCPConn).SetLinger(0) // nolint
+		closeUnusedDBs(cfg)
 
-	return conn, nil
+		log.Println("config reloaded")
+	}
 }
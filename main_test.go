@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_runMain_listenError(t *testing.T) {
+	// the port of the main listener is in use
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close()
+
+	cfg := defaultConfig()
+	cfg.NoAuth = true
+	cfg.Host = "127.0.0.1"
+	cfg.Port = ls.Addr().(*net.TCPAddr).Port
+	cfg.Listeners = []listenerConfig{{Name: "internal", Listen: "127.0.0.1:0"}}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- runMain(context.Background(), cfg, nil)
+	}()
+
+	select {
+	case err := <-done:
+		if want := "listen 127.0.0.1:" + strconv.Itoa(cfg.Port); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("runMain() error = %v, want %q", err, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("runMain() keeps running without the main listener")
+	}
+}
+
+func Test_runMain_mainListenerDisabled(t *testing.T) {
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ls.Addr().String()
+	_ = ls.Close()
+
+	cfg := defaultConfig()
+	cfg.NoAuth = true
+	cfg.Port = 0
+	cfg.Listeners = []listenerConfig{{Name: "internal", Listen: addr}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- runMain(ctx, cfg, nil)
+	}()
+
+	// the listener serves until shutdown
+	var conn net.Conn
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+
+	select {
+	case err := <-done:
+		t.Fatalf("runMain() returned %v before shutdown", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("runMain() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("runMain() is not stopped")
+	}
+}
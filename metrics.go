@@ -2,27 +2,371 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
 	"log"
+	"net"
 	"net/http"
+	"sync"
 	"time"
 
+	"github.com/dblokhin/proxyme"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+var aclDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "proxyme_acl_decisions_total",
+	Help: "The number of destination access decisions by action and matched rule.",
+}, []string{"action", "rule"})
+
+var (
+	connectionsAccepted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proxyme_connections_accepted_total",
+		Help: "The number of accepted client connections.",
+	})
+	connectionsActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "proxyme_connections_active",
+		Help: "The number of client connections being served.",
+	})
+	handshakes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxyme_handshakes_total",
+		Help: "The number of finished client sessions by auth method and authentication result.",
+	}, []string{"method", "result"})
+	connectDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "proxyme_connect_duration_seconds",
+		Help:    "The time of successful connection to the remote host including dns resolution.",
+		Buckets: prometheus.DefBuckets,
+	})
+	dialErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxyme_dial_errors_total",
+		Help: "The number of failed connections to the remote hosts by error class.",
+	}, []string{"class"})
+	dnsCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxyme_dns_cache_lookups_total",
+		Help: "The number of dns cache lookups by result: hit, miss or stale.",
+	}, []string{"result"})
+	dnsOverridesResolved = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxyme_dns_overrides_total",
+		Help: "The number of domains resolved by static hosts or rewrite rules by rule.",
+	}, []string{"rule"})
+	sessionsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxyme_sessions_rejected_total",
+		Help: "The number of rejected sessions by reason: total, per_ip, per_user, accept_rate or client_denied.",
+	}, []string{"reason"})
+	authFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxyme_auth_failures_total",
+		Help: "The number of failed username/password authentication attempts tracked by brute force protection.",
+	}, nil)
+	authBans = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxyme_auth_bans_total",
+		Help: "The number of bans by brute force protection by kind: ip or user.",
+	}, []string{"kind"})
+	dialAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxyme_dial_attempts_total",
+		Help: "The number of finished connection attempts to the remote addresses by family and result: success or failure.",
+	}, []string{"family", "result"})
+	upstreamDials = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxyme_upstream_dials_total",
+		Help: "The number of connections through the parent proxies by upstream, parent and result: success or failure.",
+	}, []string{"upstream", "parent", "result"})
+	tlsHandshakes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxyme_tls_handshakes_total",
+		Help: "The number of tls handshakes of the clients by result: success or failure.",
+	}, []string{"result"})
+	bandwidthThrottled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxyme_bandwidth_throttled_seconds_total",
+		Help: "The time the sessions are delayed by bandwidth limits by direction: upload or download.",
+	}, []string{"direction"})
+)
+
+// traffic is bytes transferred by the clients, see trafficCollector
+var traffic = newTrafficCollector()
+
+func init() {
+	prometheus.MustRegister(traffic)
+}
+
+// countACLDecision counts access decision made by acl rule
+func countACLDecision(allow bool, rule string) {
+	action := aclDeny
+	if allow {
+		action = aclAllow
+	}
+
+	aclDecisions.WithLabelValues(action, rule).Inc()
+}
+
+// trackSession counts the session as active connection, returned func is called when the session is finished
+func trackSession(sess *session) func() {
+	connectionsActive.Inc()
+	traffic.add(sess)
+
+	return func() {
+		connectionsActive.Dec()
+		traffic.remove(sess)
+		countHandshake(sess)
+	}
+}
+
+// countHandshake counts auth method and authentication result of finished session
+func countHandshake(sess *session) {
+	method, auth := sess.handshake()
+
+	name := "unknown"
+	switch method {
+	case -1:
+		name = "none_selected"
+	case authNone:
+		name = "none"
+	case authGSSAPI:
+		name = "gssapi"
+	case authPassword:
+		name = "password"
+	case authNoAcceptable:
+		name = "no_acceptable"
+	}
+
+	result := "incomplete"
+	switch auth {
+	case authSucceeded:
+		result = "success"
+	case authFailed:
+		result = "failure"
+	}
+
+	handshakes.WithLabelValues(name, result).Inc()
+}
+
+// countDialError counts failed connection to the remote host, the denied ones are counted by acl metrics
+func countDialError(err error) {
+	class := "other"
+	switch {
+	case errors.Is(err, proxyme.ErrNotAllowed):
+		return
+	case errors.Is(err, proxyme.ErrHostUnreachable):
+		class = "host_unreachable"
+	case errors.Is(err, proxyme.ErrConnectionRefused):
+		class = "connection_refused"
+	case errors.Is(err, proxyme.ErrNetworkUnreachable):
+		class = "network_unreachable"
+	case errors.Is(err, proxyme.ErrTTLExpired):
+		class = "ttl_expired"
+	}
+
+	dialErrors.WithLabelValues(class).Inc()
+}
+
+// countDNSCacheLookup counts dns cache hit, miss or stale entry served
+func countDNSCacheLookup(result string) {
+	dnsCacheLookups.WithLabelValues(result).Inc()
+}
+
+// countDNSOverride counts the domain resolved by static hosts or rewrite rule
+func countDNSOverride(rule string) {
+	dnsOverridesResolved.WithLabelValues(rule).Inc()
+}
+
+// countTLSHandshake counts finished tls handshake of the client
+func countTLSHandshake(ok bool) {
+	result := "failure"
+	if ok {
+		result = "success"
+	}
+
+	tlsHandshakes.WithLabelValues(result).Inc()
+}
+
+// countRejectedSession counts the session rejected by the limits
+func countRejectedSession(reason string) {
+	sessionsRejected.WithLabelValues(reason).Inc()
+}
+
+// countAuthFailure counts failed authentication attempt
+func countAuthFailure() {
+	authFailures.WithLabelValues().Inc()
+}
+
+// countAuthBan counts ban of ip or username
+func countAuthBan(kind string) {
+	authBans.WithLabelValues(kind).Inc()
+}
+
+// countThrottled counts the time of the session delayed by bandwidth limits
+func countThrottled(dir int, delay time.Duration) {
+	direction := "upload"
+	if dir == download {
+		direction = "download"
+	}
+
+	bandwidthThrottled.WithLabelValues(direction).Add(delay.Seconds())
+}
+
+// countDialAttempt counts connection attempt to the remote address, the ones lost the race are not counted
+func countDialAttempt(ip net.IP, ok bool) {
+	family := "ipv6"
+	if ip.To4() != nil {
+		family = "ipv4"
+	}
+
+	result := "failure"
+	if ok {
+		result = "success"
+	}
+
+	dialAttempts.WithLabelValues(family, result).Inc()
+}
+
+// countUpstreamDial counts connection through the parent proxy
+func countUpstreamDial(upstream, parent string, ok bool) {
+	result := "failure"
+	if ok {
+		result = "success"
+	}
+
+	upstreamDials.WithLabelValues(upstream, parent, result).Inc()
+}
+
+// otherUsers is the user label of the users exceeding the limit of trafficCollector
+const otherUsers = "_other"
+
+// trafficCollector exposes bytes transferred by the clients per direction. The counters of the active
+// sessions are read at scrape time, so long-living sessions are seen without waiting for them to finish.
+// The sessions are labelled by user if it's enabled, the number of distinct user labels is limited,
+// the rest of the users share otherUsers label.
+type trafficCollector struct {
+	desc *prometheus.Desc
+
+	mu       sync.Mutex
+	maxUsers int                    // max number of distinct user labels, 0 disables user label
+	users    map[string]struct{}    // users having own label
+	active   map[*session]*string   // active sessions and their user label, nil until the request is received
+	finished map[string]*[2]float64 // bytes of finished sessions by user label: upload, download
+}
+
+func newTrafficCollector() *trafficCollector {
+	return &trafficCollector{
+		desc: prometheus.NewDesc("proxyme_bytes_total",
+			"The number of bytes transferred by the clients by direction: upload to or download from the remote hosts.",
+			[]string{"direction", "user"}, nil),
+		users:    make(map[string]struct{}),
+		active:   make(map[*session]*string),
+		finished: make(map[string]*[2]float64),
+	}
+}
+
+// setMaxUsers enables user label limited by max distinct users, 0 disables it
+func (t *trafficCollector) setMaxUsers(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.maxUsers = n
+}
+
+func (t *trafficCollector) add(sess *session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.active[sess] = nil
+}
+
+func (t *trafficCollector) remove(sess *session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	label := t.active[sess]
+	if label == nil {
+		label = t.label(sess)
+	}
+	delete(t.active, sess)
+
+	t.addBytes(t.finished, *label, sess)
+}
+
+// label returns user label of the session. It's assigned once the request is received:
+// the user doesn't change after that, and the session counters keep growing under the same label.
+// must be called with lock held
+func (t *trafficCollector) label(sess *session) *string {
+	user := sess.username()
+
+	switch {
+	case t.maxUsers == 0, user == "":
+		user = ""
+	case len(t.users) < t.maxUsers:
+		t.users[user] = struct{}{}
+	default:
+		if _, ok := t.users[user]; !ok {
+			user = otherUsers
+		}
+	}
+
+	return &user
+}
+
+// addBytes adds session bytes to the totals of user label
+func (t *trafficCollector) addBytes(totals map[string]*[2]float64, label string, sess *session) {
+	v, ok := totals[label]
+	if !ok {
+		v = new([2]float64)
+		totals[label] = v
+	}
+
+	v[0] += float64(sess.bytesIn.Load())
+	v[1] += float64(sess.bytesOut.Load())
+}
+
+func (t *trafficCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- t.desc
+}
+
+func (t *trafficCollector) Collect(ch chan<- prometheus.Metric) {
+	t.mu.Lock()
+
+	totals := make(map[string]*[2]float64, len(t.finished))
+	for label, v := range t.finished {
+		totals[label] = &[2]float64{v[0], v[1]}
+	}
+
+	// the sessions are counted once the handshake is passed, the handshake bytes are counted
+	// when the session is finished
+	for sess, label := range t.active {
+		if label == nil {
+			if sess.command() == 0 {
+				continue
+			}
+			label = t.label(sess)
+			t.active[sess] = label
+		}
+		t.addBytes(totals, *label, sess)
+	}
+
+	t.mu.Unlock()
+
+	for label, v := range totals {
+		ch <- prometheus.MustNewConstMetric(t.desc, prometheus.CounterValue, v[0], "upload", label)
+		ch <- prometheus.MustNewConstMetric(t.desc, prometheus.CounterValue, v[1], "download", label)
+	}
+}
+
 // runMetricsServers exposes metric server at /metrics endpoint
 // using `METRICS_LISTEN_ADDR` (if it is not specified, metrics server is
-// disabled)
-func runMetrics(addr string) *http.Server {
-	if len(addr) == 0 {
+// disabled). The bans of brute force protection are served at /bans endpoint
+// to the requests with admin token, the endpoint is disabled if the token is empty.
+func runMetrics(cfg metricsConfig, bans http.Handler) *http.Server {
+	if len(cfg.Listen) == 0 {
 		return nil
 	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
+	if cfg.AdminToken != "" {
+		mux.Handle("/bans", requireToken(cfg.AdminToken, bans))
+	}
 
 	const maxTimeout = 3 * time.Second
 	srv := &http.Server{
-		Addr:              addr,
+		Addr:              cfg.Listen,
 		Handler:           mux,
 		ReadTimeout:       maxTimeout,
 		ReadHeaderTimeout: maxTimeout,
@@ -50,3 +394,18 @@ func stopMetrics(srv *http.Server) error {
 
 	return srv.Shutdown(ctx)
 }
+
+// requireToken passes the requests with the bearer token to the handler, the others are unauthorized
+func requireToken(token string, next http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dblokhin/proxyme"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// gatherTraffic returns bytes_total values by "direction user" key
+func gatherTraffic(t *testing.T, c *trafficCollector) map[string]float64 {
+	t.Helper()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := make(map[string]float64)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			var direction, user string
+			for _, l := range m.GetLabel() {
+				switch l.GetName() {
+				case "direction":
+					direction = l.GetValue()
+				case "user":
+					user = l.GetValue()
+				}
+			}
+			res[direction+" "+user] = m.GetCounter().GetValue()
+		}
+	}
+
+	return res
+}
+
+// newTrafficSession returns session of the user passed the handshake
+func newTrafficSession(user string, in, out int64) *session {
+	sess := newSession(nil)
+	sess.setUser(user)
+	sess.setRequest(socks5Request{cmd: cmdConnect})
+	sess.bytesIn.Add(in)
+	sess.bytesOut.Add(out)
+
+	return sess
+}
+
+func Test_trafficCollector(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxUsers int
+		users    []string
+		want     map[string]float64
+	}{
+		{
+			name:  "user label disabled",
+			users: []string{"alice", "bob", ""},
+			want:  map[string]float64{"upload ": 30, "download ": 300},
+		},
+		{
+			name:     "users over the limit",
+			maxUsers: 2,
+			users:    []string{"alice", "bob", "carol", "alice", "dave", ""},
+			want: map[string]float64{
+				"upload alice": 20, "download alice": 200,
+				"upload bob": 10, "download bob": 100,
+				"upload " + otherUsers: 20, "download " + otherUsers: 200,
+				"upload ": 10, "download ": 100,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTrafficCollector()
+			c.setMaxUsers(tt.maxUsers)
+
+			for _, user := range tt.users {
+				sess := newTrafficSession(user, 10, 100)
+				c.add(sess)
+				c.remove(sess)
+			}
+
+			got := gatherTraffic(t, c)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("bytes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_trafficCollector_activeSessions(t *testing.T) {
+	c := newTrafficCollector()
+	c.setMaxUsers(10)
+
+	handshake := newSession(nil)
+	handshake.bytesIn.Add(5)
+	c.add(handshake)
+
+	sess := newTrafficSession("alice", 10, 100)
+	c.add(sess)
+
+	// the sessions in handshake are not seen until finished
+	if got := gatherTraffic(t, c); got["upload alice"] != 10 || got["upload "] != 0 {
+		t.Fatalf("bytes = %v", got)
+	}
+
+	// the session keeps its label and counters grow monotonically
+	sess.bytesIn.Add(10)
+	sess.setUser("bob")
+	if got := gatherTraffic(t, c); got["upload alice"] != 20 || got["upload bob"] != 0 {
+		t.Fatalf("bytes = %v", got)
+	}
+
+	c.remove(sess)
+	c.remove(handshake)
+	if got := gatherTraffic(t, c); got["upload alice"] != 20 || got["upload "] != 5 {
+		t.Fatalf("bytes = %v", got)
+	}
+}
+
+func Test_server_reload_userLabels(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.NoAuth = true
+	cfg.Metrics.UserLabels = 5
+
+	srv := new(server)
+	if err := srv.reload(cfg); err != nil {
+		t.Fatalf("reload() error = %v", err)
+	}
+	t.Cleanup(func() { traffic.setMaxUsers(0) })
+
+	traffic.mu.Lock()
+	defer traffic.mu.Unlock()
+
+	if traffic.maxUsers != 5 {
+		t.Errorf("max users = %d, want 5", traffic.maxUsers)
+	}
+}
+
+func Test_countHandshake(t *testing.T) {
+	tests := []struct {
+		name       string
+		setup      func(sess *session)
+		wantMethod string
+		wantResult string
+	}{
+		{
+			name:       "greeting only",
+			setup:      func(sess *session) {},
+			wantMethod: "none_selected",
+			wantResult: "incomplete",
+		},
+		{
+			name:       "no auth",
+			setup:      func(sess *session) { sess.setMethod(authNone) },
+			wantMethod: "none",
+			wantResult: "success",
+		},
+		{
+			name:       "no acceptable methods",
+			setup:      func(sess *session) { sess.setMethod(authNoAcceptable) },
+			wantMethod: "no_acceptable",
+			wantResult: "failure",
+		},
+		{
+			name: "wrong password",
+			setup: func(sess *session) {
+				sess.setMethod(authPassword)
+				sess.setAuthenticated(false)
+			},
+			wantMethod: "password",
+			wantResult: "failure",
+		},
+		{
+			name:       "gssapi in progress",
+			setup:      func(sess *session) { sess.setMethod(authGSSAPI) },
+			wantMethod: "gssapi",
+			wantResult: "incomplete",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter := handshakes.WithLabelValues(tt.wantMethod, tt.wantResult)
+			before := testutil.ToFloat64(counter)
+
+			sess := newSession(nil)
+			tt.setup(sess)
+			countHandshake(sess)
+
+			if got := testutil.ToFloat64(counter) - before; got != 1 {
+				t.Errorf("handshakes{%s, %s} increased by %v, want 1", tt.wantMethod, tt.wantResult, got)
+			}
+		})
+	}
+}
+
+func Test_countDialError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{err: fmt.Errorf("%w: no such host", proxyme.ErrHostUnreachable), want: "host_unreachable"},
+		{err: fmt.Errorf("%w: refused", proxyme.ErrConnectionRefused), want: "connection_refused"},
+		{err: fmt.Errorf("%w: no route", proxyme.ErrNetworkUnreachable), want: "network_unreachable"},
+		{err: fmt.Errorf("%w: timeout", proxyme.ErrTTLExpired), want: "ttl_expired"},
+		{err: errors.New("unknown"), want: "other"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			counter := dialErrors.WithLabelValues(tt.want)
+			before := testutil.ToFloat64(counter)
+
+			countDialError(tt.err)
+
+			if got := testutil.ToFloat64(counter) - before; got != 1 {
+				t.Errorf("dial errors{%s} increased by %v, want 1", tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_requireToken(t *testing.T) {
+	h := requireToken("secret", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{name: "valid token", header: "Bearer secret", want: http.StatusNoContent},
+		{name: "invalid token", header: "Bearer guess", want: http.StatusUnauthorized},
+		{name: "no token", want: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodDelete, "/bans", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
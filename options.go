@@ -1,53 +1,70 @@
 package main
 
 import (
-	"fmt"
 	"net"
-	"os"
-	"slices"
-	"strings"
 
 	"github.com/dblokhin/proxyme"
 )
 
-func getPort() string {
-	const defaultPort = "1080"
+func parseOptions(cfg config) (proxyme.Options, error) {
+	// enable username/password authenticate method if given
+	users, err := newUAM(cfg.Users)
+	if err != nil {
+		return proxyme.Options{}, err
+	}
 
-	if p := os.Getenv(envPort); p != "" {
-		return p
+	var chain authChain
+	if users.len() > 0 {
+		chain = append(chain, users)
 	}
-	return defaultPort
-}
 
-func parseOptions() (proxyme.Options, error) {
-	// enable noauth authenticate method if given
-	noauth := slices.Contains([]string{"yes", "true", "1"}, strings.ToLower(os.Getenv(envNoAuth)))
+	// users from htpasswd file
+	if cfg.UsersFile != "" {
+		file, err := newUserFile(cfg.UsersFile)
+		if err != nil {
+			return proxyme.Options{}, err
+		}
+		chain = append(chain, file)
+	}
 
-	// enable username/password authenticate method if given
-	users, err := newUAM(os.Getenv(envUsers))
-	if err != nil {
-		return proxyme.Options{}, err
+	// external auth backends
+	for _, backend := range cfg.Auth {
+		a, err := newAuthBackend(backend)
+		if err != nil {
+			return proxyme.Options{}, err
+		}
+		chain = append(chain, a)
 	}
 
 	var authenticate func(username, password []byte) error
-	if users.len() > 0 {
-		authenticate = users.authenticate
+	if len(chain) > 0 {
+		authenticate = chain.authenticate
 	}
 
 	// enable BIND operation if given
 	var customListen func() (net.Listener, error)
-	if bind := os.Getenv(envBindIP); bind != "" {
+	if bind := cfg.BindIP; bind != "" {
 		customListen = func() (net.Listener, error) {
-			return net.Listen("tcp", fmt.Sprintf("%s:0", bind))
+			return net.Listen("tcp", net.JoinHostPort(bind, "0"))
+		}
+	}
+
+	// enable gssapi authenticate method if keytab is given
+	var gss func() (proxyme.GSSAPI, error)
+	if cfg.GSSAPI.Keytab != "" {
+		krb, err := newKerberos(cfg.GSSAPI)
+		if err != nil {
+			return proxyme.Options{}, err
 		}
+		gss = krb.newContext
 	}
 
-	// todo enable gssapi authenticate method if given
+	// Connect is bound to the session, see settings.newProtocol
 	opts := proxyme.Options{
-		AllowNoAuth:  noauth,
+		AllowNoAuth:  cfg.NoAuth,
 		Authenticate: authenticate,
-		GSSAPI:       nil,
-		Connect:      customConnect,
+		GSSAPI:       gss,
+		Connect:      nil,
 		Listen:       customListen,
 	}
 
@@ -3,51 +3,9 @@ package main
 import (
 	"os"
 	"testing"
-)
-
-func Test_getPort(t *testing.T) {
-	tests := []struct {
-		name    string
-		envPort string
-		want    string
-	}{
-		{
-			name:    "empty",
-			envPort: "",
-			want:    "1080",
-		},
-		{
-			name:    "common case",
-			envPort: "9999",
-			want:    "9999",
-		},
-	}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			// Save old value (if any)
-			oldValue, hadValue := os.LookupEnv(envPort)
-			// Set or unset PORT env
-			if tt.envPort == "" {
-				os.Unsetenv(envPort)
-			} else {
-				os.Setenv(envPort, tt.envPort)
-			}
-
-			got := getPort()
-			if got != tt.want {
-				t.Fatalf("getPort() = %q, want %q", got, tt.want)
-			}
-
-			// Restore old value
-			if hadValue {
-				os.Setenv(envPort, oldValue)
-			} else {
-				os.Unsetenv(envPort)
-			}
-		})
-	}
-}
+	"github.com/dblokhin/proxyme"
+)
 
 func Test_parseOptions(t *testing.T) {
 	tests := []struct {
@@ -138,7 +96,11 @@ func Test_parseOptions(t *testing.T) {
 				os.Setenv(envBindIP, tt.bindIPEnv)
 			}
 
-			opts, err := parseOptions()
+			var opts proxyme.Options
+			cfg, err := loadConfig(nil)
+			if err == nil {
+				opts, err = parseOptions(cfg)
+			}
 
 			if tt.wantErr && err == nil {
 				t.Fatalf("parseOptions() error = nil; wantErr = true")
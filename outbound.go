@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"math/rand"
+	"net"
+	"net/netip"
+	"slices"
+	"sync/atomic"
+
+	"github.com/dblokhin/proxyme"
+)
+
+// source address selection strategies
+const (
+	strategyRoundRobin = "round_robin"
+	strategyRandom     = "random"
+	strategySticky     = "sticky"
+)
+
+// outbound selects the source address of the connections to the destinations and parent proxies, and of UDP relay. The pool is chosen by
+// username, then by the listener address the client connected to, then the default one is used.
+// If no pool is chosen the system default source address is used.
+type outbound struct {
+	def       *sourcePool
+	users     map[string]*sourcePool
+	listeners map[string]*sourcePool // by local address "ip:port" or "ip"
+}
+
+// sourcePool is a set of local addresses or network interfaces the connections are made from
+type sourcePool struct {
+	name     string
+	strategy string
+	sources  []source
+	next     atomic.Uint64 // round robin counter
+}
+
+// source is local address or network interface, or both
+type source struct {
+	addr   netip.Addr // invalid for any address
+	device string     // network interface bound by SO_BINDTODEVICE, empty for any
+}
+
+// newOutbound creates source address selector by config, errors are prefixed by config key
+func newOutbound(cfg outboundConfig) (*outbound, error) {
+	var errs []error
+
+	o := &outbound{
+		users:     make(map[string]*sourcePool),
+		listeners: make(map[string]*sourcePool),
+	}
+
+	pools := make(map[string]*sourcePool)
+	for i, pc := range cfg.Pools {
+		key := fmt.Sprintf("outbound.pools[%d]", i)
+
+		pool, err := newSourcePool(pc)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s.%w", key, err))
+			continue
+		}
+
+		if _, ok := pools[pool.name]; ok {
+			errs = append(errs, fmt.Errorf("%s.name: duplicated pool %q", key, pool.name))
+		}
+		pools[pool.name] = pool
+	}
+
+	lookup := func(key, name string) *sourcePool {
+		pool, ok := pools[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown pool %q", key, name))
+		}
+		return pool
+	}
+
+	if cfg.Default != "" {
+		o.def = lookup("outbound.default", cfg.Default)
+	}
+	for _, user := range slices.Sorted(maps.Keys(cfg.Users)) {
+		o.users[user] = lookup("outbound.users."+user, cfg.Users[user])
+	}
+	for _, addr := range slices.Sorted(maps.Keys(cfg.Listeners)) {
+		key := "outbound.listeners." + addr
+
+		listener, err := parseListenerAddr(addr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+			continue
+		}
+		o.listeners[listener] = lookup(key, cfg.Listeners[addr])
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+func newSourcePool(cfg sourcePoolConfig) (*sourcePool, error) {
+	pool := &sourcePool{
+		name:     cfg.Name,
+		strategy: cfg.Strategy,
+	}
+
+	if pool.name == "" {
+		return nil, errors.New("name: must be specified")
+	}
+
+	switch pool.strategy {
+	case "":
+		pool.strategy = strategyRoundRobin
+	case strategyRoundRobin, strategyRandom, strategySticky:
+	default:
+		return nil, fmt.Errorf("strategy: must be round_robin, random or sticky, got %q", cfg.Strategy)
+	}
+
+	switch {
+	case len(cfg.Addresses) == 0 && len(cfg.Interfaces) == 0:
+		return nil, errors.New("addresses: addresses or interfaces must be specified")
+	case len(cfg.Addresses) > 0 && len(cfg.Interfaces) > 0:
+		return nil, errors.New("interfaces: addresses and interfaces are mutually exclusive")
+	case len(cfg.Interfaces) > 0 && !bindToDeviceSupported:
+		return nil, errors.New("interfaces: binding to interface is not supported on this platform")
+	}
+
+	for i, s := range cfg.Addresses {
+		addr, err := netip.ParseAddr(s)
+		if err != nil || addr.Zone() != "" {
+			return nil, fmt.Errorf("addresses[%d]: invalid ip address %q", i, s)
+		}
+		pool.sources = append(pool.sources, source{addr: addr.Unmap()})
+	}
+
+	for i, device := range cfg.Interfaces {
+		if device == "" {
+			return nil, fmt.Errorf("interfaces[%d]: must not be empty", i)
+		}
+		pool.sources = append(pool.sources, source{device: device})
+	}
+
+	return pool, nil
+}
+
+// parseListenerAddr normalizes listener address: "ip:port" or "ip"
+func parseListenerAddr(s string) (string, error) {
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()).String(), nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return "", fmt.Errorf("must be ip or ip:port, got %q", s)
+	}
+
+	return addr.Unmap().String(), nil
+}
+
+// pool returns the pool of the session, nil if the system default source address is used
+func (o *outbound) pool(sess *session) *sourcePool {
+	if o == nil {
+		return nil
+	}
+
+	if pool, ok := o.users[sess.username()]; ok {
+		return pool
+	}
+
+	if local := addrPortOf(sess.local); local.IsValid() {
+		if pool, ok := o.listeners[local.String()]; ok {
+			return pool
+		}
+		if pool, ok := o.listeners[local.Addr().String()]; ok {
+			return pool
+		}
+	}
+
+	return o.def
+}
+
+// dialer returns the dialer of the session connecting to ip address, nil ip is a host name of any family
+func (o *outbound) dialer(sess *session, ip net.IP) (*net.Dialer, error) {
+	pool := o.pool(sess)
+	if pool == nil {
+		return &net.Dialer{}, nil
+	}
+
+	src, err := pool.pick(sess, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	return src.dialer(), nil
+}
+
+// listenUDP opens the socket of UDP relay sending the datagrams of the session. The source is picked once
+// for the association, the datagrams of the other address family can't be sent from it.
+func (o *outbound) listenUDP(sess *session) (*net.UDPConn, error) {
+	pool := o.pool(sess)
+	if pool == nil {
+		return net.ListenUDP("udp", nil)
+	}
+
+	src, err := pool.pick(sess, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	lc := net.ListenConfig{}
+	if src.device != "" {
+		lc.Control = bindToDevice(src.device)
+	}
+
+	var addr string
+	if src.addr.IsValid() {
+		addr = netip.AddrPortFrom(src.addr, 0).String()
+	}
+
+	conn, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.(*net.UDPConn), nil
+}
+
+// pick selects the source of the address family of the destination ip, any source if ip is nil
+func (p *sourcePool) pick(sess *session, ip net.IP) (source, error) {
+	dst, ok := netip.AddrFromSlice(ip)
+	dst = dst.Unmap()
+
+	candidates := make([]source, 0, len(p.sources))
+	for _, src := range p.sources {
+		if !ok || !src.addr.IsValid() || src.addr.Is4() == dst.Is4() {
+			candidates = append(candidates, src)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return source{}, fmt.Errorf("%w: pool %s has no source address for %s", proxyme.ErrNetworkUnreachable, p.name, dst)
+	}
+
+	var i uint64
+	switch p.strategy {
+	case strategyRandom:
+		i = rand.Uint64() // nolint: gosec
+	case strategySticky:
+		// the same user, or the same client if it's anonymous, is always connected from the same source
+		key := sess.username()
+		if key == "" {
+			key = clientKey(sess.client)
+		}
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(key))
+		i = h.Sum64()
+	default:
+		i = p.next.Add(1) - 1
+	}
+
+	return candidates[i%uint64(len(candidates))], nil
+}
+
+func (s source) dialer() *net.Dialer {
+	d := &net.Dialer{}
+	if s.addr.IsValid() {
+		d.LocalAddr = &net.TCPAddr{IP: s.addr.AsSlice()}
+	}
+	if s.device != "" {
+		d.Control = bindToDevice(s.device)
+	}
+
+	return d
+}
@@ -0,0 +1,29 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// bindToDeviceSupported reports whether the connections can be bound to network interface
+const bindToDeviceSupported = true
+
+// bindToDevice returns dialer control function binding the socket to network interface, requires CAP_NET_RAW
+func bindToDevice(device string) func(network, address string, c syscall.RawConn) error {
+	return func(_, _ string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = syscall.BindToDevice(int(fd), device)
+		}); cerr != nil {
+			return cerr
+		}
+
+		if err != nil {
+			return fmt.Errorf("bind to interface %s: %w", device, err)
+		}
+
+		return nil
+	}
+}
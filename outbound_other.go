@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// bindToDeviceSupported reports whether the connections can be bound to network interface
+const bindToDeviceSupported = false
+
+func bindToDevice(string) func(network, address string, c syscall.RawConn) error {
+	return func(string, string, syscall.RawConn) error {
+		return errors.New("binding to interface is not supported on this platform")
+	}
+}
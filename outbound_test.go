@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/dblokhin/proxyme"
+)
+
+func Test_outbound_pool(t *testing.T) {
+	o, err := newOutbound(outboundConfig{
+		Default: "main",
+		Pools: []sourcePoolConfig{
+			{Name: "main", Addresses: []string{"203.0.113.10"}},
+			{Name: "premium", Addresses: []string{"203.0.113.20"}},
+			{Name: "eu", Addresses: []string{"203.0.113.30"}},
+			{Name: "eu-alt", Addresses: []string{"203.0.113.40"}},
+		},
+		Users:     map[string]string{"alice": "premium"},
+		Listeners: map[string]string{"192.0.2.1": "eu", "192.0.2.1:1081": "eu-alt"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		user  string
+		local net.Addr
+		want  string
+	}{
+		{name: "user", user: "alice", local: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1080}, want: "premium"},
+		{name: "listener ip", user: "bob", local: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1080}, want: "eu"},
+		{name: "listener ip and port", local: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1081}, want: "eu-alt"},
+		{name: "default", user: "bob", local: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1080}, want: "main"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sess := newSession(&net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 40000})
+			sess.local = tt.local
+			sess.setUser(tt.user)
+
+			if got := o.pool(sess); got == nil || got.name != tt.want {
+				t.Errorf("pool() = %v, want %s", got, tt.want)
+			}
+		})
+	}
+
+	var disabled *outbound
+	if pool := disabled.pool(newSession(nil)); pool != nil {
+		t.Errorf("pool() of disabled outbound = %v", pool)
+	}
+}
+
+func Test_sourcePool_pick(t *testing.T) {
+	var (
+		v4 = net.IPv4(93, 184, 216, 34)
+		v6 = net.ParseIP("2001:db8::1")
+	)
+
+	newPool := func(strategy string, addresses ...string) *sourcePool {
+		pool, err := newSourcePool(sourcePoolConfig{Name: "main", Addresses: addresses, Strategy: strategy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pool
+	}
+
+	sess := newSession(&net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 40000})
+
+	// round robin over the addresses of the destination family
+	pool := newPool("", "203.0.113.10", "2001:db8:1::10", "203.0.113.11")
+	var got []string
+	for i := 0; i < 3; i++ {
+		src, err := pool.pick(sess, v4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, src.addr.String())
+	}
+	if want := []string{"203.0.113.10", "203.0.113.11", "203.0.113.10"}; got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("round robin = %v, want %v", got, want)
+	}
+	if src, _ := pool.pick(sess, v6); src.addr != netip.MustParseAddr("2001:db8:1::10") {
+		t.Errorf("pick(ipv6) = %s", src.addr)
+	}
+
+	// no address of the family
+	if _, err := newPool("", "203.0.113.10").pick(sess, v6); !errors.Is(err, proxyme.ErrNetworkUnreachable) {
+		t.Errorf("pick() error = %v, want %v", err, proxyme.ErrNetworkUnreachable)
+	}
+
+	// the source of any family for host name
+	if _, err := newPool("", "2001:db8:1::10").pick(sess, nil); err != nil {
+		t.Errorf("pick(nil) error = %v", err)
+	}
+
+	// sticky by user
+	pool = newPool(strategySticky, "203.0.113.10", "203.0.113.11", "203.0.113.12", "203.0.113.13")
+	sess.setUser("alice")
+	first, _ := pool.pick(sess, v4)
+	for i := 0; i < 10; i++ {
+		if src, _ := pool.pick(sess, v4); src != first {
+			t.Fatalf("sticky pick() = %s, want %s", src.addr, first.addr)
+		}
+	}
+}
+
+func Test_outbound_listenUDP(t *testing.T) {
+	o, err := newOutbound(outboundConfig{
+		Default: "main",
+		Pools:   []sourcePoolConfig{{Name: "main", Addresses: []string{"127.0.0.1"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := o.listenUDP(newSession(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if got := addrPortOf(conn.LocalAddr()).Addr(); got != netip.MustParseAddr("127.0.0.1") {
+		t.Errorf("udp socket is bound to %s, want 127.0.0.1", got)
+	}
+}
+
+func Test_source_dialer(t *testing.T) {
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close()
+
+	src := source{addr: netip.MustParseAddr("127.0.0.2")}
+	conn, err := src.dialer().Dial("tcp", ls.Addr().String())
+	if err != nil {
+		t.Skipf("127.0.0.2 is not available: %v", err)
+	}
+	defer conn.Close()
+
+	server, err := ls.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	if got := addrPortOf(server.RemoteAddr()).Addr(); got != src.addr {
+		t.Errorf("connected from %s, want %s", got, src.addr)
+	}
+}
+
+func Test_newOutbound_errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     outboundConfig
+		wantErr string
+	}{
+		{
+			name:    "invalid address",
+			cfg:     outboundConfig{Pools: []sourcePoolConfig{{Name: "main", Addresses: []string{"eth0"}}}},
+			wantErr: `outbound.pools[0].addresses[0]: invalid ip address "eth0"`,
+		},
+		{
+			name:    "addresses and interfaces",
+			cfg:     outboundConfig{Pools: []sourcePoolConfig{{Name: "main", Addresses: []string{"203.0.113.10"}, Interfaces: []string{"eth0"}}}},
+			wantErr: "outbound.pools[0].interfaces: addresses and interfaces are mutually exclusive",
+		},
+		{
+			name:    "unknown strategy",
+			cfg:     outboundConfig{Pools: []sourcePoolConfig{{Name: "main", Addresses: []string{"203.0.113.10"}, Strategy: "hash"}}},
+			wantErr: "outbound.pools[0].strategy: must be round_robin, random or sticky",
+		},
+		{
+			name:    "invalid listener",
+			cfg:     outboundConfig{Pools: []sourcePoolConfig{{Name: "main", Addresses: []string{"203.0.113.10"}}}, Listeners: map[string]string{"localhost": "main"}},
+			wantErr: "outbound.listeners.localhost: must be ip or ip:port",
+		},
+		{
+			name:    "unknown default",
+			cfg:     outboundConfig{Default: "main"},
+			wantErr: `outbound.default: unknown pool "main"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newOutbound(tt.cfg)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("newOutbound() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerUID returns the user id of the process connected to the unix socket by SO_PEERCRED
+func peerUID(conn *net.UnixConn) (int, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+
+	var cred *syscall.Ucred
+	if cerr := rc.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); cerr != nil {
+		return -1, cerr
+	}
+
+	if err != nil {
+		return -1, err
+	}
+
+	return int(cred.Uid), nil
+}
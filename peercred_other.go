@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// peerUID returns the user id of the process connected to the unix socket
+func peerUID(*net.UnixConn) (int, error) {
+	return -1, errors.New("peer credentials are not supported on this platform")
+}
@@ -2,77 +2,210 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"math/rand"
 	"net"
+	"sync/atomic"
 	"time"
 
-	"github.com/hashicorp/golang-lru/v2/expirable"
+	lru "github.com/hashicorp/golang-lru/v2"
 	"golang.org/x/sync/singleflight"
 )
 
+// defaults, see dns section of config
 const (
-	dnsCacheSize = 3000 // todo: parametrize
-	dnsCacheTTL  = 24 * time.Hour
+	dnsCacheSize   = 3000
+	dnsCacheTTL    = time.Minute
+	dnsMinTTL      = 5 * time.Second
+	dnsMaxTTL      = time.Hour
+	dnsNegativeTTL = 30 * time.Second
+	dnsErrorTTL    = 5 * time.Second
 )
 
-var defaultResolver = resolver{
-	resolver: net.DefaultResolver,
-	sg:       new(singleflight.Group),
-	cache:    expirable.NewLRU[string, []net.IP](dnsCacheSize, nil, dnsCacheTTL),
+// ttlUnknown is the ttl of the addresses resolved by the system resolver
+const ttlUnknown time.Duration = -1
+
+// dnsRefreshTimeout is max time of background refresh of cached entry
+const dnsRefreshTimeout = 10 * time.Second
+
+// results of dns cache lookup
+const (
+	dnsCacheHit   = "hit"
+	dnsCacheMiss  = "miss"
+	dnsCacheStale = "stale"
+)
+
+// ttlResolver reports the ttl of resolved addresses, or the ttl of "not found" reply
+type ttlResolver interface {
+	lookupIPTTL(ctx context.Context, network, host string) ([]net.IP, time.Duration, error)
 }
 
 type resolver struct {
 	resolver interface {
 		LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
 	}
-	sg    *singleflight.Group
-	cache *expirable.LRU[string, []net.IP]
+	sg        *singleflight.Group
+	cache     *lru.Cache[string, *dnsEntry]
+	overrides *dnsOverrides // static hosts and rewrite rules, nil if disabled
+
+	ttl         time.Duration // ttl of the addresses if the resolver doesn't report it
+	minTTL      time.Duration
+	maxTTL      time.Duration // 0 means no limit
+	negativeTTL time.Duration // ttl of "not found" results, 0 disables caching
+	errorTTL    time.Duration // ttl of failed lookups, 0 disables caching
+	staleTTL    time.Duration // expired addresses are served while being refreshed within this time
+	prefetch    bool          // refresh the hot entries before expiry
 }
 
-// LookupIP resolves domain name
-func (r *resolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
-	key := network + host
+// dnsEntry is cached lookup result: the addresses or the error
+type dnsEntry struct {
+	ips        []net.IP
+	err        error
+	stored     time.Time
+	expires    time.Time
+	hits       atomic.Int32
+	refreshing atomic.Bool
+}
 
-	if ips, ok := r.cache.Get(key); ok {
-		return ips, nil
+// newResolver returns system resolver with lru cache
+func newResolver(cfg dnsConfig) *resolver {
+	cache, _ := lru.New[string, *dnsEntry](cfg.CacheSize)
+
+	return &resolver{
+		resolver:    net.DefaultResolver,
+		sg:          new(singleflight.Group),
+		cache:       cache,
+		ttl:         cfg.CacheTTL,
+		minTTL:      cfg.MinTTL,
+		maxTTL:      cfg.MaxTTL,
+		negativeTTL: cfg.NegativeTTL,
+		errorTTL:    cfg.ErrorTTL,
+		staleTTL:    cfg.StaleTTL,
+		prefetch:    cfg.Prefetch,
 	}
+}
 
-	res, err, _ := r.sg.Do(key, func() (interface{}, error) {
-		ips, err := r.resolver.LookupIP(ctx, network, host)
-		if err != nil {
-			return nil, err
+// LookupIP resolves domain name, static hosts and rewrite rules are applied first. The cached entries are served
+// until they expire, the hot ones are refreshed in background before expiry, and the expired ones are served within
+// stale ttl while being refreshed.
+func (r *resolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	if o, ok := r.overrides.match(host); ok {
+		countDNSOverride(o.rule)
+		if o.domain == "" {
+			return o.addrs(network, host)
 		}
 
-		if len(ips) == 0 {
-			return nil, fmt.Errorf("failed to resolve %q", host)
+		// the rewritten domain is resolved as usual
+		host = o.domain
+	}
+
+	key := network + host
+	now := time.Now()
+
+	if e, ok := r.cache.Get(key); ok {
+		switch {
+		case now.Before(e.expires):
+			countDNSCacheLookup(dnsCacheHit)
+
+			// the entry requested more than once is refreshed within the last 10% of its ttl
+			if r.prefetch && e.err == nil && e.hits.Add(1) > 1 && e.expires.Sub(now) < e.expires.Sub(e.stored)/10 {
+				r.refresh(key, network, host, e)
+			}
+
+			return e.ips, e.err
+
+		case e.err == nil && now.Before(e.expires.Add(r.staleTTL)):
+			countDNSCacheLookup(dnsCacheStale)
+			r.refresh(key, network, host, e)
+
+			return e.ips, nil
 		}
+	}
+	countDNSCacheLookup(dnsCacheMiss)
 
-		r.cache.Add(key, ips)
-		r.sg.Forget(key)
+	res, _, _ := r.sg.Do(key, func() (interface{}, error) {
+		e := r.lookup(ctx, network, host)
+		if e.expires.After(e.stored) {
+			r.cache.Add(key, e)
+		}
 
-		return ips, nil
+		return e, nil
 	})
 
-	if res != nil {
-		return res.([]net.IP), err
+	e := res.(*dnsEntry)
+	return e.ips, e.err
+}
+
+// refresh resolves the cached entry in background, the entry is replaced if the lookup succeeded
+func (r *resolver) refresh(key, network, host string, e *dnsEntry) {
+	if !e.refreshing.CompareAndSwap(false, true) {
+		return
 	}
 
-	return nil, err
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), dnsRefreshTimeout)
+		defer cancel()
+
+		fresh := r.lookup(ctx, network, host)
+		if fresh.err != nil {
+			e.refreshing.Store(false)
+			return
+		}
+
+		r.cache.Add(key, fresh)
+	}()
 }
 
-func defaultDomainResolver(ctx context.Context, domain []byte) (net.IP, error) {
-	ips, err := defaultResolver.LookupIP(ctx, "ip", string(domain))
-	if err != nil {
-		return nil, err
+// lookup resolves the domain and sets the expiry of the result
+func (r *resolver) lookup(ctx context.Context, network, host string) *dnsEntry {
+	var (
+		ips []net.IP
+		ttl = ttlUnknown
+		err error
+	)
+
+	if tr, ok := r.resolver.(ttlResolver); ok {
+		ips, ttl, err = tr.lookupIPTTL(ctx, network, host)
+	} else {
+		ips, err = r.resolver.LookupIP(ctx, network, host)
+	}
+
+	if ttl == ttlUnknown {
+		ttl = r.ttl
+	}
+
+	e := &dnsEntry{
+		ips:    ips,
+		err:    err,
+		stored: time.Now(),
 	}
 
-	// ipv4 priority
-	for _, ip := range ips {
-		if len(ip) == net.IPv4len {
-			return ip, nil
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil && len(ips) == 0:
+		e.err = fmt.Errorf("failed to resolve %q", host)
+		ttl = min(ttl, r.negativeTTL)
+	case err == nil:
+		ttl = max(ttl, r.minTTL)
+		if r.maxTTL > 0 {
+			ttl = min(ttl, r.maxTTL)
 		}
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		ttl = min(ttl, r.negativeTTL)
+	case errors.As(err, &dnsErr) && dnsErr.IsTimeout,
+		errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		// the lookup might be limited by the context of the client
+		ttl = 0
+	default:
+		ttl = r.errorTTL
 	}
 
-	return ips[rand.Intn(len(ips))], nil // nolint
+	e.expires = e.stored.Add(ttl)
+
+	return e
+}
+
+// lookupDomain resolves domain name to all its addresses
+func (r *resolver) lookupDomain(ctx context.Context, domain []byte) ([]net.IP, error) {
+	return r.LookupIP(ctx, "ip", string(domain))
 }
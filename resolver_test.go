@@ -7,9 +7,11 @@ import (
 	"io"
 	"net"
 	"reflect"
+	"sync/atomic"
 	"testing"
+	"time"
 
-	"github.com/hashicorp/golang-lru/v2/expirable"
+	lru "github.com/hashicorp/golang-lru/v2"
 )
 
 type fakeResolver struct {
@@ -20,6 +22,35 @@ func (f fakeResolver) LookupIP(ctx context.Context, network, host string) ([]net
 	return f.fnLookupIP(ctx, network, host)
 }
 
+// fakeTTLResolver resolves any domain to ips with ttl and counts the lookups
+type fakeTTLResolver struct {
+	ips     []net.IP
+	ttl     time.Duration
+	err     error
+	lookups *atomic.Int32
+}
+
+func (f fakeTTLResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	ips, _, err := f.lookupIPTTL(ctx, network, host)
+	return ips, err
+}
+
+func (f fakeTTLResolver) lookupIPTTL(context.Context, string, string) ([]net.IP, time.Duration, error) {
+	f.lookups.Add(1)
+	return f.ips, f.ttl, f.err
+}
+
+func newTestDNSCache(t *testing.T) *lru.Cache[string, *dnsEntry] {
+	t.Helper()
+
+	cache, err := lru.New[string, *dnsEntry](100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cache
+}
+
 func Test_resolver_LookupIP(t *testing.T) {
 	var (
 		localhost = net.ParseIP("127.0.0.1")
@@ -30,7 +61,7 @@ func Test_resolver_LookupIP(t *testing.T) {
 		resolver interface {
 			LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
 		}
-		cache *expirable.LRU[string, []net.IP]
+		cache *lru.Cache[string, *dnsEntry]
 	}
 	type args struct {
 		ctx     context.Context
@@ -51,7 +82,7 @@ func Test_resolver_LookupIP(t *testing.T) {
 						return append([]net.IP{}, localhost), nil
 					},
 				},
-				cache: expirable.NewLRU[string, []net.IP](100, nil, dnsCacheTTL),
+				cache: newTestDNSCache(t),
 			},
 			args: args{},
 			check: func(ip []net.IP, err error) error {
@@ -74,7 +105,7 @@ func Test_resolver_LookupIP(t *testing.T) {
 						return append([]net.IP{}, ips...), nil
 					},
 				},
-				cache: expirable.NewLRU[string, []net.IP](100, nil, dnsCacheTTL),
+				cache: newTestDNSCache(t),
 			},
 			args: args{},
 			check: func(ip []net.IP, err error) error {
@@ -97,7 +128,7 @@ func Test_resolver_LookupIP(t *testing.T) {
 						return nil, nil
 					},
 				},
-				cache: expirable.NewLRU[string, []net.IP](100, nil, dnsCacheTTL),
+				cache: newTestDNSCache(t),
 			},
 			args: args{},
 			check: func(ip []net.IP, err error) error {
@@ -116,7 +147,7 @@ func Test_resolver_LookupIP(t *testing.T) {
 						return nil, nil
 					},
 				},
-				cache: expirable.NewLRU[string, []net.IP](100, nil, dnsCacheTTL),
+				cache: newTestDNSCache(t),
 			},
 			args: args{},
 			check: func(ip []net.IP, err error) error {
@@ -135,7 +166,7 @@ func Test_resolver_LookupIP(t *testing.T) {
 						return nil, io.EOF
 					},
 				},
-				cache: expirable.NewLRU[string, []net.IP](100, nil, dnsCacheTTL),
+				cache: newTestDNSCache(t),
 			},
 			args: args{},
 			check: func(ip []net.IP, err error) error {
@@ -162,3 +193,142 @@ func Test_resolver_LookupIP(t *testing.T) {
 		})
 	}
 }
+
+func Test_resolver_ttl(t *testing.T) {
+	ips := []net.IP{net.ParseIP("192.0.2.1")}
+	notFound := &net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}
+	timeout := &net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true}
+
+	tests := []struct {
+		name string
+		ips  []net.IP
+		ttl  time.Duration
+		err  error
+		want time.Duration // 0 means not cached
+	}{
+		{name: "record ttl", ips: ips, ttl: time.Minute, want: time.Minute},
+		{name: "min ttl", ips: ips, ttl: time.Second, want: dnsMinTTL},
+		{name: "max ttl", ips: ips, ttl: 24 * time.Hour, want: dnsMaxTTL},
+		{name: "unknown ttl", ips: ips, ttl: ttlUnknown, want: dnsCacheTTL},
+		{name: "negative ttl of soa", ttl: 10 * time.Second, err: notFound, want: 10 * time.Second},
+		{name: "negative ttl", ttl: time.Hour, err: notFound, want: dnsNegativeTTL},
+		{name: "no addresses", ttl: ttlUnknown, want: dnsNegativeTTL},
+		{name: "server failure", ttl: ttlUnknown, err: &net.DNSError{Err: "server misbehaving", IsTemporary: true}, want: dnsErrorTTL},
+		{name: "timeout", ttl: ttlUnknown, err: timeout},
+		{name: "context canceled", ttl: ttlUnknown, err: context.Canceled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookups := new(atomic.Int32)
+			r := newResolver(dnsConfig{
+				CacheSize:   10,
+				CacheTTL:    dnsCacheTTL,
+				MinTTL:      dnsMinTTL,
+				MaxTTL:      dnsMaxTTL,
+				NegativeTTL: dnsNegativeTTL,
+				ErrorTTL:    dnsErrorTTL,
+			})
+			r.resolver = fakeTTLResolver{ips: tt.ips, ttl: tt.ttl, err: tt.err, lookups: lookups}
+
+			for i := 0; i < 2; i++ {
+				_, _ = r.LookupIP(context.Background(), "ip", "example.com")
+			}
+
+			e, ok := r.cache.Get("ipexample.com")
+			if tt.want == 0 {
+				if ok || lookups.Load() != 2 {
+					t.Errorf("cached entry = %v, lookups = %d, want not cached", ok, lookups.Load())
+				}
+				return
+			}
+
+			if !ok || lookups.Load() != 1 {
+				t.Fatalf("cached entry = %v, lookups = %d, want cached", ok, lookups.Load())
+			}
+			if got := e.expires.Sub(e.stored); got != tt.want {
+				t.Errorf("ttl = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_resolver_refresh(t *testing.T) {
+	var (
+		old   = []net.IP{net.ParseIP("192.0.2.1")}
+		fresh = []net.IP{net.ParseIP("192.0.2.2")}
+	)
+
+	tests := []struct {
+		name    string
+		entry   func(now time.Time) *dnsEntry
+		hits    int32
+		stale   time.Duration
+		refresh bool
+	}{
+		{
+			name: "stale entry is served and refreshed",
+			entry: func(now time.Time) *dnsEntry {
+				return &dnsEntry{ips: old, stored: now.Add(-2 * time.Minute), expires: now.Add(-time.Minute)}
+			},
+			stale:   time.Hour,
+			refresh: true,
+		},
+		{
+			name: "hot entry is prefetched",
+			entry: func(now time.Time) *dnsEntry {
+				return &dnsEntry{ips: old, stored: now.Add(-59 * time.Second), expires: now.Add(time.Second)}
+			},
+			hits:    1,
+			refresh: true,
+		},
+		{
+			name: "cold entry is not prefetched",
+			entry: func(now time.Time) *dnsEntry {
+				return &dnsEntry{ips: old, stored: now.Add(-59 * time.Second), expires: now.Add(time.Second)}
+			},
+		},
+		{
+			name:  "fresh entry is not prefetched",
+			entry: func(now time.Time) *dnsEntry { return &dnsEntry{ips: old, stored: now, expires: now.Add(time.Minute)} },
+			hits:  1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookups := new(atomic.Int32)
+			r := newResolver(dnsConfig{CacheSize: 10, CacheTTL: time.Minute, StaleTTL: tt.stale, Prefetch: true})
+			r.resolver = fakeTTLResolver{ips: fresh, ttl: time.Minute, lookups: lookups}
+
+			e := tt.entry(time.Now())
+			e.hits.Store(tt.hits)
+			r.cache.Add("ipexample.com", e)
+
+			got, err := r.LookupIP(context.Background(), "ip", "example.com")
+			if err != nil || !reflect.DeepEqual(got, old) {
+				t.Fatalf("LookupIP() = %v, %v, want the cached %v", got, err, old)
+			}
+
+			if !tt.refresh {
+				time.Sleep(50 * time.Millisecond)
+				if lookups.Load() != 0 {
+					t.Errorf("entry refreshed, lookups = %d", lookups.Load())
+				}
+				return
+			}
+
+			for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+				if e, _ := r.cache.Peek("ipexample.com"); reflect.DeepEqual(e.ips, fresh) {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("entry is not refreshed")
+				}
+			}
+			if lookups.Load() != 1 {
+				t.Errorf("lookups = %d, want 1", lookups.Load())
+			}
+		})
+	}
+}
@@ -7,29 +7,290 @@ import (
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dblokhin/proxyme"
 )
 
-// todo: make it configurable?
-var keepAliveConfig = net.KeepAliveConfig{
-	Enable:   true,
-	Idle:     20 * time.Second,
-	Interval: 5 * time.Second,
-	Count:    5,
+// settings is immutable set of the reloadable server settings.
+// Every session uses the settings actual at the moment the connection is accepted.
+type settings struct {
+	opts        proxyme.Options // socks5 protocol options, auth methods and Connect are bound to the session
+	connector   connector
+	shaper      *shaper          // bandwidth limits shared by all the settings of the listener
+	limits      *sessionLimits   // session limits shared by all the settings of the listener
+	bruteForce  *bruteForceGuard // nil if the server has no brute force protection
+	clients     *clientFilter
+	tls         *serverTLS          // nil if the main listener is not tls
+	udp         *udpRelay           // nil if UDP ASSOCIATE is disabled
+	socks4Users map[string]string   // socks4 userid to username
+	listener    string              // the name of the listener of listeners section, empty for the main one
+	keepAlive   net.KeepAliveConfig // keep alive settings of client connections
+	idleTimeout time.Duration       // deadline for idle client connections
 }
 
 type server struct {
-	protocol *proxyme.SOCKS5
+	settings   atomic.Pointer[settings]             // of the main and http listeners
+	listeners  map[string]*atomic.Pointer[settings] // of listeners section by name, see listenerConfig
+	accessLog  *accessLog                           // nil if disabled
+	bruteForce *bruteForceGuard                     // shared with metrics server to manage the bans
+	routing    *routing                             // shared by all the listeners and kept on reload, see routing
 }
 
-// ListenAndServe starts listening incoming connection for SOCKS5 clients.
+// reload atomically replaces server settings by the new ones built from cfg, the settings of every listener
+// are built from its config section. On error the current settings stay untouched.
+// The listeners added to the config are not started, they require restart.
+func (s *server) reload(cfg config) error {
+	rt, err := newRouting(cfg, s.routing)
+	if err != nil {
+		return fmt.Errorf("init connector: %w", err)
+	}
+
+	st, err := s.newSettings(cfg, s.settings.Load(), rt)
+	if err != nil {
+		return err
+	}
+
+	// the listeners are known by the first load
+	first := s.listeners == nil
+
+	type loaded struct {
+		name string
+		st   *settings
+		cfg  config
+	}
+
+	var listeners []loaded
+	for _, l := range cfg.Listeners {
+		current, ok := s.listeners[l.name()]
+		if !ok && !first {
+			log.Printf("listener %s requires restart", l.name())
+			continue
+		}
+
+		var prev *settings
+		if current != nil {
+			prev = current.Load()
+		}
+
+		lcfg := cfg.listener(l)
+		lst, err := s.newSettings(lcfg, prev, rt)
+		if err != nil {
+			return fmt.Errorf("listener %s: %w", l.name(), err)
+		}
+		lst.listener = l.name()
+
+		listeners = append(listeners, loaded{name: l.name(), st: lst, cfg: lcfg})
+	}
+
+	if s.bruteForce != nil {
+		if err := s.bruteForce.update(cfg.BruteForce); err != nil {
+			return fmt.Errorf("init brute force protection: %w", err)
+		}
+	}
+
+	s.routing = rt
+	s.settings.Store(st)
+	st.shaper.update(cfg.Bandwidth)
+	st.limits.update(cfg.Limits)
+	traffic.setMaxUsers(cfg.Metrics.UserLabels)
+
+	if first {
+		s.listeners = make(map[string]*atomic.Pointer[settings])
+		for _, l := range listeners {
+			s.listeners[l.name] = new(atomic.Pointer[settings])
+		}
+	}
+
+	for _, l := range listeners {
+		s.listeners[l.name].Store(l.st)
+		l.st.shaper.update(l.cfg.Bandwidth)
+		l.st.limits.update(l.cfg.Limits)
+	}
+
+	return nil
+}
+
+// newSettings builds the settings of single listener, the bandwidth and session limits are inherited from prev
+// and the routing is shared by all the listeners
+func (s *server) newSettings(cfg config, prev *settings, rt *routing) (*settings, error) {
+	opts, err := parseOptions(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("parse options: %w", err)
+	}
+
+	dialer, err := newConnector(cfg, rt)
+	if err != nil {
+		return nil, fmt.Errorf("init connector: %w", err)
+	}
+
+	clients, err := newClientFilter(cfg.Clients)
+	if err != nil {
+		return nil, fmt.Errorf("init client filter: %w", err)
+	}
+
+	serverTLS, err := newServerTLS(cfg.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("init tls: %w", err)
+	}
+
+	shaper, limits := newShaper(), newSessionLimits()
+	if prev != nil {
+		shaper, limits = prev.shaper, prev.limits
+	}
+
+	st := &settings{
+		opts:        opts,
+		connector:   dialer,
+		shaper:      shaper,
+		limits:      limits,
+		bruteForce:  s.bruteForce,
+		clients:     clients,
+		tls:         serverTLS,
+		socks4Users: cfg.SOCKS4.Users,
+		keepAlive:   cfg.KeepAlive.netKeepAlive(),
+		idleTimeout: cfg.Timeouts.Idle,
+	}
+
+	if cfg.UDP.Enable {
+		st.udp = &udpRelay{
+			connector:   dialer,
+			idleTimeout: cfg.UDP.IdleTimeout,
+		}
+	}
+
+	// check the options are valid
+	if _, err := st.newProtocol(new(session), nil); err != nil {
+		return nil, fmt.Errorf("init socks5 protocol: %w", err)
+	}
+
+	return st, nil
+}
+
+// newProtocol creates socks5 protocol handler bound to the session,
+// admit checks the session limits before connecting if it's not nil
+func (st *settings) newProtocol(sess *session, admit func() error) (*proxyme.SOCKS5, error) {
+	opts := st.opts
+
+	// the session checking the settings on reload has no client
+	if sess.client != nil {
+		opts.AllowNoAuth = st.allowNoAuth(sess)
+		if !opts.AllowNoAuth && opts.Authenticate == nil && opts.GSSAPI == nil {
+			return nil, errAuthRequired
+		}
+	} else if st.tls != nil && st.tls.noAuth {
+		opts.AllowNoAuth = true
+	}
+
+	opts.Authenticate = st.authenticate(sess)
+
+	if newContext := opts.GSSAPI; newContext != nil {
+		opts.GSSAPI = func() (proxyme.GSSAPI, error) {
+			gss, err := newContext()
+			if err != nil {
+				return nil, err
+			}
+
+			return sessionGSSAPI{GSSAPI: gss, sess: sess}, nil
+		}
+	}
+
+	opts.Connect = func(addressType int, addr []byte, port int) (net.Conn, error) {
+		// the request of gssapi session is not seen by clientConn
+		if admit != nil {
+			if err := admit(); err != nil {
+				return nil, err
+			}
+		}
+
+		return st.connector.connect(sess, addressType, addr, port)
+	}
+
+	return proxyme.New(opts)
+}
+
+// allowNoAuth reports whether the client may skip authentication: by noauth of its network,
+// or by verified client certificate if tls noauth is enabled
+func (st *settings) allowNoAuth(sess *session) bool {
+	if st.tls != nil && st.tls.noAuth && sess.certUser != "" {
+		return true
+	}
+
+	return st.opts.AllowNoAuth && st.clients.allowNoAuth(sess.client)
+}
+
+// authenticate returns username/password check bound to the session and protected from brute force,
+// it returns nil if username/password authentication is disabled
+func (st *settings) authenticate(sess *session) func(username, password []byte) error {
+	authenticate := st.opts.Authenticate
+	if authenticate == nil {
+		return nil
+	}
+
+	client := sess.client
+
+	return func(username, password []byte) error {
+		user := string(username)
+		if sess.certUser != "" && user != sess.certUser {
+			return fmt.Errorf("%w: username doesn't match client certificate", errDenied)
+		}
+
+		if err := st.bruteForce.check(client, user); err != nil {
+			return err
+		}
+
+		if err := authenticate(username, password); err != nil {
+			if isDenied(err) {
+				time.Sleep(st.bruteForce.failed(client, user))
+			}
+			return err
+		}
+
+		st.bruteForce.succeeded(user)
+		sess.setUser(user)
+		return nil
+	}
+}
+
+// ListenAndServe starts listening incoming connection for SOCKS5, SOCKS4 and HTTP proxy clients,
+// the protocol is detected by the first bytes of the client. Use context for graceful shutdown.
+func (s *server) ListenAndServe(ctx context.Context, address string) error {
+	return s.listenAndServe(ctx, listenerConfig{Listen: address}, &s.settings)
+}
+
+// ListenAndServeHTTP starts listening incoming connection for HTTP proxy clients.
 // Use context for graceful shutdown.
-func (s server) ListenAndServe(ctx context.Context, address string) error {
-	lc := net.ListenConfig{}
-	ls, err := lc.Listen(ctx, "tcp", address)
+func (s *server) ListenAndServeHTTP(ctx context.Context, address string) error {
+	return s.listenAndServe(ctx, listenerConfig{Listen: address, Protocol: listenerHTTP}, &s.settings)
+}
+
+// ListenAndServeListener starts listening incoming connection of the listener served by its own settings.
+// Use context for graceful shutdown.
+func (s *server) ListenAndServeListener(ctx context.Context, l listenerConfig) error {
+	current, ok := s.listeners[l.name()]
+	if !ok {
+		return fmt.Errorf("listener %s is not loaded", l.name())
+	}
+
+	return s.listenAndServe(ctx, l, current)
+}
+
+// listenAndServe accepts the connections of the listener passing client filter and session limits to serve them
+// by the protocol of the listener, it's detected by the first bytes of the client if not specified.
+// The connections are served by the current settings.
+func (s *server) listenAndServe(ctx context.Context, l listenerConfig, current *atomic.Pointer[settings]) error {
+	protocol := ""
+	switch l.Protocol {
+	case listenerHTTP:
+		protocol = protocolHTTP
+	case listenerSOCKS5:
+		protocol = protocolSOCKS5
+	}
+
+	ls, err := listen(ctx, l)
 	if err != nil {
 		return fmt.Errorf("listen: %w", err)
 	}
@@ -58,64 +319,320 @@ func (s server) ListenAndServe(ctx context.Context, address string) error {
 			return fmt.Errorf("accept: %w", err)
 		}
 
+		connectionsAccepted.Inc()
+		st := current.Load()
+		client := clientAddr(conn)
+
+		if err := st.clients.check(client); err != nil {
+			countRejectedSession(rejectClient)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.reject(st, conn, client, protocol, err)
+			}()
+			continue
+		}
+
+		slot, err := st.limits.enter(client)
+		if err != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.reject(st, conn, client, protocol, err)
+			}()
+			continue
+		}
+
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			s.serve(ctx, conn.(*net.TCPConn))
+			defer slot.leave()
+			s.serve(ctx, st, slot, conn, client, protocol)
 		}()
 	}
 }
 
-func (s server) serve(ctx context.Context, tcpConn *net.TCPConn) {
-	_ = tcpConn.SetLinger(0)
-	_ = tcpConn.SetKeepAliveConfig(keepAliveConfig)
+// reject closes the connection of denied client or exceeding the session limits
+func (s *server) reject(st *settings, conn net.Conn, client net.Addr, protocol string, err error) {
+	sess := newSession(client)
+	sess.listener = st.listener
+	sess.setProtocol(protocol)
+	sess.setCloseReason(err.Error())
+	defer s.accessLog.log(sess)
+
+	// the denied clients are not talked to, neither are tls ones before the handshake
+	if errors.Is(err, errClientDenied) || protocol != protocolHTTP && st.tls != nil {
+		_ = conn.Close()
+		return
+	}
+
+	if protocol == "" {
+		_ = conn.SetDeadline(time.Now().Add(rejectTimeout))
+		if protocol, conn, err = detectProtocol(conn); err != nil {
+			_ = conn.Close()
+			return
+		}
+		sess.setProtocol(protocol)
+	}
+
+	switch protocol {
+	case protocolHTTP:
+		rejectHTTP(conn, http.StatusServiceUnavailable)
+	case protocolSOCKS4:
+		rejectSOCKS4(conn)
+	default:
+		rejectConn(conn)
+	}
+}
+
+// serve serves the client connection by the protocol, it's detected by the first bytes if empty.
+// addr is the client address, see clientAddr.
+func (s *server) serve(ctx context.Context, st *settings, slot *sessionSlot, client net.Conn, addr net.Addr, protocol string) {
+	if tcpConn, ok := client.(*net.TCPConn); ok {
+		_ = tcpConn.SetLinger(0)
+		_ = tcpConn.SetKeepAliveConfig(st.keepAlive)
+	}
+
+	sess := newSession(addr)
+	sess.local = client.LocalAddr()
+	sess.listener = st.listener
+
+	defer s.accessLog.log(sess)
+	defer trackSession(sess)()
 
 	// set up deadline for idle connections
-	conn := tcpConnWithTimeout{
-		TCPConn: tcpConn,
-		timeout: time.Hour,
+	var conn net.Conn = connWithTimeout{
+		Conn:    client,
+		timeout: st.idleTimeout,
+	}
+
+	if protocol != protocolHTTP && st.tls != nil {
+		tlsConn, user, err := st.tls.handshake(ctx, conn)
+		if err != nil {
+			sess.setCloseReason(closeReason(err, "client closed"))
+			_ = conn.Close()
+			return
+		}
+
+		conn = tlsConn
+		if user != "" {
+			sess.certUser = user
+			sess.setUser(user)
+		}
+	}
+
+	admit := func() error {
+		return slot.enterUser(sess.username())
 	}
 
 	done := make(chan any)
 
-	// run socks
 	go func() {
-		s.protocol.Handle(conn, func(err error) {
-			log.Println(err)
-		})
-
+		st.serveProtocol(sess, conn, protocol, admit)
 		close(done)
 	}()
 
 	select {
 	case <-ctx.Done():
+		sess.setCloseReason("shutdown")
 	case <-done:
 	}
 
 	_ = conn.Close()
+	sess.setCloseReason("closed")
+}
+
+// serveSOCKS5 runs socks5 protocol handler on the client connection
+func (st *settings) serveSOCKS5(sess *session, client net.Conn, admit func() error) {
+	conn := &clientConn{
+		Conn:  client,
+		sess:  sess,
+		admit: admit,
+		shape: st.shaper.open(sess),
+	}
+	defer conn.shape.close()
+
+	// the datagrams are related to the client by its ip address
+	if _, ok := sess.client.(*net.TCPAddr); ok && st.udp != nil {
+		conn.associate = func(ctrl net.Conn, req socks5Request) error {
+			return st.udp.serve(ctrl, sess, req)
+		}
+	}
+
+	protocol, err := st.newProtocol(sess, admit)
+	if errors.Is(err, errAuthRequired) {
+		sess.setCloseReason(err.Error())
+		rejectConn(conn)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		sess.setCloseReason(err.Error())
+		return
+	}
+
+	protocol.Handle(conn, func(err error) {
+		// the handler fails to read the request served by udp relay
+		if conn.associate != nil && sess.command() == cmdUDPAssociate {
+			return
+		}
+		log.Println(err)
+		sess.setCloseReason(err.Error())
+	})
+}
+
+// serveProtocol serves the client by the protocol, it's detected by the first bytes if empty. The detection
+// waits for the client, so it's done here to be interrupted by the shutdown like the protocol itself.
+func (st *settings) serveProtocol(sess *session, conn net.Conn, protocol string, admit func() error) {
+	if protocol == "" {
+		var err error
+		if protocol, conn, err = detectProtocol(conn); err != nil {
+			sess.setCloseReason(closeReason(err, "client closed"))
+			return
+		}
+	}
+	sess.setProtocol(protocol)
+
+	switch protocol {
+	case protocolHTTP:
+		st.serveHTTP(sess, conn, admit)
+	case protocolSOCKS4:
+		st.serveSOCKS4(sess, conn, admit)
+	default:
+		st.serveSOCKS5(sess, conn, admit)
+	}
 }
 
-type tcpConnWithTimeout struct {
-	*net.TCPConn
+// detectProtocol reads the first byte of the client: socks version or the letter of http method.
+// The returned connection reads the byte again.
+func detectProtocol(conn net.Conn) (string, net.Conn, error) {
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(conn, first); err != nil {
+		return "", conn, err
+	}
+
+	peeked := &peekedConn{Conn: conn, peeked: first}
+
+	switch {
+	case first[0] == socks4Version:
+		return protocolSOCKS4, peeked, nil
+	case first[0] >= 'A' && first[0] <= 'Z':
+		return protocolHTTP, peeked, nil
+	}
+
+	return protocolSOCKS5, peeked, nil
+}
+
+// peekedConn is the client connection with the bytes read ahead, they are read first.
+// It keeps splice/sendfile fast path of the underlying connection.
+type peekedConn struct {
+	net.Conn
+	peeked []byte
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	if len(c.peeked) == 0 {
+		return c.Conn.Read(p)
+	}
+
+	n := copy(p, c.peeked)
+	c.peeked = c.peeked[n:]
+
+	return n, nil
+}
+
+func (c *peekedConn) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+
+	if len(c.peeked) > 0 {
+		n, err := w.Write(c.peeked)
+		total += int64(n)
+		c.peeked = c.peeked[n:]
+
+		if err != nil {
+			return total, err
+		}
+	}
+
+	if wt, ok := c.Conn.(io.WriterTo); ok {
+		n, err := wt.WriteTo(w)
+		return total + n, err
+	}
+
+	n, err := io.Copy(w, readerOnly{c.Conn})
+	return total + n, err
+}
+
+func (c *peekedConn) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+
+	return io.Copy(writerOnly{c.Conn}, r)
+}
+
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return c.Conn.Close()
+}
+
+// relay copies the data between the client and the remote host, the client's end of the data is passed on
+// to the remote host. It returns when the remote host finishes the relay.
+func relay(client, remote net.Conn) {
+	go func() {
+		_, _ = io.Copy(remote, client)
+
+		if cw, ok := remote.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+			return
+		}
+		_ = remote.Close()
+	}()
+
+	_, _ = io.Copy(client, remote)
+}
+
+// connWithTimeout is the client connection closed after the time of inactivity
+type connWithTimeout struct {
+	net.Conn
 	timeout time.Duration
 }
 
-func (t tcpConnWithTimeout) ReadFrom(r io.Reader) (n int64, err error) {
-	_ = t.TCPConn.SetDeadline(time.Now().Add(t.timeout)) // nolint
-	return t.TCPConn.ReadFrom(r)
+func (t connWithTimeout) ReadFrom(r io.Reader) (n int64, err error) {
+	_ = t.Conn.SetDeadline(time.Now().Add(t.timeout)) // nolint
+	if rf, ok := t.Conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+
+	return io.Copy(writerOnly{t.Conn}, r)
 }
 
-func (t tcpConnWithTimeout) WriteTo(w io.Writer) (n int64, err error) {
-	_ = t.TCPConn.SetDeadline(time.Now().Add(t.timeout)) // nolint
-	return t.TCPConn.WriteTo(w)
+func (t connWithTimeout) WriteTo(w io.Writer) (n int64, err error) {
+	_ = t.Conn.SetDeadline(time.Now().Add(t.timeout)) // nolint
+	if wt, ok := t.Conn.(io.WriterTo); ok {
+		return wt.WriteTo(w)
+	}
+
+	return io.Copy(w, readerOnly{t.Conn})
+}
+
+func (t connWithTimeout) Write(p []byte) (n int, err error) {
+	_ = t.Conn.SetDeadline(time.Now().Add(t.timeout)) // nolint
+	return t.Conn.Write(p)
 }
 
-func (t tcpConnWithTimeout) Write(p []byte) (n int, err error) {
-	_ = t.TCPConn.SetDeadline(time.Now().Add(t.timeout)) // nolint
-	return t.TCPConn.Write(p)
+func (t connWithTimeout) Read(p []byte) (n int, err error) {
+	_ = t.Conn.SetDeadline(time.Now().Add(t.timeout)) // nolint
+	return t.Conn.Read(p)
 }
 
-func (t tcpConnWithTimeout) Read(p []byte) (n int, err error) {
-	_ = t.TCPConn.SetDeadline(time.Now().Add(t.timeout)) // nolint
-	return t.TCPConn.Read(p)
+func (t connWithTimeout) CloseWrite() error {
+	if cw, ok := t.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return t.Conn.Close()
 }
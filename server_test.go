@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// startServer runs the listener of the server with the config and returns its address
+func startServer(t *testing.T, cfg config, listen func(*server, context.Context, string) error) string {
+	t.Helper()
+
+	srv := new(server)
+	if err := srv.reload(cfg); err != nil {
+		t.Fatalf("reload() error = %v", err)
+	}
+
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ls.Addr().String()
+	_ = ls.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan any)
+	go func() {
+		_ = listen(srv, ctx, addr)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			_ = conn.Close()
+			return addr
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("server is not started")
+	return ""
+}
+
+// startEchoServer runs tcp server echoing the data back and returns its port
+func startEchoServer(t *testing.T) int {
+	t.Helper()
+
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ls.Close() })
+
+	go func() {
+		for {
+			conn, err := ls.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return ls.Addr().(*net.TCPAddr).Port
+}
+
+// exchange writes the request and reads the reply of the size
+func exchange(t *testing.T, conn net.Conn, request []byte, size int) []byte {
+	t.Helper()
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(request); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := make([]byte, size)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	return reply
+}
+
+func Test_server_serve_detectProtocol(t *testing.T) {
+	echo := startEchoServer(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "hello")
+	}))
+	defer backend.Close()
+
+	cfg := defaultConfig()
+	cfg.NoAuth = true
+	cfg.Egress.Enable = false
+	proxy := startServer(t, cfg, (*server).ListenAndServe)
+
+	t.Run("socks4a", func(t *testing.T) {
+		conn, err := net.Dial("tcp", proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		request := append([]byte{socks4Version, cmdConnect, byte(echo >> 8), byte(echo), 0, 0, 0, 1}, "app\x00localhost\x00"...)
+		if reply := exchange(t, conn, request, socks4ReplySize); reply[1] != socks4Granted {
+			t.Fatalf("reply = %v", reply)
+		}
+		if got := exchange(t, conn, []byte("ping"), 4); string(got) != "ping" {
+			t.Errorf("relayed %q", got)
+		}
+	})
+
+	t.Run("http", func(t *testing.T) {
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: proxy})}}
+
+		resp, err := client.Get(backend.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(body) != "hello" {
+			t.Errorf("response = %d %q", resp.StatusCode, body)
+		}
+	})
+}
+
+func Test_server_serve_protocol(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.NoAuth = true
+	cfg.Egress.Enable = false
+	proxy := startServer(t, cfg, func(s *server, ctx context.Context, addr string) error {
+		return s.listenAndServe(ctx, listenerConfig{Listen: addr, Protocol: listenerSOCKS5}, &s.settings)
+	})
+
+	// the probe of startServer is reset by the socks5 handler, the next dial may catch it
+	var (
+		conn net.Conn
+		err  error
+	)
+	for i := 0; i < 10; i++ {
+		if conn, err = net.Dial("tcp", proxy); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the http request is read as socks5 greeting of unsupported version, the connection may be reset by then
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = io.WriteString(conn, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	if reply, _ := io.ReadAll(conn); bytes.HasPrefix(reply, []byte("HTTP/")) {
+		t.Errorf("socks5 listener replied http: %q", reply)
+	}
+}
+
+func Test_server_serve_shutdownBeforeDetection(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.NoAuth = true
+
+	srv := new(server)
+	if err := srv.reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ls.Addr().String()
+	_ = ls.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan any)
+	go func() {
+		_ = srv.ListenAndServe(ctx, addr)
+		close(done)
+	}()
+
+	// the client connects and sends nothing
+	var conn net.Conn
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown waits for the silent client")
+	}
+}
+
+func Test_server_ListenAndServeListener(t *testing.T) {
+	echo := startEchoServer(t)
+
+	noAuth := true
+	cfg := defaultConfig()
+	cfg.Users = "alice:secret"
+	cfg.Egress.Enable = false
+	cfg.Listeners = []listenerConfig{{Name: "internal", Listen: "127.0.0.1:1081", NoAuth: &noAuth}}
+
+	public := startServer(t, cfg, (*server).ListenAndServe)
+	internal := startServer(t, cfg, func(s *server, ctx context.Context, addr string) error {
+		l := cfg.Listeners[0]
+		l.Listen = addr
+		return s.ListenAndServeListener(ctx, l)
+	})
+
+	tests := []struct {
+		name      string
+		proxy     string
+		wantReply byte
+	}{
+		{name: "main listener requires auth", proxy: public, wantReply: socks4Rejected},
+		{name: "listener allows noauth", proxy: internal, wantReply: socks4Granted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", tt.proxy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			request := []byte{socks4Version, cmdConnect, byte(echo >> 8), byte(echo), 127, 0, 0, 1, 0}
+			if reply := exchange(t, conn, request, socks4ReplySize); reply[1] != tt.wantReply {
+				t.Errorf("reply = %v, want %d", reply, tt.wantReply)
+			}
+		})
+	}
+}
+
+func Test_server_reload_routing(t *testing.T) {
+	noAuth := true
+	cfg := defaultConfig()
+	cfg.Users = "alice:secret"
+	cfg.Listeners = []listenerConfig{{Name: "internal", Listen: "127.0.0.1:1081", NoAuth: &noAuth}}
+
+	srv := new(server)
+	if err := srv.reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	prev := srv.settings.Load().connector
+
+	if got := srv.listeners["internal"].Load().connector; got.resolver != prev.resolver || got.outbound != prev.outbound {
+		t.Error("listener doesn't share the routing of the main listener")
+	}
+
+	// the policy is changed, the routing is kept
+	cfg.ACL = aclConfig{Rules: []aclRuleConfig{{Action: aclDeny, Destinations: []string{".blocked.example"}}}}
+	if err := srv.reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	got := srv.settings.Load().connector
+	if got.resolver != prev.resolver || got.outbound != prev.outbound {
+		t.Error("routing is rebuilt on reload of the same config")
+	}
+	if got.acl == prev.acl {
+		t.Error("acl is not reloaded")
+	}
+
+	// the dns config is changed, only the resolver is rebuilt
+	cfg.DNS.CacheTTL++
+	if err := srv.reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	got = srv.settings.Load().connector
+	if got.resolver == prev.resolver || got.outbound != prev.outbound {
+		t.Error("only resolver should be rebuilt on dns config change")
+	}
+	if srv.listeners["internal"].Load().connector.resolver != got.resolver {
+		t.Error("listener doesn't share the new resolver")
+	}
+}
+
+func Test_server_reload(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Users = "alice:secret"
+	cfg.Timeouts.Connect = time.Second
+
+	srv := new(server)
+	if err := srv.reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// the session has taken the settings before reload
+	old := srv.settings.Load()
+
+	t.Run("invalid config", func(t *testing.T) {
+		invalid := cfg
+		invalid.Users = "bob"
+		if err := srv.reload(invalid); err == nil {
+			t.Fatal("reload() error = nil")
+		}
+
+		if srv.settings.Load() != old {
+			t.Error("settings are replaced by invalid config")
+		}
+		if err := srv.settings.Load().opts.Authenticate([]byte("alice"), []byte("secret")); err != nil {
+			t.Errorf("authenticate(alice) error = %v", err)
+		}
+	})
+
+	next := cfg
+	next.Users = "bob:secret"
+	next.ACL = aclConfig{Rules: []aclRuleConfig{{Action: aclDeny, Destinations: []string{".blocked.example"}}}}
+	next.Timeouts.Connect = 2 * time.Second
+	if err := srv.reload(next); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		st        *settings
+		wantUser  string
+		wantAllow bool
+		wantDial  time.Duration
+	}{
+		{name: "established session keeps old settings", st: old, wantUser: "alice", wantAllow: true, wantDial: time.Second},
+		{name: "new session gets new settings", st: srv.settings.Load(), wantUser: "bob", wantAllow: false, wantDial: 2 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, user := range []string{"alice", "bob"} {
+				err := tt.st.opts.Authenticate([]byte(user), []byte("secret"))
+				if (err == nil) != (user == tt.wantUser) {
+					t.Errorf("authenticate(%s) error = %v, want user %s only", user, err, tt.wantUser)
+				}
+			}
+
+			if allow, _ := tt.st.connector.acl.check("", "www.blocked.example", net.IPv4(192, 0, 2, 1), 443); allow != tt.wantAllow {
+				t.Errorf("acl allows = %v, want %v", allow, tt.wantAllow)
+			}
+			if tt.st.connector.timeout != tt.wantDial {
+				t.Errorf("connect timeout = %s, want %s", tt.st.connector.timeout, tt.wantDial)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// session is the state of single client connection
+type session struct {
+	client   net.Addr
+	local    net.Addr // the listener address the client connected to
+	listener string   // the name of the listener of listeners section, empty for the main and http ones
+	certUser string   // username of verified tls client certificate, empty if none
+	start    time.Time
+
+	bytesIn  atomic.Int64 // received from the client
+	bytesOut atomic.Int64 // sent to the client
+
+	mu          sync.Mutex
+	protocol    string        // client protocol: socks5, socks4 or http, empty until detected
+	method      int           // selected auth method, -1 if not selected yet
+	auth        int           // authentication result: authPending, authSucceeded or authFailed
+	user        string        // authenticated username, empty for anonymous clients
+	request     socks5Request // zero if the request is not received yet
+	resolved    net.IP        // dialed address of the destination
+	upstream    string        // the upstream the destination is connected through, empty if directly
+	reply       int           // socks5 reply code or http status, -1 if no reply sent
+	closeReason string
+}
+
+func newSession(client net.Addr) *session {
+	return &session{
+		client: client,
+		start:  time.Now(),
+		method: -1,
+		reply:  -1,
+	}
+}
+
+// client protocols of session
+const (
+	protocolSOCKS5 = "socks5"
+	protocolSOCKS4 = "socks4"
+	protocolHTTP   = "http"
+)
+
+// authentication results of session
+const (
+	authPending = iota
+	authSucceeded
+	authFailed
+)
+
+// setMethod sets auth method selected by the server, no acceptable methods fails authentication
+func (s *session) setMethod(method byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.method = int(method)
+	switch method {
+	case authNone:
+		s.auth = authSucceeded
+	case authNoAcceptable:
+		s.auth = authFailed
+	}
+}
+
+func (s *session) setAuthenticated(ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.auth = authFailed
+	if ok {
+		s.auth = authSucceeded
+	}
+}
+
+// handshake returns selected auth method and authentication result
+func (s *session) handshake() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.method, s.auth
+}
+
+func (s *session) setUser(user string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.user = user
+}
+
+func (s *session) username() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.user
+}
+
+func (s *session) setRequest(req socks5Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.request = req
+}
+
+func (s *session) command() byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.request.cmd
+}
+
+// setTarget sets the dialed destination. The request is set if the handshake is not seen by the session,
+// e.g. gssapi encapsulated one.
+func (s *session) setTarget(req socks5Request, resolved net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.request.cmd == 0 {
+		s.request = req
+	}
+	s.resolved = resolved
+}
+
+func (s *session) setProtocol(protocol string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.protocol = protocol
+}
+
+func (s *session) setUpstream(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.upstream = name
+}
+
+func (s *session) setReply(rep byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reply = int(rep)
+}
+
+// setStatus sets http status replied to http proxy client
+func (s *session) setStatus(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reply = status
+}
+
+// setCloseReason sets why the session is finished, the first reason wins
+func (s *session) setCloseReason(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closeReason == "" {
+		s.closeReason = reason
+	}
+}
+
+// closeReason describes connection error as session close reason, it's empty if the error tells nothing:
+// the connection is closed by the other side of relay.
+func closeReason(err error, eof string) string {
+	var ne net.Error
+
+	switch {
+	case err == nil, errors.Is(err, io.EOF):
+		return eof
+	case errors.Is(err, net.ErrClosed):
+		return ""
+	case errors.As(err, &ne) && ne.Timeout():
+		return "idle timeout"
+	}
+
+	return err.Error()
+}
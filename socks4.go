@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// socks4 protocol constants, SOCKS4 and SOCKS4a extension
+const (
+	socks4Version    = 4
+	socks4ReplyVer   = 0
+	socks4Granted    = 90
+	socks4Rejected   = 91
+	socks4MaxField   = 255 // max length of userid and domain, like socks5 ones
+	socks4ReplySize  = 8
+	socks4HeaderSize = 8
+)
+
+var errSOCKS4Request = errors.New("invalid socks4 request")
+
+// serveSOCKS4 serves SOCKS4 and SOCKS4a CONNECT request. The protocol has no authentication: the client is served
+// if its userid is mapped to the user, or if it may connect without authentication.
+func (st *settings) serveSOCKS4(sess *session, client net.Conn, admit func() error) {
+	// the connection only counts and limits the traffic
+	conn := &clientConn{
+		Conn:  client,
+		sess:  sess,
+		shape: st.shaper.open(sess),
+		state: stateRelay,
+	}
+	defer conn.shape.close()
+
+	req, userid, err := readSOCKS4Request(conn)
+	if err != nil {
+		sess.setCloseReason(closeReason(err, "client closed"))
+		return
+	}
+	sess.setRequest(req)
+
+	reject := func(err error) {
+		sess.setCloseReason(err.Error())
+		sess.setReply(socks4Rejected)
+		_ = writeSOCKS4Reply(conn, socks4Rejected)
+	}
+
+	if err := st.authorizeSOCKS4(sess, userid); err != nil {
+		reject(err)
+		return
+	}
+
+	if req.cmd != cmdConnect {
+		reject(fmt.Errorf("socks4 command %d is not supported", req.cmd))
+		return
+	}
+
+	if err := admit(); err != nil {
+		reject(err)
+		return
+	}
+
+	remote, err := st.connector.connect(sess, int(req.atyp), req.addr, req.port)
+	if err != nil {
+		reject(err)
+		return
+	}
+	defer remote.Close()
+
+	sess.setReply(socks4Granted)
+	if err := writeSOCKS4Reply(conn, socks4Granted); err != nil {
+		return
+	}
+
+	relay(conn, remote)
+}
+
+// authorizeSOCKS4 allows the client if noauth is allowed for it and sets the user the userid is mapped to.
+// The userid is not a secret, so the mapping names the session but never grants access.
+// The user of client certificate is not replaced by the userid.
+func (st *settings) authorizeSOCKS4(sess *session, userid string) error {
+	if !st.allowNoAuth(sess) {
+		sess.setMethod(authNoAcceptable)
+		return errAuthRequired
+	}
+
+	sess.setMethod(authNone)
+	if user, ok := st.socks4Users[userid]; ok && sess.certUser == "" {
+		sess.setUser(user)
+	}
+
+	return nil
+}
+
+// readSOCKS4Request reads VN CD DSTPORT DSTIP USERID NULL, followed by DOMAIN NULL of SOCKS4a
+// if DSTIP is 0.0.0.x with non-zero x
+func readSOCKS4Request(r io.Reader) (socks5Request, string, error) {
+	header := make([]byte, socks4HeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return socks5Request{}, "", err
+	}
+
+	if header[0] != socks4Version {
+		return socks5Request{}, "", fmt.Errorf("%w: version %d", errSOCKS4Request, header[0])
+	}
+
+	userid, err := readNullTerminated(r)
+	if err != nil {
+		return socks5Request{}, "", err
+	}
+
+	req := socks5Request{
+		cmd:  header[1],
+		atyp: atypIPv4,
+		addr: header[4:8],
+		port: int(binary.BigEndian.Uint16(header[2:4])),
+	}
+
+	if header[4] == 0 && header[5] == 0 && header[6] == 0 && header[7] != 0 {
+		domain, err := readNullTerminated(r)
+		if err != nil {
+			return socks5Request{}, "", err
+		}
+		if domain == "" {
+			return socks5Request{}, "", fmt.Errorf("%w: empty domain", errSOCKS4Request)
+		}
+
+		req.atyp, req.addr = atypDomain, []byte(domain)
+	}
+
+	return req, userid, nil
+}
+
+// readNullTerminated reads the string terminated by zero byte, the data following it is not read
+func readNullTerminated(r io.Reader) (string, error) {
+	var (
+		buf []byte
+		b   = make([]byte, 1)
+	)
+
+	for len(buf) <= socks4MaxField {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(buf), nil
+		}
+		buf = append(buf, b[0])
+	}
+
+	return "", fmt.Errorf("%w: field is longer than %d bytes", errSOCKS4Request, socks4MaxField)
+}
+
+// writeSOCKS4Reply writes VN CD DSTPORT DSTIP, the address is not used by CONNECT reply
+func writeSOCKS4Reply(w io.Writer, code byte) error {
+	reply := make([]byte, socks4ReplySize)
+	reply[0], reply[1] = socks4ReplyVer, code
+
+	_, err := w.Write(reply)
+	return err
+}
+
+// rejectSOCKS4 tells socks4 client the request is rejected and closes the connection.
+// The request is drained to make the client get the reply instead of connection reset.
+func rejectSOCKS4(conn net.Conn) {
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(rejectTimeout))
+	if err := writeSOCKS4Reply(conn, socks4Rejected); err != nil {
+		return
+	}
+
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+
+	const maxRequest = socks4HeaderSize + 2*(socks4MaxField+1)
+	_, _ = io.Copy(io.Discard, io.LimitReader(conn, maxRequest))
+}
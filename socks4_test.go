@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_readSOCKS4Request(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       string
+		want       socks5Request
+		wantUserid string
+		wantErr    error
+	}{
+		{
+			name:       "socks4",
+			data:       "\x04\x01\x00\x50\x0a\x00\x00\x01app\x00",
+			want:       socks5Request{cmd: cmdConnect, atyp: atypIPv4, addr: []byte{10, 0, 0, 1}, port: 80},
+			wantUserid: "app",
+		},
+		{
+			name: "socks4a",
+			data: "\x04\x01\x01\xbb\x00\x00\x00\x01\x00example.com\x00",
+			want: socks5Request{cmd: cmdConnect, atyp: atypDomain, addr: []byte("example.com"), port: 443},
+		},
+		{
+			name:    "socks4a empty domain",
+			data:    "\x04\x01\x01\xbb\x00\x00\x00\x01\x00\x00",
+			wantErr: errSOCKS4Request,
+		},
+		{
+			name:    "invalid version",
+			data:    "\x05\x01\x00\x50\x0a\x00\x00\x01\x00",
+			wantErr: errSOCKS4Request,
+		},
+		{
+			name:    "too long userid",
+			data:    "\x04\x01\x00\x50\x0a\x00\x00\x01" + strings.Repeat("a", socks4MaxField+1) + "\x00",
+			wantErr: errSOCKS4Request,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, userid, err := readSOCKS4Request(strings.NewReader(tt.data))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("readSOCKS4Request() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("readSOCKS4Request() error = %v", err)
+			}
+			if !reflect.DeepEqual(req, tt.want) || userid != tt.wantUserid {
+				t.Errorf("readSOCKS4Request() = %+v, %q, want %+v, %q", req, userid, tt.want, tt.wantUserid)
+			}
+		})
+	}
+}
+
+func Test_settings_authorizeSOCKS4(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.NoAuth = true
+	cfg.Users = "alice:secret"
+	cfg.Clients.NoAuth = []string{"127.0.0.0/8"}
+	cfg.SOCKS4.Users = map[string]string{"app": "alice"}
+
+	srv := new(server)
+	if err := srv.reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	st := srv.settings.Load()
+
+	tests := []struct {
+		name     string
+		client   net.IP
+		userid   string
+		wantUser string
+		wantErr  error
+	}{
+		{name: "mapped userid", client: net.IPv4(127, 0, 0, 1), userid: "app", wantUser: "alice"},
+		{name: "unknown userid", client: net.IPv4(127, 0, 0, 1), userid: "bob"},
+		{name: "no userid", client: net.IPv4(127, 0, 0, 1)},
+		{name: "mapped userid requires noauth", client: net.IPv4(198, 51, 100, 1), userid: "app", wantErr: errAuthRequired},
+		{name: "auth required", client: net.IPv4(198, 51, 100, 1), wantErr: errAuthRequired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sess := newSession(&net.TCPAddr{IP: tt.client, Port: 1080})
+
+			err := st.authorizeSOCKS4(sess, tt.userid)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("authorizeSOCKS4() error = %v, want %v", err, tt.wantErr)
+			}
+			if sess.user != tt.wantUser {
+				t.Errorf("user = %q, want %q", sess.user, tt.wantUser)
+			}
+		})
+	}
+}
+
+func Test_writeSOCKS4Reply(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeSOCKS4Reply(&buf, socks4Granted); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []byte{0, socks4Granted, 0, 0, 0, 0, 0, 0}; !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("reply = %v, want %v", buf.Bytes(), want)
+	}
+}
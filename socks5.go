@@ -0,0 +1,547 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+// socks5 protocol constants, RFC 1928
+const (
+	socks5Version = 5
+
+	authNone         = 0
+	authGSSAPI       = 1
+	authPassword     = 2
+	authNoAcceptable = 0xff
+
+	cmdConnect      = 1
+	cmdBind         = 2
+	cmdUDPAssociate = 3
+
+	atypIPv4   = 1
+	atypDomain = 3
+	atypIPv6   = 4
+
+	repSucceeded           = 0
+	repGeneralFailure      = 1
+	repNotAllowed          = 2
+	repNetworkUnreachable  = 3
+	repHostUnreachable     = 4
+	repConnectionRefused   = 5
+	repTTLExpired          = 6
+	repCommandNotSupported = 7
+)
+
+// states of socks5 handshake
+const (
+	stateGreeting    = iota // client sends auth methods
+	stateMethodReply        // server selects auth method
+	stateAuth               // client sends username/password
+	stateAuthReply          // server replies auth status
+	stateRequest            // client sends request
+	stateReply              // server replies request status
+	stateRelay              // handshake is done, the data is relayed as is
+)
+
+var (
+	errUDPAssociate         = errors.New("udp association is closed")
+	errAddrTypeNotSupported = errors.New("address type is not supported")
+)
+
+// socks5Request is the client request: command and destination address
+type socks5Request struct {
+	cmd  byte
+	atyp byte
+	addr []byte // ip address or domain
+	port int
+}
+
+// host returns printable destination host
+func (r socks5Request) host() string {
+	if r.atyp == atypDomain {
+		return string(r.addr)
+	}
+
+	return net.IP(r.addr).String()
+}
+
+func (r socks5Request) String() string {
+	return net.JoinHostPort(r.host(), strconv.Itoa(r.port))
+}
+
+// clientConn is client connection that counts and limits the traffic of the session. For socks5 clients
+// it tracks the handshake passing through it to the protocol handler, the other protocols start in stateRelay.
+// It feeds the handler the client messages one by one, that makes it possible to intercept the request
+// before the handler gets it: UDP ASSOCIATE command is served by the proxy itself. After the handshake
+// the connection is transparent and keeps splice/sendfile fast path of the underlying connection.
+type clientConn struct {
+	net.Conn
+	sess *session
+
+	// associate serves UDP ASSOCIATE request using the client connection as control connection.
+	// If it's nil the request is passed to the handler.
+	associate func(ctrl net.Conn, req socks5Request) error
+
+	// admit checks the session may make the request, the session is rejected with "not allowed" reply on error.
+	// If it's nil all the requests are passed to the handler.
+	admit func() error
+
+	// shape limits bandwidth of the relayed data, nil if it is not limited
+	shape *sessionShape
+
+	state   int
+	cmd     byte
+	replies int    // the number of request replies, BIND command has two replies
+	buf     []byte // the rest of current client message not read by the handler
+	written []byte // incomplete server message
+}
+
+func (c *clientConn) Read(p []byte) (int, error) {
+	limited := c.limited(upload)
+	if limited {
+		p = p[:min(len(p), c.shape.chunk(upload))]
+	}
+
+	n, err := c.read(p)
+	c.sess.bytesIn.Add(int64(n))
+
+	if limited {
+		c.shape.wait(upload, n)
+	}
+
+	if err != nil && !errors.Is(err, errUDPAssociate) {
+		c.sess.setCloseReason(closeReason(err, "client closed"))
+	}
+
+	return n, err
+}
+
+func (c *clientConn) read(p []byte) (int, error) {
+	if len(c.buf) == 0 {
+		if c.state == stateRelay {
+			return c.Conn.Read(p)
+		}
+
+		if err := c.readMessage(); err != nil {
+			return 0, err
+		}
+
+		// handshake could be finished by the message
+		if len(c.buf) == 0 {
+			return c.Conn.Read(p)
+		}
+	}
+
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+
+	return n, nil
+}
+
+// readMessage reads the next client message according to the handshake state
+func (c *clientConn) readMessage() error {
+	var (
+		msg []byte
+		err error
+	)
+
+	switch c.state {
+	case stateGreeting:
+		msg, err = readPrefixed(c.Conn, 2) // VER NMETHODS METHODS
+		if err == nil && msg[0] != socks5Version {
+			c.state = stateRelay // let the handler deal with it
+		} else {
+			c.state = stateMethodReply
+		}
+
+	case stateAuth:
+		msg, err = readPrefixed(c.Conn, 2) // VER ULEN UNAME
+		if err == nil {
+			var passwd []byte
+			passwd, err = readPrefixed(c.Conn, 1) // PLEN PASSWD
+			msg = append(msg, passwd...)
+		}
+		c.state = stateAuthReply
+
+	case stateRequest:
+		var req socks5Request
+		msg, req, err = readRequest(c.Conn)
+		if errors.Is(err, errAddrTypeNotSupported) {
+			// let the handler reply the error
+			c.state = stateRelay
+			c.buf = msg
+			return nil
+		}
+		if err != nil {
+			break
+		}
+
+		c.cmd = req.cmd
+		c.state = stateReply
+		c.sess.setRequest(req)
+
+		if c.admit != nil {
+			if err := c.admit(); err != nil {
+				c.state = stateRelay
+				c.sess.setReply(repNotAllowed)
+				_ = writeReply(c.Conn, repNotAllowed, netip.AddrPort{})
+				return err
+			}
+		}
+
+		if req.cmd == cmdUDPAssociate && c.associate != nil {
+			c.state = stateRelay
+
+			if err := c.associate(c.Conn, req); err != nil {
+				log.Println(err)
+			}
+			return errUDPAssociate
+		}
+
+	default:
+		// the handler expects more data than the protocol defines, give up tracking
+		c.state = stateRelay
+		return nil
+	}
+
+	c.buf = msg
+	return err
+}
+
+func (c *clientConn) Write(p []byte) (int, error) {
+	if c.state != stateRelay {
+		c.track(p)
+		return c.write(p)
+	}
+
+	if !c.limited(download) {
+		return c.write(p)
+	}
+
+	var total int
+	for len(p) > 0 {
+		n, err := c.write(p[:min(len(p), c.shape.chunk(download))])
+		total += n
+		c.shape.wait(download, n)
+
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+	}
+
+	return total, nil
+}
+
+func (c *clientConn) write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.sess.bytesOut.Add(int64(n))
+
+	if err != nil {
+		c.sess.setCloseReason(closeReason(err, "client closed"))
+	}
+
+	return n, err
+}
+
+// track follows server messages to switch handshake state
+func (c *clientConn) track(p []byte) {
+	c.written = append(c.written, p...)
+
+	for len(c.written) > 0 && c.state != stateRelay {
+		n := c.parseServerMessage(c.written)
+		if n == 0 {
+			return // incomplete message
+		}
+		c.written = c.written[n:]
+	}
+
+	c.written = nil
+}
+
+// parseServerMessage handles complete server message and returns its size, or 0 if message is incomplete
+func (c *clientConn) parseServerMessage(msg []byte) int {
+	switch c.state {
+	case stateMethodReply: // VER METHOD
+		if len(msg) < 2 {
+			return 0
+		}
+
+		c.sess.setMethod(msg[1])
+
+		switch msg[1] {
+		case authNone:
+			c.state = stateRequest
+		case authPassword:
+			c.state = stateAuth
+		default:
+			c.state = stateRelay // gssapi encapsulates messages, or no acceptable methods
+		}
+
+		return 2
+
+	case stateAuthReply: // VER STATUS
+		if len(msg) < 2 {
+			return 0
+		}
+
+		c.sess.setAuthenticated(msg[1] == 0)
+
+		c.state = stateRelay
+		if msg[1] == 0 {
+			c.state = stateRequest
+		}
+
+		return 2
+
+	case stateReply: // VER REP RSV ATYP BND.ADDR BND.PORT
+		n := replySize(msg)
+		if n == 0 {
+			return 0
+		}
+
+		c.replies++
+		c.sess.setReply(msg[1])
+
+		c.state = stateRelay
+		if c.cmd == cmdBind && msg[1] == repSucceeded && c.replies == 1 {
+			c.state = stateReply // waiting for the second reply with incoming connection address
+		}
+
+		return n
+	}
+
+	return len(msg)
+}
+
+// ReadFrom relays the remote host data to the client, the relay is finished by the remote host.
+func (c *clientConn) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := c.Conn.(io.ReaderFrom); ok && c.state == stateRelay {
+		return c.readFromLimited(rf, r)
+	}
+
+	n, err := io.Copy(writerOnly{c}, r)
+	c.sess.setCloseReason(closeReason(err, "remote closed"))
+
+	return n, err
+}
+
+// readFromLimited relays the remote host data by chunks limited by bandwidth, the limits are checked again
+// for every chunk and the unlimited data is relayed by large chunks. Every chunk keeps splice fast path.
+func (c *clientConn) readFromLimited(rf io.ReaderFrom, r io.Reader) (int64, error) {
+	var total int64
+
+	for {
+		lr := &io.LimitedReader{R: r, N: int64(c.shape.chunk(download))}
+		n, err := rf.ReadFrom(lr)
+		total += n
+		c.sess.bytesOut.Add(n)
+		c.shape.wait(download, int(n))
+
+		// the chunk is not filled up only if the remote host has finished the relay
+		if err != nil || lr.N > 0 {
+			c.sess.setCloseReason(closeReason(err, "remote closed"))
+			return total, err
+		}
+	}
+}
+
+// WriteTo relays the client data to the remote host, the relay is finished by the client.
+func (c *clientConn) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+
+	if len(c.buf) > 0 {
+		n, err := w.Write(c.buf)
+		total += int64(n)
+		c.buf = c.buf[n:]
+		c.sess.bytesIn.Add(int64(n))
+
+		if err != nil {
+			return total, err
+		}
+	}
+
+	// the data is relayed by chunks while it's not limited, the limits are checked between them
+	if wt, ok := c.Conn.(io.WriterTo); ok && c.state == stateRelay {
+		for !c.limited(upload) {
+			n, err := wt.WriteTo(chunkWriter{w: w, n: unlimitedChunk})
+			total += n
+			c.sess.bytesIn.Add(n)
+
+			if !errors.Is(err, errChunkRelayed) {
+				c.sess.setCloseReason(closeReason(err, "client closed"))
+				return total, err
+			}
+		}
+	}
+
+	// the limited data is relayed by Read
+	n, err := io.Copy(w, readerOnly{c})
+	return total + n, err
+}
+
+// errChunkRelayed stops the copy to chunkWriter once the chunk is relayed
+var errChunkRelayed = errors.New("chunk is relayed")
+
+// chunkWriter takes at most n bytes copied to it, then the copy is stopped by errChunkRelayed.
+// The chunk is relayed by ReadFrom of the destination, so it keeps splice fast path.
+type chunkWriter struct {
+	w io.Writer
+	n int64
+}
+
+// Write is not used by io.Copy preferring ReadFrom, the data is written as is
+func (c chunkWriter) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func (c chunkWriter) ReadFrom(r io.Reader) (int64, error) {
+	lr := &io.LimitedReader{R: r, N: c.n}
+	n, err := io.Copy(c.w, lr)
+	if err == nil && lr.N == 0 {
+		err = errChunkRelayed
+	}
+
+	return n, err
+}
+
+// limited reports whether the relayed data of the direction is limited by bandwidth at the moment
+func (c *clientConn) limited(dir int) bool {
+	return c.shape != nil && c.state == stateRelay && !c.shape.unlimited(dir)
+}
+
+// readerOnly and writerOnly hide ReadFrom/WriteTo methods to avoid recursion in io.Copy
+type readerOnly struct{ io.Reader }
+
+type writerOnly struct{ io.Writer }
+
+// readPrefixed reads the header of size n and the data following it,
+// the last byte of the header is the length of the data.
+func readPrefixed(r io.Reader, n int) ([]byte, error) {
+	header := make([]byte, n)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	size := int(header[n-1])
+	msg := make([]byte, n+size)
+	copy(msg, header)
+
+	if _, err := io.ReadFull(r, msg[n:]); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// readRequest reads socks5 request: VER CMD RSV ATYP DST.ADDR DST.PORT
+func readRequest(r io.Reader) ([]byte, socks5Request, error) {
+	var req socks5Request
+
+	msg := make([]byte, 4, 4+1+255+2)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, req, err
+	}
+
+	req.cmd = msg[1]
+	req.atyp = msg[3]
+
+	addr, err := readAddr(r, req.atyp)
+	if errors.Is(err, errAddrTypeNotSupported) {
+		return msg, req, err
+	}
+	if err != nil {
+		return nil, req, err
+	}
+	msg = append(msg, addr...)
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return nil, req, err
+	}
+	msg = append(msg, port...)
+
+	req.addr = addr
+	if req.atyp == atypDomain {
+		req.addr = addr[1:]
+	}
+	req.port = int(binary.BigEndian.Uint16(port))
+
+	return msg, req, nil
+}
+
+// readAddr reads address of given type, domain is read with the length byte
+func readAddr(r io.Reader, atyp byte) ([]byte, error) {
+	switch atyp {
+	case atypIPv4:
+		addr := make([]byte, net.IPv4len)
+		_, err := io.ReadFull(r, addr)
+		return addr, err
+	case atypIPv6:
+		addr := make([]byte, net.IPv6len)
+		_, err := io.ReadFull(r, addr)
+		return addr, err
+	case atypDomain:
+		return readPrefixed(r, 1)
+	}
+
+	return nil, fmt.Errorf("%w: %d", errAddrTypeNotSupported, atyp)
+}
+
+// replySize returns the size of complete reply message, 0 if the message is incomplete
+func replySize(msg []byte) int {
+	const header = 4
+
+	if len(msg) < header+1 {
+		return 0
+	}
+
+	var n int
+	switch msg[3] {
+	case atypIPv4:
+		n = header + net.IPv4len + 2
+	case atypIPv6:
+		n = header + net.IPv6len + 2
+	case atypDomain:
+		n = header + 1 + int(msg[4]) + 2
+	default:
+		return len(msg) // broken reply, skip it entirely
+	}
+
+	if len(msg) < n {
+		return 0
+	}
+
+	return n
+}
+
+// appendAddr appends socks5 address ATYP ADDR PORT
+func appendAddr(b []byte, addr netip.AddrPort) []byte {
+	ip := addr.Addr().Unmap()
+	if ip.Is4() {
+		b = append(b, atypIPv4)
+	} else {
+		b = append(b, atypIPv6)
+	}
+
+	b = append(b, ip.AsSlice()...)
+	return binary.BigEndian.AppendUint16(b, addr.Port())
+}
+
+// writeReply writes socks5 reply with bound address
+func writeReply(w io.Writer, rep byte, bound netip.AddrPort) error {
+	if !bound.IsValid() {
+		bound = netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+	}
+
+	msg := appendAddr([]byte{socks5Version, rep, 0}, bound)
+	_, err := w.Write(msg)
+
+	return err
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+// fakeHandler serves socks5 handshake the simple way: reads exactly expected messages
+// and replies with the given method and reply code
+func fakeHandler(conn net.Conn, method, rep byte) error {
+	if _, err := readPrefixed(conn, 2); err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return err
+	}
+
+	if method == authPassword {
+		if _, err := readPrefixed(conn, 2); err != nil {
+			return err
+		}
+		if _, err := readPrefixed(conn, 1); err != nil {
+			return err
+		}
+		if _, err := conn.Write([]byte{1, 0}); err != nil {
+			return err
+		}
+	}
+
+	if _, _, err := readRequest(conn); err != nil {
+		return err
+	}
+
+	// the reply is written by parts to check tracking of incomplete messages
+	var reply bytes.Buffer
+	_ = writeReply(&reply, rep, netip.MustParseAddrPort("1.2.3.4:80"))
+	for _, b := range reply.Bytes() {
+		if _, err := conn.Write([]byte{b}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func Test_clientConn_handshake(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  byte
+		client  []byte
+		wantReq string
+		wantRep int
+	}{
+		{
+			name:    "no auth",
+			method:  authNone,
+			client:  []byte{5, 1, 0, 5, 1, 0, 1, 8, 8, 8, 8, 0, 53},
+			wantReq: "8.8.8.8:53",
+			wantRep: repSucceeded,
+		},
+		{
+			name:   "password",
+			method: authPassword,
+			client: []byte{
+				5, 1, 2,
+				1, 4, 'u', 's', 'e', 'r', 4, 'p', 'a', 's', 's',
+				5, 1, 0, 3, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 1, 187,
+			},
+			wantReq: "example.com:443",
+			wantRep: repNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+
+			sess := newSession(nil)
+			conn := &clientConn{Conn: server, sess: sess}
+
+			errc := make(chan error, 1)
+			go func() {
+				errc <- fakeHandler(conn, tt.method, byte(tt.wantRep)) // nolint
+				_ = conn.Close()
+			}()
+
+			go func() {
+				_, _ = client.Write(tt.client)
+			}()
+			_, _ = io.Copy(io.Discard, client)
+
+			if err := <-errc; err != nil {
+				t.Fatalf("handler error = %v", err)
+			}
+			if got := sess.request.String(); got != tt.wantReq {
+				t.Errorf("request = %s, want %s", got, tt.wantReq)
+			}
+			if sess.reply != tt.wantRep {
+				t.Errorf("reply = %d, want %d", sess.reply, tt.wantRep)
+			}
+			if conn.state != stateRelay {
+				t.Errorf("state = %d, want relay", conn.state)
+			}
+			if method, auth := sess.handshake(); method != int(tt.method) || auth != authSucceeded {
+				t.Errorf("handshake = %d, %d, want %d, %d", method, auth, tt.method, authSucceeded)
+			}
+			if got := sess.bytesIn.Load(); got != int64(len(tt.client)) {
+				t.Errorf("bytes in = %d, want %d", got, len(tt.client))
+			}
+			if sess.bytesOut.Load() == 0 {
+				t.Error("bytes out = 0")
+			}
+		})
+	}
+}
+
+func Test_clientConn_associate(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	sess := newSession(nil)
+
+	var got socks5Request
+	conn := &clientConn{
+		Conn: server,
+		sess: sess,
+		associate: func(ctrl net.Conn, req socks5Request) error {
+			got = req
+			return writeReply(ctrl, repSucceeded, netip.MustParseAddrPort("127.0.0.1:5000"))
+		},
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- fakeHandler(conn, authNone, repCommandNotSupported)
+		_ = conn.Close()
+	}()
+
+	go func() {
+		_, _ = client.Write([]byte{5, 1, 0, 5, 3, 0, 1, 0, 0, 0, 0, 0x13, 0x88})
+	}()
+
+	reply, _ := io.ReadAll(client)
+	want := []byte{5, 0, 5, 0, 0, 1, 127, 0, 0, 1, 0x13, 0x88}
+	if !bytes.Equal(reply, want) {
+		t.Errorf("reply = %v, want %v", reply, want)
+	}
+
+	if err := <-errc; !errors.Is(err, errUDPAssociate) {
+		t.Errorf("handler error = %v, want %v", err, errUDPAssociate)
+	}
+	if got.cmd != cmdUDPAssociate || got.port != 5000 {
+		t.Errorf("associate request = %+v", got)
+	}
+	if sess.command() != cmdUDPAssociate {
+		t.Errorf("session command = %d, want %d", sess.command(), cmdUDPAssociate)
+	}
+}
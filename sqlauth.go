@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite" // sqlite driver
+)
+
+const sqlAuthQuery = "SELECT password FROM users WHERE username = ?"
+
+// databases are shared between config reloads, so every dsn is opened once
+var (
+	sqlDBMu sync.Mutex
+	sqlDBs  = make(map[string]*sql.DB)
+)
+
+// sqlAuth checks credentials by SQL query that returns bcrypt or argon2id password hash of the user
+type sqlAuth struct {
+	db      *sql.DB
+	query   string
+	timeout time.Duration
+}
+
+func newSQLAuth(cfg sqlConfig, timeout time.Duration) (sqlAuth, error) {
+	query := cfg.Query
+	if query == "" {
+		query = sqlAuthQuery
+	}
+
+	db, err := openDB(cfg)
+	if err != nil {
+		return sqlAuth{}, err
+	}
+
+	return sqlAuth{
+		db:      db,
+		query:   query,
+		timeout: timeout,
+	}, nil
+}
+
+func openDB(cfg sqlConfig) (*sql.DB, error) {
+	sqlDBMu.Lock()
+	defer sqlDBMu.Unlock()
+
+	driver, key := sqlDB(cfg)
+	if db, ok := sqlDBs[key]; ok {
+		return db, nil
+	}
+
+	db, err := sql.Open(driver, cfg.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("open %s database: %w", driver, err)
+	}
+
+	sqlDBs[key] = db
+	return db, nil
+}
+
+// sqlDB returns the driver and the key of shared database
+func sqlDB(cfg sqlConfig) (string, string) {
+	driver := cfg.Driver
+	if driver == "" {
+		driver = "sqlite"
+	}
+
+	return driver, driver + ":" + cfg.DSN
+}
+
+// closeUnusedDBs closes the databases no longer used by sql auth backends of the config, it's called
+// after config reload
+func closeUnusedDBs(cfg config) {
+	backends := slices.Clone(cfg.Auth)
+	for _, l := range cfg.Listeners {
+		backends = append(backends, cfg.listener(l).Auth...)
+	}
+
+	used := make(map[string]bool)
+	for _, b := range backends {
+		if b.Type == authSQL {
+			_, key := sqlDB(b.SQL)
+			used[key] = true
+		}
+	}
+
+	sqlDBMu.Lock()
+	defer sqlDBMu.Unlock()
+
+	for key, db := range sqlDBs {
+		if !used[key] {
+			_ = db.Close()
+			delete(sqlDBs, key)
+		}
+	}
+}
+
+func (a sqlAuth) authenticate(username, password []byte) error {
+	if len(username) == 0 || len(password) == 0 {
+		return errDenied
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+
+	var encoded string
+	err := a.db.QueryRowContext(ctx, a.query, string(username)).Scan(&encoded)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errDenied
+	}
+	if err != nil {
+		return fmt.Errorf("sql auth: %w", err)
+	}
+
+	hash, err := parsePasswordHash(encoded)
+	if err != nil {
+		return fmt.Errorf("sql auth: user %q: %w", username, err)
+	}
+
+	if !hash.verify(password) {
+		return errDenied
+	}
+
+	return nil
+}
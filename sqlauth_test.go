@@ -0,0 +1,99 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_sqlAuth(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "users.db")
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer db.Close()
+
+	hash := strings.TrimSpace(strings.TrimPrefix(bcryptEntry(t, "alice", "1234"), "alice:"))
+	stmts := []string{
+		"CREATE TABLE users (username TEXT PRIMARY KEY, password TEXT NOT NULL)",
+		"INSERT INTO users VALUES ('alice', '" + hash + "')",
+		"INSERT INTO users VALUES ('bob', 'plaintext')",
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+
+	a, err := newSQLAuth(sqlConfig{DSN: dsn}, time.Second)
+	if err != nil {
+		t.Fatalf("failed to init sql auth: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		username    string
+		password    string
+		expectedErr error
+		wantErr     bool
+	}{
+		{name: "valid user", username: "alice", password: "1234"},
+		{name: "invalid password", username: "alice", password: "4321", expectedErr: errDenied, wantErr: true},
+		{name: "non-existent user", username: "nobody", password: "1234", expectedErr: errDenied, wantErr: true},
+		{name: "sql injection", username: "' OR '1'='1", password: "1234", expectedErr: errDenied, wantErr: true},
+		{name: "unsupported hash", username: "bob", password: "plaintext", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := a.authenticate([]byte(tt.username), []byte(tt.password))
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("did not expect an error, got: %v", err)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("expected an error, got nil")
+			}
+			if tt.expectedErr != nil && !errors.Is(err, tt.expectedErr) {
+				t.Errorf("expected error %v, got %v", tt.expectedErr, err)
+			}
+		})
+	}
+}
+
+func Test_closeUnusedDBs(t *testing.T) {
+	kept := sqlConfig{DSN: filepath.Join(t.TempDir(), "kept.db")}
+	removed := sqlConfig{DSN: filepath.Join(t.TempDir(), "removed.db")}
+
+	keptDB, err := openDB(kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removedDB, err := openDB(removed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := defaultConfig()
+	cfg.Auth = []authBackendConfig{{Type: authSQL, SQL: kept}}
+	closeUnusedDBs(cfg)
+	t.Cleanup(func() { closeUnusedDBs(defaultConfig()) })
+
+	if err := keptDB.Ping(); err != nil {
+		t.Errorf("used database is closed: %v", err)
+	}
+	if err := removedDB.Ping(); err == nil {
+		t.Error("unused database is not closed")
+	}
+	if db, _ := openDB(kept); db != keptDB {
+		t.Error("used database is opened again")
+	}
+}
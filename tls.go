@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// tls settings, see tls section of config
+const (
+	tlsVersion12 = "1.2"
+	tlsVersion13 = "1.3"
+
+	tlsClientRequire  = "require"
+	tlsClientOptional = "optional"
+
+	tlsUserCN    = "cn"
+	tlsUserEmail = "email"
+	tlsUserDNS   = "dns"
+	tlsUserURI   = "uri"
+)
+
+// tlsHandshakeTimeout is max time of tls handshake of the client
+const tlsHandshakeTimeout = 10 * time.Second
+
+var errNoCertUser = errors.New("client certificate has no username")
+
+// serverTLS is tls of client connections, the certificate files are read again on config reload
+type serverTLS struct {
+	config     *tls.Config
+	clientUser string // the field of client certificate the username is taken from
+	noAuth     bool   // the clients with verified certificate skip authentication
+}
+
+// newServerTLS loads the certificates, it returns nil if tls is disabled
+func newServerTLS(cfg tlsConfig) (*serverTLS, error) {
+	if cfg.Cert == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+	if err != nil {
+		return nil, fmt.Errorf("tls.cert: %w", err)
+	}
+
+	t := &serverTLS{
+		config: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+			NextProtos:   cfg.ALPN,
+		},
+		clientUser: cfg.ClientUser,
+		noAuth:     cfg.NoAuth,
+	}
+
+	if cfg.MinVersion == tlsVersion13 {
+		t.config.MinVersion = tls.VersionTLS13
+	}
+
+	if cfg.ClientCA == "" {
+		return t, nil
+	}
+
+	pem, err := os.ReadFile(cfg.ClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("tls.client_ca: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("tls.client_ca: no certificates found in %s", cfg.ClientCA)
+	}
+
+	t.config.ClientCAs = pool
+	t.config.ClientAuth = tls.RequireAndVerifyClientCert
+	if cfg.ClientAuth == tlsClientOptional {
+		t.config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	// the certificate not mapped to the user is useless
+	t.config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.VerifiedChains) > 0 && t.username(cs.PeerCertificates[0]) == "" {
+			return errNoCertUser
+		}
+		return nil
+	}
+
+	return t, nil
+}
+
+// handshake runs tls handshake of the client, it returns the username of verified client certificate if any
+func (t *serverTLS) handshake(ctx context.Context, conn net.Conn) (*tls.Conn, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+	defer cancel()
+
+	tlsConn := tls.Server(conn, t.config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		countTLSHandshake(false)
+		return nil, "", fmt.Errorf("tls handshake: %w", err)
+	}
+	countTLSHandshake(true)
+
+	cs := tlsConn.ConnectionState()
+	if len(cs.VerifiedChains) == 0 {
+		return tlsConn, "", nil
+	}
+
+	return tlsConn, t.username(cs.PeerCertificates[0]), nil
+}
+
+// username returns the subject common name or the first subject alternative name of the type
+func (t *serverTLS) username(cert *x509.Certificate) string {
+	switch t.clientUser {
+	case tlsUserEmail:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case tlsUserDNS:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case tlsUserURI:
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	default:
+		return cert.Subject.CommonName
+	}
+
+	return ""
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA issues the certificates of the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string // PEM file of CA certificate
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	writePEM(t, file, "CERTIFICATE", der)
+
+	return &testCA{cert: cert, key: key, file: file}
+}
+
+// issue returns the certificate of the template signed by CA
+func (ca *testCA) issue(t *testing.T, tmpl *x509.Certificate) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writeKeyPair writes the certificate and its key to PEM files
+func writeKeyPair(t *testing.T, cert tls.Certificate) (string, string) {
+	t.Helper()
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writePEM(t, certFile, "CERTIFICATE", cert.Certificate[0])
+	writePEM(t, keyFile, "PRIVATE KEY", keyDER)
+
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, file, blockType string, der []byte) {
+	t.Helper()
+
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_server_serve_tls(t *testing.T) {
+	echo := startEchoServer(t)
+	ca := newTestCA(t)
+
+	serverCert := ca.issue(t, &x509.Certificate{DNSNames: []string{"proxy.test"}})
+	certFile, keyFile := writeKeyPair(t, serverCert)
+
+	cfg := defaultConfig()
+	cfg.Egress.Enable = false
+	cfg.TLS = tlsConfig{
+		Cert:     certFile,
+		Key:      keyFile,
+		ClientCA: ca.file,
+		NoAuth:   true,
+	}
+	proxy := startServer(t, cfg, (*server).ListenAndServe)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	tests := []struct {
+		name        string
+		clientCerts []tls.Certificate
+		wantReply   byte
+		wantErr     bool
+	}{
+		{
+			name:        "client certificate",
+			clientCerts: []tls.Certificate{ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}})},
+			wantReply:   socks4Granted,
+		},
+		{
+			name:    "no client certificate",
+			wantErr: true,
+		},
+		{
+			name:        "certificate without username",
+			clientCerts: []tls.Certificate{ca.issue(t, &x509.Certificate{})},
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := tls.Dial("tcp", proxy, &tls.Config{
+				ServerName:   "proxy.test",
+				RootCAs:      roots,
+				Certificates: tt.clientCerts,
+				MinVersion:   tls.VersionTLS12,
+			})
+			if err != nil {
+				if !tt.wantErr {
+					t.Fatal(err)
+				}
+				return
+			}
+			defer conn.Close()
+
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			request := append([]byte{socks4Version, cmdConnect, byte(echo >> 8), byte(echo), 0, 0, 0, 1}, "\x00localhost\x00"...)
+			_, err = conn.Write(request)
+
+			reply := make([]byte, socks4ReplySize)
+			if err == nil {
+				_, err = io.ReadFull(conn, reply)
+			}
+
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("reply = %v, want tls error", reply)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply[1] != tt.wantReply {
+				t.Fatalf("reply = %v, want %d", reply, tt.wantReply)
+			}
+			if got := exchange(t, conn, []byte("ping"), 4); string(got) != "ping" {
+				t.Errorf("relayed %q", got)
+			}
+		})
+	}
+
+	// the plain client doesn't get the reply
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte{socks4Version, cmdConnect, 0, 80, 127, 0, 0, 1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if reply, _ := io.ReadAll(conn); len(reply) >= socks4ReplySize && reply[0] == socks4ReplyVer {
+		t.Errorf("plain client got socks4 reply %v", reply)
+	}
+}
+
+func Test_serverTLS_username(t *testing.T) {
+	uri, _ := url.Parse("spiffe://example.com/proxy-client")
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "alice"},
+		EmailAddresses: []string{"alice@example.com"},
+		DNSNames:       []string{"alice.example.com"},
+		URIs:           []*url.URL{uri},
+	}
+
+	tests := []struct {
+		clientUser string
+		cert       *x509.Certificate
+		want       string
+	}{
+		{clientUser: "", cert: cert, want: "alice"},
+		{clientUser: tlsUserCN, cert: cert, want: "alice"},
+		{clientUser: tlsUserEmail, cert: cert, want: "alice@example.com"},
+		{clientUser: tlsUserDNS, cert: cert, want: "alice.example.com"},
+		{clientUser: tlsUserURI, cert: cert, want: "spiffe://example.com/proxy-client"},
+		{clientUser: tlsUserEmail, cert: &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}}, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.clientUser, func(t *testing.T) {
+			st := &serverTLS{clientUser: tt.clientUser}
+			if got := st.username(tt.cert); got != tt.want {
+				t.Errorf("username() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_newServerTLS_errors(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := writeKeyPair(t, ca.issue(t, &x509.Certificate{DNSNames: []string{"proxy.test"}}))
+
+	tests := []struct {
+		name    string
+		cfg     tlsConfig
+		wantErr string
+	}{
+		{
+			name:    "missing certificate",
+			cfg:     tlsConfig{Cert: filepath.Join(t.TempDir(), "cert.pem"), Key: keyFile},
+			wantErr: "tls.cert: open",
+		},
+		{
+			name:    "key of other certificate",
+			cfg:     tlsConfig{Cert: ca.file, Key: keyFile},
+			wantErr: "tls.cert: tls: private key does not match public key",
+		},
+		{
+			name:    "client ca without certificates",
+			cfg:     tlsConfig{Cert: certFile, Key: keyFile, ClientCA: keyFile},
+			wantErr: "tls.client_ca: no certificates found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newServerTLS(tt.cfg)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("newServerTLS() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if st, err := newServerTLS(tlsConfig{}); st != nil || err != nil {
+		t.Errorf("newServerTLS(disabled) = %v, %v, want nil", st, err)
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxDatagramSize = 65535
+	maxUDPTargets   = 1024 // max number of remote addresses remembered by the association
+	maxUDPPending   = 16   // max datagrams queued for the destination domain being resolved
+)
+
+var errFragmented = errors.New("fragmented datagrams are not supported")
+
+// udpDatagram is socks5 UDP request: RSV FRAG ATYP DST.ADDR DST.PORT DATA
+type udpDatagram struct {
+	frag byte
+	dst  socks5Request
+	data []byte
+}
+
+func parseUDPDatagram(b []byte) (udpDatagram, error) {
+	const header = 3 // RSV FRAG
+
+	var dg udpDatagram
+	if len(b) < header+1 {
+		return dg, io.ErrUnexpectedEOF
+	}
+
+	dg.frag = b[2]
+	if dg.frag != 0 {
+		return dg, errFragmented
+	}
+
+	// the rest of datagram looks like request without VER CMD RSV fields
+	r := bytes.NewReader(b[header:])
+	atyp, _ := r.ReadByte()
+
+	addr, err := readAddr(r, atyp)
+	if err != nil {
+		return dg, err
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return dg, err
+	}
+
+	dg.dst = socks5Request{
+		cmd:  cmdUDPAssociate,
+		atyp: atyp,
+		addr: addr,
+		port: int(port[0])<<8 | int(port[1]),
+	}
+	if atyp == atypDomain {
+		dg.dst.addr = addr[1:]
+	}
+
+	dg.data = b[len(b)-r.Len():]
+
+	return dg, nil
+}
+
+// appendUDPHeader appends socks5 UDP request header with the source address of the remote host
+func appendUDPHeader(b []byte, from netip.AddrPort) []byte {
+	return appendAddr(append(b, 0, 0, 0), from)
+}
+
+// udpRelay serves UDP ASSOCIATE requests, the destinations are checked by the same rules as CONNECT
+type udpRelay struct {
+	connector   connector
+	idleTimeout time.Duration // the association is closed if there are no datagrams during this time
+}
+
+// serve relays datagrams between the client and the remote hosts until the control connection is closed
+// or the association becomes idle.
+func (r *udpRelay) serve(ctrl net.Conn, sess *session, req socks5Request) error {
+	clientAddr := addrPortOf(ctrl.RemoteAddr())
+	localAddr := addrPortOf(ctrl.LocalAddr())
+
+	// the client side socket is bound to the same ip the client has connected to
+	client, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(localAddr.Addr(), 0)))
+	if err != nil {
+		_ = writeReply(ctrl, repGeneralFailure, netip.AddrPort{})
+		return fmt.Errorf("udp associate: %w", err)
+	}
+	defer client.Close()
+
+	remote, err := r.connector.outbound.listenUDP(sess)
+	if err != nil {
+		_ = writeReply(ctrl, repGeneralFailure, netip.AddrPort{})
+		return fmt.Errorf("udp associate: %w", err)
+	}
+	defer remote.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := &udpAssociation{
+		ctx:        ctx,
+		relay:      r,
+		sess:       sess,
+		ctrl:       ctrl,
+		client:     client,
+		remote:     remote,
+		clientIP:   clientAddr.Addr(),
+		clientPort: uint16(req.port), // nolint: the client may specify the port it sends datagrams from
+		targets:    make(map[netip.AddrPort]struct{}),
+		resolved:   make(map[string]netip.AddrPort),
+		pending:    make(map[string][][]byte),
+	}
+	a.touch()
+
+	bound := netip.AddrPortFrom(localAddr.Addr(), addrPortOf(client.LocalAddr()).Port())
+	if err := writeReply(ctrl, repSucceeded, bound); err != nil {
+		return err
+	}
+	sess.setReply(repSucceeded)
+
+	fromClient, fromRemote := make(chan any), make(chan any)
+	go func() {
+		defer close(fromClient)
+		a.clientToRemote()
+	}()
+	go func() {
+		defer close(fromRemote)
+		a.remoteToClient()
+	}()
+
+	a.watch()
+
+	// the pending resolves are canceled and waited for, they must not write to the closed remote socket
+	cancel()
+	_ = client.Close()
+	<-fromClient
+	a.resolving.Wait()
+
+	_ = remote.Close()
+	<-fromRemote
+
+	return nil
+}
+
+// udpAssociation is a single UDP ASSOCIATE relay
+type udpAssociation struct {
+	ctx   context.Context // canceled when the association is closed
+	relay *udpRelay
+	sess  *session
+	ctrl  net.Conn // control tcp connection, the association lives until it is closed
+
+	client *net.UDPConn // client side socket
+	remote *net.UDPConn // remote hosts side socket
+
+	clientIP   netip.Addr // datagrams from other addresses are dropped
+	lastActive atomic.Int64
+	resolving  sync.WaitGroup // resolvePending goroutines, added by clientToRemote only
+
+	mu         sync.Mutex
+	clientPort uint16                      // 0 until the first datagram if the client doesn't specify it
+	targets    map[netip.AddrPort]struct{} // remote addresses the client sent datagrams to, only they may reply
+	resolved   map[string]netip.AddrPort   // allowed destinations, invalid address means denied one
+	pending    map[string][][]byte         // datagrams waiting for their destination domain being resolved
+}
+
+func (a *udpAssociation) touch() {
+	a.lastActive.Store(time.Now().UnixNano())
+}
+
+func (a *udpAssociation) idle() bool {
+	return time.Since(time.Unix(0, a.lastActive.Load())) >= a.relay.idleTimeout
+}
+
+// watch blocks until the control connection is closed
+func (a *udpAssociation) watch() {
+	buf := make([]byte, 512)
+
+	for {
+		if _, err := a.ctrl.Read(buf); err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() && !a.idle() {
+				continue
+			}
+
+			a.sess.setCloseReason(closeReason(err, "client closed"))
+			return
+		}
+	}
+}
+
+func (a *udpAssociation) clientToRemote() {
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		_ = a.client.SetReadDeadline(time.Now().Add(a.relay.idleTimeout))
+
+		n, from, err := a.client.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				if a.idle() {
+					a.sess.setCloseReason("idle timeout")
+					_ = a.ctrl.Close() // stops the association
+					return
+				}
+				continue
+			}
+
+			return
+		}
+
+		if !a.fromClient(from) {
+			continue
+		}
+
+		dg, err := parseUDPDatagram(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		// the domains are resolved aside, a slow lookup doesn't stall the datagrams to other destinations
+		if dg.dst.atyp == atypDomain {
+			a.sendDomain(dg)
+			continue
+		}
+
+		if target, ok := a.target(dg.dst); ok {
+			a.send(target, dg.data)
+		}
+	}
+}
+
+// sendDomain sends the datagram to the resolved destination domain. The datagrams of the domain not resolved yet
+// are queued until it's resolved.
+func (a *udpAssociation) sendDomain(dg udpDatagram) {
+	key := dg.dst.String()
+
+	a.mu.Lock()
+	target, resolved := a.resolved[key]
+	queue, resolving := a.pending[key]
+
+	switch {
+	case resolved:
+	case resolving && len(queue) < maxUDPPending:
+		a.pending[key] = append(queue, bytes.Clone(dg.data))
+	case !resolving && len(a.pending) < maxUDPTargets:
+		a.pending[key] = [][]byte{bytes.Clone(dg.data)}
+		a.resolving.Add(1)
+		go func() {
+			defer a.resolving.Done()
+			a.resolvePending(dg.dst)
+		}()
+	}
+	a.mu.Unlock()
+
+	if target.IsValid() {
+		a.send(target, dg.data)
+	}
+}
+
+// resolvePending resolves the destination and sends the datagrams queued for it
+func (a *udpAssociation) resolvePending(dst socks5Request) {
+	target, ok := a.target(dst)
+
+	key := dst.String()
+	a.mu.Lock()
+	queue := a.pending[key]
+	delete(a.pending, key)
+	a.mu.Unlock()
+
+	if !ok || a.ctx.Err() != nil {
+		return
+	}
+
+	for _, data := range queue {
+		a.send(target, data)
+	}
+}
+
+func (a *udpAssociation) send(target netip.AddrPort, data []byte) {
+	a.touch()
+	a.sess.bytesIn.Add(int64(len(data)))
+	_, _ = a.remote.WriteToUDPAddrPort(data, target)
+}
+
+func (a *udpAssociation) remoteToClient() {
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		n, from, err := a.remote.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+
+		a.mu.Lock()
+		_, ok := a.targets[from]
+		clientPort := a.clientPort
+		a.mu.Unlock()
+
+		if !ok || clientPort == 0 {
+			continue
+		}
+
+		a.touch()
+		a.sess.bytesOut.Add(int64(n))
+		msg := append(appendUDPHeader(make([]byte, 0, n+32), from), buf[:n]...)
+		_, _ = a.client.WriteToUDPAddrPort(msg, netip.AddrPortFrom(a.clientIP, clientPort))
+	}
+}
+
+// fromClient reports whether the datagram is sent by the client
+func (a *udpAssociation) fromClient(from netip.AddrPort) bool {
+	if from.Addr().Unmap() != a.clientIP {
+		return false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.clientPort == 0 {
+		a.clientPort = from.Port()
+	}
+
+	return a.clientPort == from.Port()
+}
+
+// target resolves and authorizes the destination of datagram
+func (a *udpAssociation) target(dst socks5Request) (netip.AddrPort, bool) {
+	key := dst.String()
+
+	a.mu.Lock()
+	target, ok := a.resolved[key]
+	a.mu.Unlock()
+
+	if ok {
+		return target, target.IsValid()
+	}
+
+	c := a.relay.connector
+	ctx, cancel := context.WithTimeout(a.ctx, c.timeout)
+	defer cancel()
+
+	// datagrams are sent to the first allowed address of preferred family, the denied domains are not resolved
+	var (
+		domain string
+		ips    []net.IP
+		err    error
+	)
+	if dst.atyp == atypDomain {
+		err = c.authorizeDomain(a.sess, string(dst.addr), dst.port)
+	}
+	if err == nil {
+		domain, ips, err = c.resolve(ctx, int(dst.atyp), dst.addr)
+	}
+	if err == nil {
+		ips, err = c.authorize(a.sess, domain, ips, dst.port)
+	}
+	if err != nil {
+		log.Println("udp associate:", err)
+	} else {
+		addr, _ := netip.AddrFromSlice(ips[0])
+		target = netip.AddrPortFrom(addr.Unmap(), uint16(dst.port)) // nolint
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.resolved) >= maxUDPTargets {
+		clear(a.resolved)
+	}
+	a.resolved[key] = target
+
+	if target.IsValid() {
+		if len(a.targets) >= maxUDPTargets {
+			clear(a.targets)
+		}
+		a.targets[target] = struct{}{}
+	}
+
+	return target, target.IsValid()
+}
+
+// addrPortOf returns ip:port of tcp or udp address
+func addrPortOf(addr net.Addr) netip.AddrPort {
+	var ap netip.AddrPort
+
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ap = a.AddrPort()
+	case *net.UDPAddr:
+		ap = a.AddrPort()
+	}
+
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
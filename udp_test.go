@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func Test_parseUDPDatagram(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      []byte
+		wantDst  string
+		wantData []byte
+		wantErr  error
+	}{
+		{
+			name:     "ipv4",
+			msg:      []byte{0, 0, 0, 1, 8, 8, 8, 8, 0, 53, 'h', 'i'},
+			wantDst:  "8.8.8.8:53",
+			wantData: []byte("hi"),
+		},
+		{
+			name:     "domain",
+			msg:      []byte{0, 0, 0, 3, 4, 'h', 'o', 's', 't', 0, 80, 'x'},
+			wantDst:  "host:80",
+			wantData: []byte("x"),
+		},
+		{
+			name:     "empty data",
+			msg:      []byte{0, 0, 0, 1, 1, 1, 1, 1, 0, 53},
+			wantDst:  "1.1.1.1:53",
+			wantData: []byte{},
+		},
+		{
+			name:    "fragmented",
+			msg:     []byte{0, 0, 1, 1, 8, 8, 8, 8, 0, 53},
+			wantErr: errFragmented,
+		},
+		{
+			name:    "short",
+			msg:     []byte{0, 0, 0, 1, 8, 8},
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "unknown address type",
+			msg:     []byte{0, 0, 0, 9, 8, 8, 8, 8, 0, 53},
+			wantErr: errAddrTypeNotSupported,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dg, err := parseUDPDatagram(tt.msg)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseUDPDatagram() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if dg.dst.String() != tt.wantDst {
+				t.Errorf("dst = %s, want %s", dg.dst, tt.wantDst)
+			}
+			if !bytes.Equal(dg.data, tt.wantData) {
+				t.Errorf("data = %q, want %q", dg.data, tt.wantData)
+			}
+		})
+	}
+}
+
+func Test_appendUDPHeader(t *testing.T) {
+	for _, addr := range []string{"1.2.3.4:53", "[2001:db8::1]:443"} {
+		from := netip.MustParseAddrPort(addr)
+		msg := append(appendUDPHeader(nil, from), "data"...)
+
+		dg, err := parseUDPDatagram(msg)
+		if err != nil {
+			t.Fatalf("parseUDPDatagram() error = %v", err)
+		}
+		if dg.dst.String() != from.String() || string(dg.data) != "data" {
+			t.Errorf("parseUDPDatagram() = %s %q, want %s %q", dg.dst, dg.data, from, "data")
+		}
+	}
+}
+
+func Test_udpRelay(t *testing.T) {
+	// loopback destinations are blocked by default egress guard
+	cfg, err := loadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Egress.Enable = false
+
+	rt, err := newRouting(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dialer, err := newConnector(cfg, rt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay := &udpRelay{connector: dialer, idleTimeout: time.Second}
+
+	// the domain is resolved after the datagrams to other destinations are relayed
+	release := make(chan any)
+	dialer.resolver.resolver = fakeResolver{
+		fnLookupIP: func(context.Context, string, string) ([]net.IP, error) {
+			<-release
+			return []net.IP{net.IPv4(127, 0, 0, 1)}, nil
+		},
+	}
+
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := echo.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteToUDPAddrPort(buf[:n], from)
+		}
+	}()
+
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		ctrl, err := ls.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer ctrl.Close()
+		done <- relay.serve(ctrl, newSession(ctrl.RemoteAddr()), socks5Request{cmd: cmdUDPAssociate})
+	}()
+
+	ctrl, err := net.Dial("tcp", ls.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(ctrl, reply); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if reply[1] != repSucceeded {
+		t.Fatalf("reply code = %d", reply[1])
+	}
+	bound := netip.AddrPortFrom(netip.AddrFrom4([4]byte(reply[4:8])), uint16(reply[8])<<8|uint16(reply[9]))
+
+	client, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(bound))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	target := addrPortOf(echo.LocalAddr())
+	domain := append([]byte{0, 0, 0, atypDomain, byte(len("echo.test"))}, "echo.test"...)
+	domain = append(domain, byte(target.Port()>>8), byte(target.Port()))
+
+	for _, msg := range [][]byte{
+		append(domain, "pong"...),
+		append(appendUDPHeader(nil, target), "ping"...),
+	} {
+		if _, err := client.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, want := range []string{"ping", "pong"} {
+		_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 1024)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("read datagram: %v", err)
+		}
+
+		dg, err := parseUDPDatagram(buf[:n])
+		if err != nil {
+			t.Fatalf("parseUDPDatagram() error = %v", err)
+		}
+		if dg.dst.String() != target.String() || string(dg.data) != want {
+			t.Errorf("got %s %q, want %s %q", dg.dst, dg.data, target, want)
+		}
+
+		if want == "ping" {
+			close(release)
+		}
+	}
+
+	// closing control connection stops the association
+	_ = ctrl.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("serve() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("association is not closed")
+	}
+}
+
+func Test_udpRelay_closeResolving(t *testing.T) {
+	cfg, err := loadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt, err := newRouting(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dialer, err := newConnector(cfg, rt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay := &udpRelay{connector: dialer, idleTimeout: time.Minute}
+
+	// the lookup hangs until the association is closed
+	started, returned := make(chan any), make(chan any)
+	dialer.resolver.resolver = fakeResolver{
+		fnLookupIP: func(ctx context.Context, _, _ string) ([]net.IP, error) {
+			close(started)
+			defer close(returned)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		ctrl, err := ls.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer ctrl.Close()
+		done <- relay.serve(ctrl, newSession(ctrl.RemoteAddr()), socks5Request{cmd: cmdUDPAssociate})
+	}()
+
+	ctrl, err := net.Dial("tcp", ls.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(ctrl, reply); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	bound := netip.AddrPortFrom(netip.AddrFrom4([4]byte(reply[4:8])), uint16(reply[8])<<8|uint16(reply[9]))
+
+	client, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(bound))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	msg := append([]byte{0, 0, 0, atypDomain, byte(len("slow.test"))}, "slow.test"...)
+	if _, err := client.Write(append(msg, 0, 53, 'q')); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("domain is not resolved")
+	}
+
+	_ = ctrl.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("association waits for the lookup")
+	}
+
+	select {
+	case <-returned:
+	default:
+		t.Error("association is closed before the lookup is finished")
+	}
+}
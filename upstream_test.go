@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dblokhin/proxyme"
+)
+
+// fakeParent serves the connections by handler and returns its address
+func fakeParent(t *testing.T, handler func(conn net.Conn)) string {
+	t.Helper()
+
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ls.Close() })
+
+	go func() {
+		for {
+			conn, err := ls.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handler(conn)
+			}()
+		}
+	}()
+
+	return ls.Addr().String()
+}
+
+// fakeSOCKS5Parent accepts alice:secret and replies rep, the destination is sent to the client on success
+func fakeSOCKS5Parent(t *testing.T, rep byte) string {
+	return fakeParent(t, func(conn net.Conn) {
+		greeting, err := readPrefixed(conn, 2)
+		if err != nil || greeting[2] != authPassword {
+			_, _ = conn.Write([]byte{socks5Version, authNoAcceptable})
+			return
+		}
+		_, _ = conn.Write([]byte{socks5Version, authPassword})
+
+		user, err := readPrefixed(conn, 2)
+		if err != nil {
+			return
+		}
+		password, err := readPrefixed(conn, 1)
+		if err != nil || string(user[2:]) != "alice" || string(password[1:]) != "secret" {
+			_, _ = conn.Write([]byte{1, 1})
+			return
+		}
+		_, _ = conn.Write([]byte{1, 0})
+
+		_, req, err := readRequest(conn)
+		if err != nil {
+			return
+		}
+		_ = writeReply(conn, rep, conn.LocalAddr().(*net.TCPAddr).AddrPort())
+		_, _ = io.WriteString(conn, req.String())
+	})
+}
+
+// fakeHTTPParent accepts alice:secret and replies status, the destination is sent to the client on success
+func fakeHTTPParent(t *testing.T, status int) string {
+	return fakeParent(t, func(conn net.Conn) {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+
+		code := status
+		user, password, ok := parseProxyAuth(req.Header.Get("Proxy-Authorization"))
+		if req.Method != http.MethodConnect || !ok || user != "alice" || password != "secret" {
+			code = http.StatusProxyAuthRequired
+		}
+
+		_, _ = fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n\r\n", code, http.StatusText(code))
+		if code == http.StatusOK {
+			_, _ = io.WriteString(conn, req.Host)
+		}
+	})
+}
+
+func parseProxyAuth(header string) (string, string, bool) {
+	req := &http.Request{Header: http.Header{"Authorization": {header}}}
+	return req.BasicAuth()
+}
+
+// closedAddr returns the address nobody listens on
+func closedAddr(t *testing.T) string {
+	t.Helper()
+
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ls.Addr().String()
+	_ = ls.Close()
+
+	return addr
+}
+
+// directDialer connects to the parents from the system default source address
+func directDialer(net.IP) (*net.Dialer, error) {
+	return &net.Dialer{}, nil
+}
+
+func newTestUpstream(t *testing.T, proxies ...string) *upstream {
+	t.Helper()
+
+	us, err := newUpstreams([]upstreamConfig{{Name: "corp", Proxies: proxies}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return us[0]
+}
+
+func Test_upstreams_match(t *testing.T) {
+	us, err := newUpstreams([]upstreamConfig{
+		{Name: "admins", Proxies: []string{"socks5://127.0.0.1:1080"}, Users: []string{"admin"}},
+		{Name: "corp", Proxies: []string{"http://127.0.0.1:3128"}, Destinations: []string{".corp.example.com", "10.0.0.0/8"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		user   string
+		domain string
+		ip     net.IP
+		want   string
+	}{
+		{name: "user", user: "admin", domain: "example.com", ip: net.IPv4(93, 184, 216, 34), want: "admins"},
+		{name: "domain", domain: "git.CORP.example.com.", ip: net.IPv4(198, 51, 100, 1), want: "corp"},
+		{name: "cidr", ip: net.IPv4(10, 1, 1, 1), want: "corp"},
+		{name: "direct", user: "alice", domain: "example.com", ip: net.IPv4(93, 184, 216, 34)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			if u := us.match(tt.user, tt.domain, tt.ip, 443); u != nil {
+				got = u.name
+			}
+			if got != tt.want {
+				t.Errorf("match() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_upstreams_matchDomain(t *testing.T) {
+	us, err := newUpstreams([]upstreamConfig{
+		{Name: "corp", Proxies: []string{"http://127.0.0.1:3128"}, Destinations: []string{".corp.example.com"}},
+		{Name: "lab", Proxies: []string{"http://127.0.0.1:3129"}, Destinations: []string{"192.0.2.0/24"}},
+		{Name: "eu", Proxies: []string{"socks5://127.0.0.1:1080"}, Destinations: []string{".eu.example.com"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		domain      string
+		want        string
+		wantDecided bool
+	}{
+		{name: "matched by domain", domain: "git.corp.example.com", want: "corp", wantDecided: true},
+		{name: "ip rule precedes", domain: "www.eu.example.com"},
+		{name: "ip rule may match", domain: "example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, decided := us.matchDomain("alice", tt.domain, 443)
+
+			var got string
+			if u != nil {
+				got = u.name
+			}
+			if got != tt.want || decided != tt.wantDecided {
+				t.Errorf("matchDomain() = %q, %v, want %q, %v", got, decided, tt.want, tt.wantDecided)
+			}
+		})
+	}
+
+	if u, decided := us[:1].matchDomain("alice", "example.com", 443); u != nil || !decided {
+		t.Errorf("matchDomain(direct) = %v, %v, want nil, true", u, decided)
+	}
+}
+
+func Test_upstream_dial(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxy   string
+		host    string
+		wantErr error
+	}{
+		{name: "socks5 domain", proxy: "socks5://alice:secret@" + fakeSOCKS5Parent(t, repSucceeded), host: "example.com"},
+		{name: "socks5 ipv6", proxy: "socks5://alice:secret@" + fakeSOCKS5Parent(t, repSucceeded), host: "2001:db8::1"},
+		{name: "socks5 refused", proxy: "socks5://alice:secret@" + fakeSOCKS5Parent(t, repConnectionRefused), host: "example.com", wantErr: proxyme.ErrConnectionRefused},
+		{name: "socks5 bad credentials", proxy: "socks5://alice:wrong@" + fakeSOCKS5Parent(t, repSucceeded), host: "example.com", wantErr: errParentFailed},
+		{name: "http", proxy: "http://alice:secret@" + fakeHTTPParent(t, http.StatusOK), host: "example.com"},
+		{name: "http forbidden", proxy: "http://alice:secret@" + fakeHTTPParent(t, http.StatusForbidden), host: "example.com", wantErr: proxyme.ErrNotAllowed},
+		{name: "http bad credentials", proxy: "http://bob:secret@" + fakeHTTPParent(t, http.StatusOK), host: "example.com", wantErr: errParentFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			conn, err := newTestUpstream(t, tt.proxy).dial(ctx, directDialer, tt.host, 443)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("dial() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("dial() error = %v", err)
+			}
+			defer conn.Close()
+
+			got, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := net.JoinHostPort(tt.host, "443"); string(got) != want {
+				t.Errorf("parent connected to %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func Test_upstream_failover(t *testing.T) {
+	down := closedAddr(t)
+	refused := fakeSOCKS5Parent(t, repConnectionRefused)
+	u := newTestUpstream(t, "http://"+down, "socks5://alice:secret@"+fakeSOCKS5Parent(t, repSucceeded), "socks5://alice:secret@"+refused)
+
+	if _, err := u.dial(context.Background(), directDialer, "example.com", 443); err != nil {
+		t.Fatalf("dial() error = %v", err)
+	}
+
+	// the failed parent is tried last
+	ordered := u.ordered(time.Now())
+	if ordered[len(ordered)-1].addr != down {
+		t.Errorf("failed parent is not moved to the end: %s", ordered[len(ordered)-1].addr)
+	}
+	if ordered = u.ordered(time.Now().Add(upstreamRetry)); ordered[0].addr != down {
+		t.Errorf("failed parent is not retried after %s", upstreamRetry)
+	}
+
+	// the destination errors are not failed over
+	u = newTestUpstream(t, "socks5://alice:secret@"+refused, "http://"+down)
+	if _, err := u.dial(context.Background(), directDialer, "example.com", 443); !errors.Is(err, proxyme.ErrConnectionRefused) {
+		t.Errorf("dial() error = %v, want %v", err, proxyme.ErrConnectionRefused)
+	}
+
+	// all the parents failed
+	u = newTestUpstream(t, "http://"+down, "http://"+closedAddr(t))
+	if _, err := u.dial(context.Background(), directDialer, "example.com", 443); !errors.Is(err, errParentFailed) {
+		t.Errorf("dial() error = %v, want %v", err, errParentFailed)
+	}
+}
+
+func Test_upstream_dial_source(t *testing.T) {
+	u := newTestUpstream(t, "socks5://alice:secret@"+fakeSOCKS5Parent(t, repSucceeded))
+
+	var dialed []net.IP
+	dialer := func(ip net.IP) (*net.Dialer, error) {
+		dialed = append(dialed, ip)
+		return &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}}, nil
+	}
+
+	conn, err := u.dial(context.Background(), dialer, "example.com", 443)
+	if err != nil {
+		t.Fatalf("dial() error = %v", err)
+	}
+	_ = conn.Close()
+
+	if len(dialed) != 1 || !dialed[0].Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("dialer got %v, want the parent address 127.0.0.1", dialed)
+	}
+
+	// the source not available for the parent fails it over
+	u = newTestUpstream(t, "socks5://alice:secret@"+fakeSOCKS5Parent(t, repSucceeded))
+	_, err = u.dial(context.Background(), func(net.IP) (*net.Dialer, error) {
+		return nil, proxyme.ErrNetworkUnreachable
+	}, "example.com", 443)
+	if !errors.Is(err, errParentFailed) {
+		t.Errorf("dial() error = %v, want %v", err, errParentFailed)
+	}
+}
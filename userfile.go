@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const userFileCheckInterval = 5 * time.Second // how often the users file is checked for changes
+
+// passwordHash is a stored password representation that is able to verify the password
+type passwordHash interface {
+	verify(password []byte) bool
+}
+
+// userFile is users database stored in htpasswd compatible file, one "username:hash" entry per line.
+// Supported hashes are bcrypt ($2a$, $2b$, $2y$) and argon2id in PHC string format.
+// The file is re-read when its modification time or size is changed, a broken file is logged
+// and the previous users remain in effect.
+type userFile struct {
+	path     string
+	interval time.Duration // min interval between the file checks
+
+	mu      sync.Mutex
+	checked time.Time // last time the file was checked
+	modTime time.Time
+	size    int64
+	users   map[string]passwordHash
+	dummy   passwordHash // verified for unknown users to make timing similar to the existing ones
+}
+
+// newUserFile loads users from the file at path
+func newUserFile(path string) (*userFile, error) {
+	f := &userFile{
+		path:     path,
+		interval: userFileCheckInterval,
+	}
+
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *userFile) authenticate(username, password []byte) error {
+	if len(username) == 0 || len(password) == 0 {
+		return errDenied
+	}
+
+	hash, dummy := f.lookup(string(username))
+	if hash == nil {
+		if dummy != nil {
+			dummy.verify(password)
+		}
+		return errDenied
+	}
+
+	if !hash.verify(password) {
+		return errDenied
+	}
+
+	return nil
+}
+
+func (f *userFile) len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.users)
+}
+
+func (f *userFile) lookup(username string) (hash, dummy passwordHash) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.refresh()
+	return f.users[username], f.dummy
+}
+
+// refresh reloads the users if the file has been changed, must be called under mutex
+func (f *userFile) refresh() {
+	now := time.Now()
+	if now.Sub(f.checked) < f.interval {
+		return
+	}
+	f.checked = now
+
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		log.Println("users file:", err)
+		return
+	}
+
+	if fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return
+	}
+
+	if err := f.load(); err != nil {
+		log.Println("reload users file:", err)
+	}
+}
+
+// load reads and parses the users file
+func (f *userFile) load() error {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return fmt.Errorf("users file: %w", err)
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("users file: %w", err)
+	}
+
+	users, err := parseUserFile(data)
+	if err != nil {
+		return fmt.Errorf("users file %s: %w", f.path, err)
+	}
+
+	f.users = users
+	f.modTime = fi.ModTime()
+	f.size = fi.Size()
+	f.dummy = nil
+	for _, hash := range users {
+		f.dummy = hash
+		break
+	}
+
+	return nil
+}
+
+// parseUserFile parses "username:hash" lines, empty lines and lines started with # are ignored
+func parseUserFile(data []byte) (map[string]passwordHash, error) {
+	users := make(map[string]passwordHash)
+
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, encoded, ok := strings.Cut(line, ":")
+		if !ok || name == "" || encoded == "" {
+			return nil, fmt.Errorf("line %d: invalid entry, want username:hash", n)
+		}
+
+		if _, ok := users[name]; ok {
+			return nil, fmt.Errorf("line %d: %q is already exists", n, name)
+		}
+
+		hash, err := parsePasswordHash(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: user %q: %w", n, name, err)
+		}
+
+		users[name] = hash
+	}
+
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func parsePasswordHash(s string) (passwordHash, error) {
+	switch {
+	case strings.HasPrefix(s, "$2a$"), strings.HasPrefix(s, "$2b$"), strings.HasPrefix(s, "$2y$"):
+		if _, err := bcrypt.Cost([]byte(s)); err != nil {
+			return nil, fmt.Errorf("invalid bcrypt hash: %w", err)
+		}
+		return bcryptHash(s), nil
+
+	case strings.HasPrefix(s, "$argon2id$"):
+		return parseArgon2id(s)
+	}
+
+	return nil, errors.New("unsupported hash, use bcrypt or argon2id")
+}
+
+// bcryptHash is bcrypt hash string, e.g. generated by `htpasswd -B`
+type bcryptHash string
+
+func (h bcryptHash) verify(password []byte) bool {
+	return bcrypt.CompareHashAndPassword([]byte(h), password) == nil
+}
+
+// argon2idHash is argon2id hash, encoded in PHC string format:
+// $argon2id$v=19$m=65536,t=3,p=4$<base64 salt>$<base64 key>
+type argon2idHash struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func parseArgon2id(s string) (argon2idHash, error) {
+	var h argon2idHash
+
+	parts := strings.Split(s, "$")
+	if len(parts) != 6 {
+		return h, errors.New("invalid argon2id hash format")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return h, fmt.Errorf("unsupported argon2id version %q", parts[2])
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return h, fmt.Errorf("invalid argon2id parameters %q", parts[3])
+	}
+	if h.memory == 0 || h.time == 0 || h.threads == 0 {
+		return h, fmt.Errorf("invalid argon2id parameters %q", parts[3])
+	}
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return h, fmt.Errorf("invalid argon2id salt: %w", err)
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return h, errors.New("invalid argon2id key")
+	}
+
+	return h, nil
+}
+
+func (h argon2idHash) verify(password []byte) bool {
+	key := argon2.IDKey(password, h.salt, h.time, h.memory, h.threads, uint32(len(h.key))) // nolint
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func bcryptEntry(t *testing.T, user, pass string) string {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("bcrypt: %v", err)
+	}
+
+	return fmt.Sprintf("%s:%s\n", user, hash)
+}
+
+func argon2idEntry(user, pass string) string {
+	salt := []byte("somesalt")
+	key := argon2.IDKey([]byte(pass), salt, 1, 64, 1, 16)
+
+	return fmt.Sprintf("%s:$argon2id$v=19$m=64,t=1,p=1$%s$%s\n", user,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))
+}
+
+func Test_parseUserFile(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		wantUsers int
+		wantErr   string
+	}{
+		{
+			name:      "empty file",
+			content:   "",
+			wantUsers: 0,
+		},
+		{
+			name:      "comments and empty lines",
+			content:   "# users\n\n" + argon2idEntry("alice", "1234") + "\n",
+			wantUsers: 1,
+		},
+		{
+			name:    "missing hash",
+			content: "alice:\n",
+			wantErr: "line 1: invalid entry",
+		},
+		{
+			name:    "missing colon",
+			content: "# comment\nalice\n",
+			wantErr: "line 2: invalid entry",
+		},
+		{
+			name:    "plain text password",
+			content: "alice:1234\n",
+			wantErr: `line 1: user "alice": unsupported hash`,
+		},
+		{
+			name:    "md5 apr1 hash",
+			content: "alice:$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/\n",
+			wantErr: "unsupported hash",
+		},
+		{
+			name:    "broken bcrypt",
+			content: "alice:$2y$05$short\n",
+			wantErr: "invalid bcrypt hash",
+		},
+		{
+			name:    "broken argon2id params",
+			content: "alice:$argon2id$v=19$m=0,t=1,p=1$c2FsdA$a2V5\n",
+			wantErr: "invalid argon2id parameters",
+		},
+		{
+			name:    "unsupported argon2id version",
+			content: "alice:$argon2id$v=16$m=64,t=1,p=1$c2FsdA$a2V5\n",
+			wantErr: "unsupported argon2id version",
+		},
+		{
+			name:    "duplicate user",
+			content: argon2idEntry("alice", "1") + argon2idEntry("alice", "2"),
+			wantErr: `line 2: "alice" is already exists`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, err := parseUserFile([]byte(tt.content))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("did not expect an error, got: %v", err)
+			}
+
+			if len(users) != tt.wantUsers {
+				t.Errorf("expected %d users, got %d", tt.wantUsers, len(users))
+			}
+		})
+	}
+}
+
+func TestUserFile_Authenticate(t *testing.T) {
+	path := writeFile(t, "users", bcryptEntry(t, "alice", "1234")+argon2idEntry("bob", "secret"))
+
+	f, err := newUserFile(path)
+	if err != nil {
+		t.Fatalf("failed to init user file: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		username    string
+		password    string
+		expectedErr error
+	}{
+		{"valid bcrypt user", "alice", "1234", nil},
+		{"valid argon2id user", "bob", "secret", nil},
+		{"invalid bcrypt password", "alice", "secret", errDenied},
+		{"invalid argon2id password", "bob", "1234", errDenied},
+		{"non-existent user", "nobody", "1234", errDenied},
+		{"empty username", "", "1234", errDenied},
+		{"empty password", "alice", "", errDenied},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := f.authenticate([]byte(tt.username), []byte(tt.password))
+			if !errors.Is(err, tt.expectedErr) {
+				t.Errorf("expected error %v, got %v", tt.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestUserFile_Reload(t *testing.T) {
+	path := writeFile(t, "users", argon2idEntry("alice", "1234"))
+
+	f, err := newUserFile(path)
+	if err != nil {
+		t.Fatalf("failed to init user file: %v", err)
+	}
+	f.interval = 0 // check the file on every authenticate
+
+	// changed password and new user
+	content := argon2idEntry("alice", "4321") + argon2idEntry("bob", "secret")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.authenticate([]byte("alice"), []byte("4321")); err != nil {
+		t.Errorf("new password: expected no error, got %v", err)
+	}
+	if err := f.authenticate([]byte("alice"), []byte("1234")); !errors.Is(err, errDenied) {
+		t.Errorf("old password: expected %v, got %v", errDenied, err)
+	}
+	if got := f.len(); got != 2 {
+		t.Errorf("expected 2 users, got %d", got)
+	}
+
+	// broken file keeps the previous users
+	if err := os.WriteFile(path, []byte("broken file content"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.authenticate([]byte("bob"), []byte("secret")); err != nil {
+		t.Errorf("broken file: expected no error, got %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"strings"
@@ -20,7 +21,8 @@ func (u uam) authenticate(username, password []byte) error {
 		return errDenied
 	}
 
-	if u.users.Get(string(username)) != string(password) {
+	// keyValueDB returns empty string for unknown user, so it never matches non-empty password
+	if subtle.ConstantTimeCompare([]byte(u.users.Get(string(username))), password) != 1 {
 		return errDenied
 	}
 
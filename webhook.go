@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// webhookAuth checks credentials by HTTP POST request with JSON body {"username": "...", "password": "..."}.
+// The webhook must reply 200 OK with JSON body {"allow": true} or {"allow": false}, 401 and 403 statuses
+// are treated as denial too.
+type webhookAuth struct {
+	url     string
+	headers map[string]string // extra request headers, e.g. Authorization
+	timeout time.Duration
+	client  *http.Client
+}
+
+func newWebhookAuth(cfg webhookConfig, timeout time.Duration) webhookAuth {
+	return webhookAuth{
+		url:     cfg.URL,
+		headers: cfg.Headers,
+		timeout: timeout,
+		client: &http.Client{
+			Timeout: timeout,
+			// the credentials are never posted to the redirect location
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+func (a webhookAuth) authenticate(username, password []byte) error {
+	if len(username) == 0 || len(password) == 0 {
+		return errDenied
+	}
+
+	body, err := json.Marshal(struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}{
+		Username: string(username),
+		Password: string(password),
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range a.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return errDenied
+	default:
+		return fmt.Errorf("webhook: unexpected status %q", resp.Status)
+	}
+
+	const maxBodySize = 4096
+
+	var result struct {
+		Allow *bool `json:"allow"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxBodySize)).Decode(&result); err != nil {
+		return fmt.Errorf("webhook: invalid response: %w", err)
+	}
+
+	if result.Allow == nil {
+		return fmt.Errorf("webhook: invalid response: allow field is missing")
+	}
+
+	if !*result.Allow {
+		return errDenied
+	}
+
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_webhookAuth(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirected" {
+			_, _ = w.Write([]byte(`{"allow": true}`))
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var req struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		switch {
+		case req.Username == "alice" && req.Password == "1234":
+			_, _ = w.Write([]byte(`{"allow": true}`))
+		case req.Username == "alice":
+			_, _ = w.Write([]byte(`{"allow": false}`))
+		case req.Username == "blocked":
+			w.WriteHeader(http.StatusForbidden)
+		case req.Username == "slow":
+			time.Sleep(time.Second)
+		case req.Username == "redirect":
+			http.Redirect(w, r, "/redirected", http.StatusTemporaryRedirect)
+		case req.Username == "broken":
+			_, _ = w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	a := newWebhookAuth(webhookConfig{
+		URL:     srv.URL,
+		Headers: map[string]string{"Authorization": "Bearer token"},
+	}, 100*time.Millisecond)
+
+	tests := []struct {
+		name        string
+		username    string
+		password    string
+		expectedErr error
+		wantErr     bool
+	}{
+		{name: "allowed", username: "alice", password: "1234"},
+		{name: "denied", username: "alice", password: "4321", expectedErr: errDenied, wantErr: true},
+		{name: "forbidden status", username: "blocked", password: "1234", expectedErr: errDenied, wantErr: true},
+		{name: "empty password", username: "alice", password: "", expectedErr: errDenied, wantErr: true},
+		{name: "server error", username: "nobody", password: "1234", wantErr: true},
+		{name: "invalid response", username: "broken", password: "1234", wantErr: true},
+		{name: "redirect is not followed", username: "redirect", password: "1234", wantErr: true},
+		{name: "timeout", username: "slow", password: "1234", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := a.authenticate([]byte(tt.username), []byte(tt.password))
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("did not expect an error, got: %v", err)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("expected an error, got nil")
+			}
+			if tt.expectedErr == nil && errors.Is(err, errDenied) {
+				t.Errorf("failure must not be reported as denial: %v", err)
+			}
+			if tt.expectedErr != nil && !errors.Is(err, tt.expectedErr) {
+				t.Errorf("expected error %v, got %v", tt.expectedErr, err)
+			}
+		})
+	}
+}